@@ -0,0 +1,63 @@
+package imagine
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+
+	"github.com/h2non/bimg"
+	"github.com/juju/errors"
+)
+
+// sampleImage downscales the image through libvips so its longest side is at
+// most maxSize pixels and decodes the result so it can be analyzed pixel by
+// pixel. Images already smaller than maxSize are only re-encoded.
+func sampleImage(data []byte, maxSize int) (image.Image, error) {
+	img := bimg.NewImage(data)
+	size, err := img.Size()
+	if err != nil {
+		return nil, errors.Annotate(err, "could not read image size")
+	}
+
+	options := bimg.Options{
+		Type:          bimg.PNG,
+		StripMetadata: true,
+	}
+	if size.Width > maxSize || size.Height > maxSize {
+		if size.Width >= size.Height {
+			options.Width = maxSize
+		} else {
+			options.Height = maxSize
+		}
+	}
+
+	sample, err := img.Process(options)
+	if err != nil {
+		return nil, errors.Annotate(err, "could not downscale image")
+	}
+
+	decoded, err := png.Decode(bytes.NewReader(sample))
+	if err != nil {
+		return nil, errors.Annotate(err, "could not decode image sample")
+	}
+
+	return decoded, nil
+}
+
+// toNRGBA returns the pixels of img as a tightly packed, non-premultiplied
+// RGBA buffer along with its dimensions.
+func toNRGBA(img image.Image) (pixels []uint8, width, height int) {
+	bounds := img.Bounds()
+	width, height = bounds.Dx(), bounds.Dy()
+	pixels = make([]uint8, 0, width*height*4)
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			pixels = append(pixels, c.R, c.G, c.B, c.A)
+		}
+	}
+
+	return pixels, width, height
+}
@@ -0,0 +1,714 @@
+package imagine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/png"
+
+	"github.com/h2non/bimg"
+	"github.com/juju/errors"
+)
+
+var (
+	// ErrAnimationTooLarge is returned when an animation has more frames or
+	// pixels than allowed
+	ErrAnimationTooLarge = errors.New("animation exceeds the frame or pixel limits")
+	// ErrAnimationUnsupported is returned when an animation is requested in a
+	// format which can't be animated
+	ErrAnimationUnsupported = errors.New("animations can't be encoded in this format")
+	// ErrFrameOutOfRange is returned when the requested frame doesn't exist
+	ErrFrameOutOfRange = errors.New("frame out of range")
+)
+
+// AnimationParams limits the animations being processed
+type AnimationParams struct {
+	// MaxFrames is the maximum number of frames of an animation. Defaults
+	// to 300.
+	MaxFrames int
+
+	// MaxPixels is the maximum number of pixels of all the frames together.
+	// Defaults to 100 megapixels.
+	MaxPixels int
+}
+
+// withDefaults sets the default values for the animation parameters
+func (p *AnimationParams) withDefaults() {
+	if p.MaxFrames == 0 {
+		p.MaxFrames = 300
+	}
+	if p.MaxPixels == 0 {
+		p.MaxPixels = 100 * 1000 * 1000
+	}
+}
+
+// GIF disposal methods, shared by the WebP frames
+const (
+	disposeNone       = gif.DisposalNone
+	disposeBackground = gif.DisposalBackground
+	disposePrevious   = gif.DisposalPrevious
+)
+
+// animationHeader is what can be told about an animation without decoding it
+type animationHeader struct {
+	frames, width, height int
+}
+
+// readAnimationHeader returns the header of an animated GIF or WebP, nil is
+// returned for still images
+func readAnimationHeader(data []byte) *animationHeader {
+	var h *animationHeader
+	switch bimg.DetermineImageType(data) {
+	case bimg.GIF:
+		h = readGIFHeader(data)
+	case bimg.WEBP:
+		h = readWebPHeader(data)
+	}
+
+	if h == nil || h.frames < 2 {
+		return nil
+	}
+	return h
+}
+
+// readGIFHeader counts the frames of a GIF walking its blocks, the image
+// data itself is skipped
+func readGIFHeader(data []byte) *animationHeader {
+	if len(data) < 13 {
+		return nil
+	}
+
+	h := &animationHeader{
+		width:  int(binary.LittleEndian.Uint16(data[6:])),
+		height: int(binary.LittleEndian.Uint16(data[8:])),
+	}
+
+	pos := 13
+	if data[10]&0x80 != 0 {
+		pos += 3 << (data[10]&0x07 + 1)
+	}
+
+	skipSubBlocks := func() bool {
+		for pos < len(data) {
+			size := int(data[pos])
+			pos += 1 + size
+			if size == 0 {
+				return true
+			}
+		}
+		return false
+	}
+
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x21:
+			// extension: introducer, label and sub-blocks
+			pos += 2
+			if !skipSubBlocks() {
+				return h
+			}
+		case 0x2C:
+			// image descriptor, color table, LZW code size and sub-blocks
+			if pos+10 > len(data) {
+				return h
+			}
+			packed := data[pos+9]
+			pos += 10
+			if packed&0x80 != 0 {
+				pos += 3 << (packed&0x07 + 1)
+			}
+			pos++
+			if !skipSubBlocks() {
+				return h
+			}
+			h.frames++
+		default:
+			// trailer
+			return h
+		}
+	}
+
+	return h
+}
+
+// readWebPHeader counts the frames of an animated WebP
+func readWebPHeader(data []byte) *animationHeader {
+	chunks, err := webpChunks(data)
+	if err != nil || len(chunks) == 0 || chunks[0].id != "VP8X" || len(chunks[0].data) < 10 {
+		return nil
+	}
+
+	vp8x := chunks[0].data
+	if vp8x[0]&webpAnimationFlag == 0 {
+		return nil
+	}
+
+	h := &animationHeader{
+		width:  1 + int(uint24(vp8x[4:])),
+		height: 1 + int(uint24(vp8x[7:])),
+	}
+	for _, c := range chunks {
+		if c.id == "ANMF" {
+			h.frames++
+		}
+	}
+
+	return h
+}
+
+// checkAnimation enforces the animation limits
+func (i *Imagine) checkAnimation(h *animationHeader) error {
+	limits := i.params.Animation
+	if h.frames > limits.MaxFrames {
+		return errors.Annotatef(ErrAnimationTooLarge, "%d frames over a limit of %d", h.frames, limits.MaxFrames)
+	}
+	if pixels := h.frames * h.width * h.height; pixels > limits.MaxPixels {
+		return errors.Annotatef(ErrAnimationTooLarge, "%d pixels over a limit of %d", pixels, limits.MaxPixels)
+	}
+	return nil
+}
+
+// animation is a decoded animated image
+type animation struct {
+	width, height int
+
+	// loops is the number of times the animation is played, 0 loops forever
+	loops int
+
+	frames []animationFrame
+}
+
+// animationFrame is a frame of an animation along with how it's laid out on
+// the canvas
+type animationFrame struct {
+	bounds image.Rectangle
+
+	// delay is the display duration in milliseconds
+	delay int
+
+	// blend draws the frame over the canvas instead of replacing its area
+	blend bool
+
+	// disposal tells how the frame area is cleared before the next frame
+	disposal byte
+
+	decode func() (image.Image, error)
+}
+
+// decodeAnimation decodes an animated GIF or WebP within the limits, nil is
+// returned for still images
+func (i *Imagine) decodeAnimation(data []byte) (*animation, error) {
+	h := readAnimationHeader(data)
+	if h == nil {
+		return nil, nil
+	}
+
+	if err := i.checkAnimation(h); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if bimg.DetermineImageType(data) == bimg.GIF {
+		return decodeGIFAnimation(data)
+	}
+	return decodeWebPAnimation(data)
+}
+
+// decodeGIFAnimation decodes the frames of an animated GIF
+func decodeGIFAnimation(data []byte) (*animation, error) {
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.Annotate(err, "could not decode gif")
+	}
+
+	a := &animation{
+		width:  g.Config.Width,
+		height: g.Config.Height,
+	}
+
+	// GIF counts the repetitions after the first play
+	switch {
+	case g.LoopCount < 0:
+		a.loops = 1
+	case g.LoopCount > 0:
+		a.loops = g.LoopCount + 1
+	}
+
+	for idx, frame := range g.Image {
+		frame := frame
+		disposal := byte(disposeNone)
+		if idx < len(g.Disposal) && g.Disposal[idx] != 0 {
+			disposal = g.Disposal[idx]
+		}
+		a.frames = append(a.frames, animationFrame{
+			bounds:   frame.Bounds(),
+			delay:    g.Delay[idx] * 10,
+			blend:    true,
+			disposal: disposal,
+			decode:   func() (image.Image, error) { return frame, nil },
+		})
+	}
+
+	return a, nil
+}
+
+// composite renders the frames on the canvas in order, canvas is only valid
+// during the call to render
+func (a *animation) composite(frames int, render func(idx int, canvas *image.NRGBA) error) error {
+	canvas := image.NewNRGBA(image.Rect(0, 0, a.width, a.height))
+	transparent := image.NewUniform(color.Transparent)
+
+	for idx, frame := range a.frames[:frames] {
+		img, err := frame.decode()
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		var previous *image.NRGBA
+		if frame.disposal == disposePrevious {
+			previous = image.NewNRGBA(canvas.Rect)
+			copy(previous.Pix, canvas.Pix)
+		}
+
+		op := draw.Src
+		if frame.blend {
+			op = draw.Over
+		}
+		draw.Draw(canvas, frame.bounds, img, img.Bounds().Min, op)
+
+		if err := render(idx, canvas); err != nil {
+			return errors.Trace(err)
+		}
+
+		switch frame.disposal {
+		case disposeBackground:
+			draw.Draw(canvas, frame.bounds, transparent, image.Point{}, draw.Src)
+		case disposePrevious:
+			canvas = previous
+		}
+	}
+
+	return nil
+}
+
+// transparent tells whether any frame of the animation has transparent
+// pixels once composited
+func (a *animation) transparent() (bool, error) {
+	transparent := false
+	err := a.composite(len(a.frames), func(_ int, canvas *image.NRGBA) error {
+		transparent = transparent || !canvas.Opaque()
+		return nil
+	})
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+
+	return transparent, nil
+}
+
+// extractFrame renders the nth frame, starting at 1, of an animation as PNG
+func (i *Imagine) extractFrame(data []byte, n int) ([]byte, error) {
+	a, err := i.decodeAnimation(data)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	frames := 1
+	if a != nil {
+		frames = len(a.frames)
+	}
+	if n > frames {
+		return nil, errors.Annotatef(ErrFrameOutOfRange, "frame %d of %d", n, frames)
+	}
+	if a == nil {
+		return data, nil
+	}
+
+	var still bytes.Buffer
+	err = a.composite(n, func(idx int, canvas *image.NRGBA) error {
+		if idx < n-1 {
+			return nil
+		}
+		return png.Encode(&still, canvas)
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return still.Bytes(), nil
+}
+
+// processAnimation applies options to every frame of an animation and
+// encodes the result as an animated GIF, WebP or AVIF
+func (i *Imagine) processAnimation(a *animation, options bimg.Options, outputType bimg.ImageType) (*bimg.Image, error) {
+	frameOptions := options
+	frameOptions.StripMetadata = true
+	frameOptions.InputICC = ""
+	frameOptions.OutputICC = ""
+
+	keepAlpha := false
+	switch outputType {
+	case bimg.GIF:
+		frameOptions.Type = bimg.PNG
+	case bimg.WEBP:
+		frameOptions.Type = bimg.WEBP
+	case bimg.AVIF:
+		frameOptions.Type = bimg.AVIF
+
+		// the alpha track of an AVIF sequence needs a sample for every
+		// frame, so every frame keeps its alpha channel when any is
+		// transparent
+		transparent, err := a.transparent()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		keepAlpha = transparent
+	default:
+		return nil, errors.Annotatef(ErrAnimationUnsupported, "format %s", bimg.ImageTypeName(outputType))
+	}
+
+	encoder := &png.Encoder{CompressionLevel: png.BestSpeed}
+	frames := make([][]byte, 0, len(a.frames))
+	err := a.composite(len(a.frames), func(idx int, canvas *image.NRGBA) error {
+		// PNG drops the alpha channel of opaque images, an almost opaque
+		// pixel keeps it
+		if keepAlpha && len(canvas.Pix) > 0 && canvas.Opaque() {
+			canvas.Pix[3] = 0xfe
+			defer func() { canvas.Pix[3] = 0xff }()
+		}
+
+		var buf bytes.Buffer
+		if err := encoder.Encode(&buf, canvas); err != nil {
+			return errors.Trace(err)
+		}
+
+		frame, err := bimg.NewImage(buf.Bytes()).Process(frameOptions)
+		if err != nil {
+			return errors.Annotatef(err, "could not process frame %d", idx+1)
+		}
+		frames = append(frames, frame)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var encoded []byte
+	switch outputType {
+	case bimg.GIF:
+		encoded, err = encodeGIFAnimation(a, frames)
+	case bimg.WEBP:
+		encoded, err = encodeWebPAnimation(a, frames)
+	default:
+		encoded, err = encodeAVIFAnimation(a, frames)
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return bimg.NewImage(encoded), nil
+}
+
+// encodeGIFAnimation quantizes the processed PNG frames with a palette shared
+// by the whole animation
+func encodeGIFAnimation(a *animation, frames [][]byte) ([]byte, error) {
+	images := make([]image.Image, len(frames))
+	for idx, frame := range frames {
+		img, err := png.Decode(bytes.NewReader(frame))
+		if err != nil {
+			return nil, errors.Annotate(err, "could not decode frame")
+		}
+		images[idx] = img
+	}
+
+	palette, err := animationPalette(frames)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	transparentIndex := uint8(len(palette) - 1)
+
+	g := &gif.GIF{}
+	switch a.loops {
+	case 0:
+		g.LoopCount = 0
+	case 1:
+		g.LoopCount = -1
+	default:
+		g.LoopCount = a.loops - 1
+	}
+
+	for idx, img := range images {
+		paletted := image.NewPaletted(img.Bounds(), palette)
+		draw.FloydSteinberg.Draw(paletted, img.Bounds(), img, img.Bounds().Min)
+
+		// dithering is not meant for the alpha channel
+		bounds := img.Bounds()
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				if _, _, _, alpha := img.At(x, y).RGBA(); alpha < 0x8000 {
+					paletted.SetColorIndex(x, y, transparentIndex)
+				}
+			}
+		}
+
+		// every frame covers the whole canvas
+		g.Image = append(g.Image, paletted)
+		g.Delay = append(g.Delay, a.frames[idx].delay/10)
+		g.Disposal = append(g.Disposal, disposeBackground)
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		return nil, errors.Annotate(err, "could not encode gif")
+	}
+
+	return buf.Bytes(), nil
+}
+
+// animationPalette clusters the colors of a few frames spread over the
+// animation into a 255 colors palette, the last entry is transparent
+func animationPalette(frames [][]byte) (color.Palette, error) {
+	const samples = 4
+	step := maxInt(1, len(frames)/samples)
+
+	mosaic := image.NewNRGBA(image.Rect(0, 0, paletteSampleSize*samples, paletteSampleSize))
+	for s := 0; s < samples && s*step < len(frames); s++ {
+		sample, err := sampleImage(frames[s*step], paletteSampleSize)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		offset := image.Pt(s*paletteSampleSize, 0)
+		draw.Draw(mosaic, sample.Bounds().Add(offset), sample, sample.Bounds().Min, draw.Src)
+	}
+
+	palette := color.Palette{}
+	for _, c := range clusterColors(mosaic, 255) {
+		palette = append(palette, color.NRGBA{c.R, c.G, c.B, 255})
+	}
+
+	return append(palette, color.Transparent), nil
+}
+
+// WebP container constants
+const (
+	webpAlphaFlag     = 0x10
+	webpAnimationFlag = 0x02
+	// webpNoBlend set in the ANMF flags replaces the frame area instead of
+	// alpha blending the frame over it
+	webpNoBlend = 0x02
+	// webpDisposeBackground set in the ANMF flags clears the frame area
+	// before the next frame
+	webpDisposeBackground = 0x01
+)
+
+// riffChunk is a chunk of a RIFF container
+type riffChunk struct {
+	id   string
+	data []byte
+}
+
+// webpChunks splits a WebP file into its chunks
+func webpChunks(data []byte) ([]riffChunk, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errors.New("not a webp file")
+	}
+
+	return readChunks(data[12:])
+}
+
+// readChunks reads consecutive RIFF chunks
+func readChunks(data []byte) ([]riffChunk, error) {
+	var chunks []riffChunk
+	for pos := 0; pos+8 <= len(data); {
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		if size < 0 || pos+8+size > len(data) {
+			return nil, errors.New("truncated webp chunk")
+		}
+		chunks = append(chunks, riffChunk{id: string(data[pos : pos+4]), data: data[pos+8 : pos+8+size]})
+		pos += 8 + size + size&1
+	}
+
+	return chunks, nil
+}
+
+// appendChunk appends a RIFF chunk, padded to an even size
+func appendChunk(b []byte, id string, data []byte) []byte {
+	b = append(b, id...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(data)))
+	b = append(b, data...)
+	if len(data)&1 == 1 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// riffWebP wraps chunks in a WebP RIFF container
+func riffWebP(chunks []byte) []byte {
+	b := []byte("RIFF")
+	b = binary.LittleEndian.AppendUint32(b, uint32(4+len(chunks)))
+	b = append(b, "WEBP"...)
+	return append(b, chunks...)
+}
+
+func uint24(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
+
+func appendUint24(b []byte, v int) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16))
+}
+
+// decodeWebPAnimation reads the frames of an animated WebP. Every frame is
+// turned into a still WebP decoded by libvips.
+func decodeWebPAnimation(data []byte) (*animation, error) {
+	chunks, err := webpChunks(data)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	vp8x := chunks[0].data
+	a := &animation{
+		width:  1 + int(uint24(vp8x[4:])),
+		height: 1 + int(uint24(vp8x[7:])),
+	}
+
+	for _, c := range chunks {
+		switch c.id {
+		case "ANIM":
+			if len(c.data) >= 6 {
+				a.loops = int(binary.LittleEndian.Uint16(c.data[4:]))
+			}
+		case "ANMF":
+			if len(c.data) < 16 {
+				return nil, errors.New("truncated webp frame")
+			}
+			x, y := 2*int(uint24(c.data)), 2*int(uint24(c.data[3:]))
+			width, height := 1+int(uint24(c.data[6:])), 1+int(uint24(c.data[9:]))
+			flags := c.data[15]
+
+			disposal := byte(disposeNone)
+			if flags&webpDisposeBackground != 0 {
+				disposal = disposeBackground
+			}
+
+			still, err := stillWebP(c.data[16:], width, height)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+
+			a.frames = append(a.frames, animationFrame{
+				bounds:   image.Rect(x, y, x+width, y+height),
+				delay:    int(uint24(c.data[12:])),
+				blend:    flags&webpNoBlend == 0,
+				disposal: disposal,
+				decode:   func() (image.Image, error) { return decodeStill(still) },
+			})
+		}
+	}
+
+	return a, nil
+}
+
+// stillWebP turns the bitstream chunks of an animation frame into a still WebP
+func stillWebP(frameData []byte, width, height int) ([]byte, error) {
+	chunks, err := readChunks(frameData)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var body []byte
+	alpha := false
+	for _, c := range chunks {
+		switch c.id {
+		case "ALPH":
+			alpha = true
+			fallthrough
+		case "VP8 ", "VP8L":
+			body = appendChunk(body, c.id, c.data)
+		}
+	}
+	if body == nil {
+		return nil, errors.New("webp frame without image data")
+	}
+
+	// a separate alpha chunk is only valid in the extended format
+	if alpha {
+		vp8x := []byte{webpAlphaFlag, 0, 0, 0}
+		vp8x = appendUint24(vp8x, width-1)
+		vp8x = appendUint24(vp8x, height-1)
+		body = append(appendChunk(nil, "VP8X", vp8x), body...)
+	}
+
+	return riffWebP(body), nil
+}
+
+// decodeStill decodes a still image libvips can read
+func decodeStill(data []byte) (image.Image, error) {
+	converted, err := bimg.NewImage(data).Process(bimg.Options{Type: bimg.PNG})
+	if err != nil {
+		return nil, errors.Annotate(err, "could not decode frame")
+	}
+
+	img, err := png.Decode(bytes.NewReader(converted))
+	if err != nil {
+		return nil, errors.Annotate(err, "could not decode frame")
+	}
+
+	return img, nil
+}
+
+// encodeWebPAnimation muxes the processed still WebP frames into an animated
+// WebP, every frame covers the whole canvas
+func encodeWebPAnimation(a *animation, frames [][]byte) ([]byte, error) {
+	var width, height int
+	var body []byte
+	alpha := false
+	for idx, frame := range frames {
+		size, err := bimg.NewImage(frame).Size()
+		if err != nil {
+			return nil, errors.Annotate(err, "could not read frame size")
+		}
+		width, height = size.Width, size.Height
+
+		chunks, err := webpChunks(frame)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		anmf := appendUint24(nil, 0)
+		anmf = appendUint24(anmf, 0)
+		anmf = appendUint24(anmf, size.Width-1)
+		anmf = appendUint24(anmf, size.Height-1)
+		anmf = appendUint24(anmf, a.frames[idx].delay)
+		anmf = append(anmf, webpNoBlend)
+		for _, c := range chunks {
+			switch c.id {
+			case "ALPH", "VP8L":
+				// lossless frames may carry an alpha channel too
+				alpha = true
+				fallthrough
+			case "VP8 ":
+				anmf = appendChunk(anmf, c.id, c.data)
+			}
+		}
+		body = appendChunk(body, "ANMF", anmf)
+	}
+
+	flags := byte(webpAnimationFlag)
+	if alpha {
+		flags |= webpAlphaFlag
+	}
+	vp8x := []byte{flags, 0, 0, 0}
+	vp8x = appendUint24(vp8x, width-1)
+	vp8x = appendUint24(vp8x, height-1)
+
+	// transparent background, then the loop count
+	anim := binary.LittleEndian.AppendUint16([]byte{0, 0, 0, 0}, uint16(a.loops))
+
+	header := appendChunk(nil, "VP8X", vp8x)
+	header = appendChunk(header, "ANIM", anim)
+
+	return riffWebP(append(header, body...)), nil
+}
@@ -0,0 +1,285 @@
+package imagine_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/risico/imagine"
+)
+
+var animationColors = []color.RGBA{
+	{255, 0, 0, 255},
+	{0, 255, 0, 255},
+	{0, 0, 255, 255},
+}
+
+func TestAnimation(t *testing.T) {
+	storage := imagine.NewInMemoryStorage(imagine.MemoryStoreParams{})
+	i, err := imagine.New(imagine.Params{
+		Storage: storage,
+		Cache:   imagine.NewInMemoryStorage(imagine.MemoryStoreParams{}),
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, storage.Set(testSlug+".gif", animatedGIF(t, 40, 30)))
+
+	t.Run("resize every frame", func(t *testing.T) {
+		pi, err := i.Get(testSlug+".gif", &imagine.ImageParams{Width: 20, Format: "gif"})
+		assert.NoError(t, err)
+
+		g, err := gif.DecodeAll(bytes.NewReader(pi.Image))
+		assert.NoError(t, err)
+		assert.Len(t, g.Image, 3)
+		assert.Equal(t, []int{10, 20, 30}, g.Delay)
+		assert.Equal(t, 2, g.LoopCount)
+		assert.Equal(t, 20, g.Config.Width)
+		assert.Equal(t, 15, g.Config.Height)
+		for idx, frame := range g.Image {
+			assertColor(t, animationColors[idx], frame.At(10, 7))
+		}
+	})
+
+	t.Run("animated webp", func(t *testing.T) {
+		pi, err := i.Get(testSlug+".gif", &imagine.ImageParams{Width: 20, Format: "webp"})
+		assert.NoError(t, err)
+
+		chunks := riffChunks(t, pi.Image)
+		assert.Equal(t, "VP8X", chunks[0].id)
+		assert.NotZero(t, chunks[0].data[0]&0x02, "animation flag")
+		assert.Equal(t, "ANIM", chunks[1].id)
+		assert.Equal(t, uint16(3), binary.LittleEndian.Uint16(chunks[1].data[4:]))
+
+		var durations []int
+		for _, c := range chunks[2:] {
+			assert.Equal(t, "ANMF", c.id)
+			durations = append(durations, int(c.data[12])|int(c.data[13])<<8|int(c.data[14])<<16)
+		}
+		assert.Equal(t, []int{100, 200, 300}, durations)
+
+		// read the animated webp back
+		assert.NoError(t, storage.Set(testSlug+".webp", pi.Image))
+		still, err := i.Get(testSlug+".webp", &imagine.ImageParams{Frame: 3, Format: "png"})
+		assert.NoError(t, err)
+		assertFrameColor(t, animationColors[2], still.Image)
+	})
+
+	t.Run("extract a frame", func(t *testing.T) {
+		pi, err := i.Get(testSlug+".gif", &imagine.ImageParams{Frame: 2, Format: "png"})
+		assert.NoError(t, err)
+		assertFrameColor(t, animationColors[1], pi.Image)
+	})
+
+	t.Run("frame out of range", func(t *testing.T) {
+		_, err := i.Get(testSlug+".gif", &imagine.ImageParams{Frame: 4, Format: "png"})
+		assert.Equal(t, imagine.ErrFrameOutOfRange, errors.Cause(err))
+
+		request := httptest.NewRequest("GET", "/"+testSlug+".gif?frame=4", nil)
+		response := httptest.NewRecorder()
+		i.GetHandlerFunc().ServeHTTP(response, request)
+		assert.Equal(t, http.StatusBadRequest, response.Code)
+	})
+
+	t.Run("animated avif", func(t *testing.T) {
+		pi, err := i.Get(testSlug+".gif", &imagine.ImageParams{Width: 20, Format: "avif"})
+		assert.NoError(t, err)
+		assert.Equal(t, "avif", pi.Type)
+		assert.Equal(t, "ftypavis", string(pi.Image[4:12]))
+
+		moov := isoBox(t, pi.Image, "moov")
+		traks := isoBoxes(t, moov, "trak")
+		assert.Len(t, traks, 1)
+
+		stbl := isoBox(t, isoBox(t, isoBox(t, traks[0], "mdia"), "minf"), "stbl")
+		assert.Equal(t, uint32(3), binary.BigEndian.Uint32(isoBox(t, stbl, "stsz")[8:]))
+		stts := isoBox(t, stbl, "stts")
+		assert.Equal(t, uint32(3), binary.BigEndian.Uint32(stts[4:]))
+		for idx := 0; idx < 3; idx++ {
+			assert.Equal(t, uint32((idx+1)*100), binary.BigEndian.Uint32(stts[12+idx*8:]))
+		}
+
+		// three plays of 600ms
+		mvhd := isoBox(t, moov, "mvhd")
+		assert.Equal(t, uint64(1800), binary.BigEndian.Uint64(mvhd[24:]))
+
+		// the primary item is the first frame
+		still, err := i.Get(testSlug+".gif", &imagine.ImageParams{Width: 20, Frame: 1, Format: "avif"})
+		assert.NoError(t, err)
+		assert.Equal(t, isoBox(t, still.Image, "mdat"), isoBox(t, pi.Image, "mdat")[:len(isoBox(t, still.Image, "mdat"))])
+
+		// served from the cache
+		cached, err := i.Get(testSlug+".gif", &imagine.ImageParams{Width: 20, Format: "avif"})
+		assert.NoError(t, err)
+		assert.Equal(t, "avif", cached.Type)
+	})
+
+	t.Run("transparent avif", func(t *testing.T) {
+		assert.NoError(t, storage.Set(testSlug+"t.gif", transparentGIF(t)))
+		pi, err := i.Get(testSlug+"t.gif", &imagine.ImageParams{Format: "avif"})
+		assert.NoError(t, err)
+
+		traks := isoBoxes(t, isoBox(t, pi.Image, "moov"), "trak")
+		if !assert.Len(t, traks, 2) {
+			return
+		}
+		for _, trak := range traks {
+			stbl := isoBox(t, isoBox(t, isoBox(t, trak, "mdia"), "minf"), "stbl")
+			assert.Equal(t, uint32(2), binary.BigEndian.Uint32(isoBox(t, stbl, "stsz")[8:]))
+		}
+		assert.Equal(t, "auxv", string(isoBox(t, isoBox(t, traks[1], "mdia"), "hdlr")[8:12]))
+		assert.NotNil(t, isoBox(t, traks[1], "tref"))
+	})
+
+	t.Run("upload keeps the animation", func(t *testing.T) {
+		slug, err := i.Upload(animatedGIF(t, 40, 30))
+		assert.NoError(t, err)
+
+		stored, _, err := storage.Get(slug)
+		assert.NoError(t, err)
+		g, err := gif.DecodeAll(bytes.NewReader(stored))
+		assert.NoError(t, err)
+		assert.Len(t, g.Image, 3)
+	})
+}
+
+func TestAnimationLimits(t *testing.T) {
+	storage := imagine.NewInMemoryStorage(imagine.MemoryStoreParams{})
+	i, err := imagine.New(imagine.Params{
+		Storage: storage,
+		Cache:   imagine.NewInMemoryStorage(imagine.MemoryStoreParams{}),
+		Animation: imagine.AnimationParams{
+			MaxFrames: 2,
+		},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, storage.Set(testSlug+".gif", animatedGIF(t, 40, 30)))
+
+	_, err = i.Get(testSlug+".gif", &imagine.ImageParams{Width: 20, Format: "gif"})
+	assert.Equal(t, imagine.ErrAnimationTooLarge, errors.Cause(err))
+
+	_, err = i.Upload(animatedGIF(t, 40, 30))
+	assert.Equal(t, imagine.ErrAnimationTooLarge, errors.Cause(err))
+
+	t.Run("pixels", func(t *testing.T) {
+		i, err := imagine.New(imagine.Params{
+			Storage: storage,
+			Cache:   imagine.NewInMemoryStorage(imagine.MemoryStoreParams{}),
+			Animation: imagine.AnimationParams{
+				MaxPixels: 3*40*30 - 1,
+			},
+		})
+		assert.NoError(t, err)
+
+		_, err = i.Get(testSlug+".gif", &imagine.ImageParams{Width: 20, Format: "gif"})
+		assert.Equal(t, imagine.ErrAnimationTooLarge, errors.Cause(err))
+	})
+}
+
+// animatedGIF encodes a red, green and blue animation looping twice after
+// the first play
+func animatedGIF(t *testing.T, width, height int) []byte {
+	g := &gif.GIF{LoopCount: 2}
+	for idx, c := range animationColors {
+		frame := image.NewPaletted(image.Rect(0, 0, width, height), color.Palette{c})
+		g.Image = append(g.Image, frame)
+		g.Delay = append(g.Delay, (idx+1)*10)
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, gif.EncodeAll(&buf, g))
+	return buf.Bytes()
+}
+
+func assertFrameColor(t *testing.T, expected color.RGBA, data []byte) {
+	img, err := png.Decode(bytes.NewReader(data))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	center := img.Bounds().Size().Div(2)
+	assertColor(t, expected, img.At(center.X, center.Y))
+}
+
+// assertColor compares colors with some tolerance for lossy encodings
+func assertColor(t *testing.T, expected color.RGBA, actual color.Color) {
+	r, g, b, _ := actual.RGBA()
+	assert.InDelta(t, expected.R, r>>8, 24)
+	assert.InDelta(t, expected.G, g>>8, 24)
+	assert.InDelta(t, expected.B, b>>8, 24)
+}
+
+// transparentGIF encodes an opaque red frame followed by a green frame
+// transparent on its left half
+func transparentGIF(t *testing.T) []byte {
+	opaque := image.NewPaletted(image.Rect(0, 0, 20, 20), color.Palette{animationColors[0]})
+	half := image.NewPaletted(image.Rect(0, 0, 20, 20), color.Palette{color.Transparent, animationColors[1]})
+	for y := 0; y < 20; y++ {
+		for x := 10; x < 20; x++ {
+			half.SetColorIndex(x, y, 1)
+		}
+	}
+
+	g := &gif.GIF{
+		Image:    []*image.Paletted{opaque, half},
+		Delay:    []int{10, 10},
+		Disposal: []byte{gif.DisposalBackground, gif.DisposalNone},
+	}
+	var buf bytes.Buffer
+	assert.NoError(t, gif.EncodeAll(&buf, g))
+	return buf.Bytes()
+}
+
+// isoBoxes returns the payloads of the boxes of the given type
+func isoBoxes(t *testing.T, data []byte, typ string) [][]byte {
+	var boxes [][]byte
+	for pos := 0; pos+8 <= len(data); {
+		size := int(binary.BigEndian.Uint32(data[pos:]))
+		if !assert.True(t, size >= 8 && pos+size <= len(data), "box size") {
+			return nil
+		}
+		if string(data[pos+4:pos+8]) == typ {
+			boxes = append(boxes, data[pos+8:pos+size])
+		}
+		pos += size
+	}
+
+	return boxes
+}
+
+// isoBox returns the payload of the first box of the given type
+func isoBox(t *testing.T, data []byte, typ string) []byte {
+	boxes := isoBoxes(t, data, typ)
+	if !assert.NotEmpty(t, boxes, typ) {
+		return nil
+	}
+
+	return boxes[0]
+}
+
+type riffChunk struct {
+	id   string
+	data []byte
+}
+
+func riffChunks(t *testing.T, data []byte) []riffChunk {
+	if !assert.True(t, len(data) > 12 && string(data[8:12]) == "WEBP") {
+		return nil
+	}
+
+	var chunks []riffChunk
+	for pos := 12; pos+8 <= len(data); {
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		chunks = append(chunks, riffChunk{id: string(data[pos : pos+4]), data: data[pos+8 : pos+8+size]})
+		pos += 8 + size + size&1
+	}
+
+	return chunks
+}
@@ -0,0 +1,701 @@
+package imagine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+
+	"github.com/h2non/bimg"
+	"github.com/juju/errors"
+)
+
+// avifAlphaURN is the auxiliary type of the alpha plane of an AVIF image
+const avifAlphaURN = "urn:mpeg:mpegB:cicp:systems:auxiliary:alpha"
+
+// avifTimescale is the number of time units per second of the tracks, the
+// frame delays are in milliseconds
+const avifTimescale = 1000
+
+// isoBox is a box of an ISO base media file, data excludes the header
+type isoBox struct {
+	typ  string
+	raw  []byte
+	data []byte
+}
+
+// readBoxes splits data into consecutive boxes
+func readBoxes(data []byte) ([]isoBox, error) {
+	var boxes []isoBox
+	for pos := 0; pos < len(data); {
+		if len(data)-pos < 8 {
+			return nil, errors.New("truncated box header")
+		}
+		size := uint64(binary.BigEndian.Uint32(data[pos:]))
+		typ := string(data[pos+4 : pos+8])
+		header := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data) - pos)
+		case 1:
+			if len(data)-pos < 16 {
+				return nil, errors.New("truncated box header")
+			}
+			size = binary.BigEndian.Uint64(data[pos+8:])
+			header = 16
+		}
+		if size < header || size > uint64(len(data)-pos) {
+			return nil, errors.Errorf("invalid size of box %q", typ)
+		}
+
+		end := pos + int(size)
+		boxes = append(boxes, isoBox{typ: typ, raw: data[pos:end], data: data[pos+int(header) : end]})
+		pos = end
+	}
+
+	return boxes, nil
+}
+
+// boxReader reads the big endian fields of a box, reading past the end
+// returns zeroes and sets err
+type boxReader struct {
+	data []byte
+	err  error
+}
+
+// fullBox reads the version and flags of a full box
+func fullBox(data []byte) (*boxReader, int, uint32) {
+	r := &boxReader{data: data}
+	header := uint32(r.uint(4))
+	return r, int(header >> 24), header & 0xffffff
+}
+
+func (r *boxReader) next(n int) []byte {
+	if r.err != nil || n > len(r.data) {
+		r.err = errors.New("truncated box")
+		return make([]byte, n)
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+// uint reads an unsigned integer of n bytes
+func (r *boxReader) uint(n int) uint64 {
+	var v uint64
+	for _, c := range r.next(n) {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+// avifItem is an AV1 image item of a still AVIF
+type avifItem struct {
+	data []byte
+
+	// props are the property boxes associated with the item
+	props []avifProperty
+}
+
+type avifProperty struct {
+	box       isoBox
+	essential bool
+}
+
+// prop returns the first property of the given type
+func (item *avifItem) prop(typ string) *isoBox {
+	for idx := range item.props {
+		if item.props[idx].box.typ == typ {
+			return &item.props[idx].box
+		}
+	}
+	return nil
+}
+
+// size returns the dimensions of the item
+func (item *avifItem) size() (int, int, error) {
+	ispe := item.prop("ispe")
+	if ispe == nil {
+		return 0, 0, errors.New("avif item without size")
+	}
+	r, _, _ := fullBox(ispe.data)
+	width, height := r.uint(4), r.uint(4)
+	if r.err != nil {
+		return 0, 0, errors.Trace(r.err)
+	}
+	return int(width), int(height), nil
+}
+
+// isAlpha tells whether an auxiliary item is an alpha plane
+func (item *avifItem) isAlpha() bool {
+	auxC := item.prop("auxC")
+	if auxC == nil || len(auxC.data) < 4 {
+		return false
+	}
+	urn := auxC.data[4:]
+	if end := bytes.IndexByte(urn, 0); end >= 0 {
+		urn = urn[:end]
+	}
+	return string(urn) == avifAlphaURN
+}
+
+// avifImage is the color and, when transparent, alpha item of a still AVIF
+type avifImage struct {
+	color, alpha *avifItem
+}
+
+// readAVIF reads the primary item of a still AVIF and its alpha plane
+func readAVIF(data []byte) (*avifImage, error) {
+	boxes, err := readBoxes(data)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var meta []byte
+	for _, b := range boxes {
+		if b.typ == "meta" && len(b.data) >= 4 {
+			meta = b.data[4:]
+		}
+	}
+	if meta == nil {
+		return nil, errors.New("avif without meta box")
+	}
+
+	children, err := readBoxes(meta)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	box := map[string][]byte{}
+	for _, b := range children {
+		if _, ok := box[b.typ]; !ok {
+			box[b.typ] = b.data
+		}
+	}
+
+	r, version, _ := fullBox(box["pitm"])
+	idSize := 2
+	if version > 0 {
+		idSize = 4
+	}
+	primary := uint32(r.uint(idSize))
+	if r.err != nil {
+		return nil, errors.Annotate(r.err, "could not read the primary item")
+	}
+
+	items, err := avifItemData(box["iloc"], box["idat"], data)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := avifItemProperties(items, box["iprp"]); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	img := &avifImage{color: items[primary]}
+	if img.color == nil {
+		return nil, errors.New("avif without primary item")
+	}
+
+	alpha, err := avifReferences(box["iref"], "auxl", primary)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for _, id := range alpha {
+		if item := items[id]; item != nil && item.isAlpha() {
+			img.alpha = item
+		}
+	}
+
+	return img, nil
+}
+
+// avifItemData reads the data of the items located in the file or in idat
+func avifItemData(iloc, idat, file []byte) (map[uint32]*avifItem, error) {
+	r, version, _ := fullBox(iloc)
+	if version > 2 {
+		return nil, errors.Errorf("unsupported iloc version %d", version)
+	}
+	sizes := r.uint(1)
+	offsetSize, lengthSize := int(sizes>>4), int(sizes&0xf)
+	sizes = r.uint(1)
+	baseSize, indexSize := int(sizes>>4), int(sizes&0xf)
+	if version == 0 {
+		indexSize = 0
+	}
+
+	idSize := 2
+	if version == 2 {
+		idSize = 4
+	}
+	count := r.uint(idSize)
+
+	items := map[uint32]*avifItem{}
+	for n := uint64(0); n < count && r.err == nil; n++ {
+		id := uint32(r.uint(idSize))
+		method := uint64(0)
+		if version > 0 {
+			method = r.uint(2) & 0xf
+		}
+		r.uint(2) // data reference index
+		base := r.uint(baseSize)
+
+		var source []byte
+		switch method {
+		case 0:
+			source = file
+		case 1:
+			source = idat
+		default:
+			return nil, errors.Errorf("unsupported construction method %d", method)
+		}
+
+		item := &avifItem{}
+		extents := r.uint(2)
+		for e := uint64(0); e < extents && r.err == nil; e++ {
+			r.uint(indexSize)
+			offset := base + r.uint(offsetSize)
+			length := r.uint(lengthSize)
+			if offset > uint64(len(source)) {
+				return nil, errors.Errorf("item %d out of bounds", id)
+			}
+			if length == 0 {
+				length = uint64(len(source)) - offset
+			}
+			if length > uint64(len(source))-offset {
+				return nil, errors.Errorf("item %d out of bounds", id)
+			}
+			item.data = append(item.data, source[offset:offset+length]...)
+		}
+		items[id] = item
+	}
+	if r.err != nil {
+		return nil, errors.Annotate(r.err, "could not read the item locations")
+	}
+
+	return items, nil
+}
+
+// avifItemProperties associates the properties in iprp with the items
+func avifItemProperties(items map[uint32]*avifItem, iprp []byte) error {
+	children, err := readBoxes(iprp)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var props []isoBox
+	var ipma []byte
+	for _, b := range children {
+		switch b.typ {
+		case "ipco":
+			if props, err = readBoxes(b.data); err != nil {
+				return errors.Trace(err)
+			}
+		case "ipma":
+			ipma = b.data
+		}
+	}
+
+	r, version, flags := fullBox(ipma)
+	idSize := 2
+	if version > 0 {
+		idSize = 4
+	}
+	count := r.uint(4)
+	for n := uint64(0); n < count && r.err == nil; n++ {
+		item := items[uint32(r.uint(idSize))]
+		associations := r.uint(1)
+		for a := uint64(0); a < associations && r.err == nil; a++ {
+			var index uint64
+			var essential bool
+			if flags&1 != 0 {
+				v := r.uint(2)
+				index, essential = v&0x7fff, v&0x8000 != 0
+			} else {
+				v := r.uint(1)
+				index, essential = v&0x7f, v&0x80 != 0
+			}
+			if index == 0 || item == nil {
+				continue
+			}
+			if index > uint64(len(props)) {
+				return errors.Errorf("property %d out of range", index)
+			}
+			item.props = append(item.props, avifProperty{box: props[index-1], essential: essential})
+		}
+	}
+	if r.err != nil {
+		return errors.Annotate(r.err, "could not read the item properties")
+	}
+
+	return nil
+}
+
+// avifReferences returns the items referencing the item to with the given
+// reference type
+func avifReferences(iref []byte, typ string, to uint32) ([]uint32, error) {
+	if iref == nil {
+		return nil, nil
+	}
+	r, version, _ := fullBox(iref)
+	if r.err != nil {
+		return nil, errors.Trace(r.err)
+	}
+	idSize := 2
+	if version > 0 {
+		idSize = 4
+	}
+
+	refs, err := readBoxes(r.data)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var from []uint32
+	for _, ref := range refs {
+		if ref.typ != typ {
+			continue
+		}
+		r := &boxReader{data: ref.data}
+		id := uint32(r.uint(idSize))
+		count := r.uint(2)
+		for n := uint64(0); n < count && r.err == nil; n++ {
+			if uint32(r.uint(idSize)) == to {
+				from = append(from, id)
+			}
+		}
+		if r.err != nil {
+			return nil, errors.Annotate(r.err, "could not read the item references")
+		}
+	}
+
+	return from, nil
+}
+
+// appendBox appends a box to b
+func appendBox(b []byte, typ string, data ...[]byte) []byte {
+	size := 8
+	for _, d := range data {
+		size += len(d)
+	}
+	b = binary.BigEndian.AppendUint32(b, uint32(size))
+	b = append(b, typ...)
+	for _, d := range data {
+		b = append(b, d...)
+	}
+	return b
+}
+
+// appendFullBox appends a box with a version and flags to b
+func appendFullBox(b []byte, typ string, version byte, flags uint32, data ...[]byte) []byte {
+	header := binary.BigEndian.AppendUint32(nil, uint32(version)<<24|flags)
+	return appendBox(b, typ, append([][]byte{header}, data...)...)
+}
+
+// be builds big endian fields
+func be(values ...interface{}) []byte {
+	var b []byte
+	for _, v := range values {
+		switch v := v.(type) {
+		case uint16:
+			b = binary.BigEndian.AppendUint16(b, v)
+		case uint32:
+			b = binary.BigEndian.AppendUint32(b, v)
+		case uint64:
+			b = binary.BigEndian.AppendUint64(b, v)
+		case string:
+			b = append(b, v...)
+		case []byte:
+			b = append(b, v...)
+		default:
+			panic("unsupported field type")
+		}
+	}
+	return b
+}
+
+// unityMatrix is the identity transformation of the movie and track headers
+var unityMatrix = be(uint32(0x10000), uint32(0), uint32(0), uint32(0), uint32(0x10000), uint32(0), uint32(0), uint32(0), uint32(0x40000000))
+
+// avifSequence lays out the frames of an animation as an AVIF image sequence
+type avifSequence struct {
+	frames []*avifImage
+
+	// delays are the durations of the frames in milliseconds
+	delays []uint32
+
+	// loops is the number of plays, 0 plays forever
+	loops int
+
+	width, height int
+}
+
+// encodeAVIFAnimation muxes the processed still AVIF frames into an AVIF
+// image sequence. The first frame is the primary item too, for readers
+// without sequence support.
+func encodeAVIFAnimation(a *animation, frames [][]byte) ([]byte, error) {
+	s := &avifSequence{loops: a.loops}
+	for idx, frame := range frames {
+		img, err := readAVIF(frame)
+		if err != nil {
+			return nil, errors.Annotatef(err, "could not read frame %d", idx+1)
+		}
+		if idx > 0 && (img.alpha == nil) != (s.frames[0].alpha == nil) {
+			return nil, errors.Errorf("frame %d differs in transparency", idx+1)
+		}
+		for _, item := range []*avifItem{img.color, img.alpha} {
+			if item != nil && item.prop("av1C") == nil {
+				return nil, errors.Errorf("frame %d without av1 configuration", idx+1)
+			}
+		}
+		s.frames = append(s.frames, img)
+
+		// every sample needs a duration
+		s.delays = append(s.delays, uint32(maxInt(1, a.frames[idx].delay)))
+	}
+
+	var err error
+	s.width, s.height, err = s.frames[0].color.size()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var mdat []byte
+	for _, img := range s.frames {
+		mdat = append(mdat, img.color.data...)
+	}
+	for _, img := range s.frames {
+		if img.alpha != nil {
+			mdat = append(mdat, img.alpha.data...)
+		}
+	}
+
+	ftyp := appendBox(nil, "ftyp", be("avis", uint32(0), "avisavifmsf1iso8mif1miaf"))
+
+	// the box sizes don't depend on the offsets of the samples
+	start := uint64(len(ftyp)+len(s.meta(0))+len(s.moov(0))) + 8
+	if start+uint64(len(mdat)) > math.MaxUint32 {
+		return nil, errors.New("avif animation too large")
+	}
+
+	encoded := append(ftyp, s.meta(uint32(start))...)
+	encoded = append(encoded, s.moov(uint32(start))...)
+	return appendBox(encoded, "mdat", mdat), nil
+}
+
+// colorSize is the size of the color samples, the alpha samples follow them
+func (s *avifSequence) colorSize() uint32 {
+	size := 0
+	for _, img := range s.frames {
+		size += len(img.color.data)
+	}
+	return uint32(size)
+}
+
+// meta describes the first frame as the primary item
+func (s *avifSequence) meta(offset uint32) []byte {
+	items := []*avifItem{s.frames[0].color}
+	if alpha := s.frames[0].alpha; alpha != nil {
+		items = append(items, alpha)
+	}
+
+	iloc := be([]byte{0x44, 0}, uint16(len(items)))
+	iinf := be(uint16(len(items)))
+	var ipco [][]byte
+	var associations [][]uint16
+	for idx, item := range items {
+		id := uint16(idx + 1)
+		name, itemOffset := "Color", offset
+		if idx == 1 {
+			name, itemOffset = "Alpha", offset+s.colorSize()
+		}
+		iloc = append(iloc, be(id, uint16(0), uint16(1), itemOffset, uint32(len(item.data)))...)
+		iinf = appendFullBox(iinf, "infe", 2, 0, be(id, uint16(0), "av01", name, []byte{0}))
+
+		// the properties shared by both items are stored once
+		var indices []uint16
+		for _, p := range item.props {
+			index := 0
+			for index < len(ipco) && !bytes.Equal(ipco[index], p.box.raw) {
+				index++
+			}
+			if index == len(ipco) {
+				ipco = append(ipco, p.box.raw)
+			}
+			if p.essential {
+				indices = append(indices, uint16(index+1)|0x8000)
+			} else {
+				indices = append(indices, uint16(index+1))
+			}
+		}
+		associations = append(associations, indices)
+	}
+
+	// the property indices are 7 bits wide unless flagged otherwise
+	var flags uint32
+	if len(ipco) > 0x7f {
+		flags = 1
+	}
+	ipma := be(uint32(len(items)))
+	for idx, indices := range associations {
+		ipma = append(ipma, be(uint16(idx+1))...)
+		ipma = append(ipma, byte(len(indices)))
+		for _, index := range indices {
+			if flags == 1 {
+				ipma = append(ipma, be(index)...)
+			} else {
+				ipma = append(ipma, byte(index>>8&0x80|index&0x7f))
+			}
+		}
+	}
+
+	meta := appendFullBox(nil, "hdlr", 0, 0, be(uint32(0), "pict", make([]byte, 13)))
+	meta = appendFullBox(meta, "pitm", 0, 0, be(uint16(1)))
+	meta = appendFullBox(meta, "iloc", 0, 0, iloc)
+	meta = appendFullBox(meta, "iinf", 0, 0, iinf)
+	if len(items) > 1 {
+		meta = appendFullBox(meta, "iref", 0, 0, appendBox(nil, "auxl", be(uint16(2), uint16(1), uint16(1))))
+	}
+	iprp := appendBox(nil, "ipco", ipco...)
+	iprp = appendFullBox(iprp, "ipma", 0, flags, ipma)
+	meta = appendBox(meta, "iprp", iprp)
+
+	return appendFullBox(nil, "meta", 0, 0, meta)
+}
+
+// duration returns the duration of a single play and of all the plays
+func (s *avifSequence) duration() (uint64, uint64) {
+	var play uint64
+	for _, delay := range s.delays {
+		play += uint64(delay)
+	}
+	if s.loops == 0 {
+		return play, math.MaxUint64
+	}
+	return play, play * uint64(s.loops)
+}
+
+// moov describes the frames as a color track and, when transparent, an
+// auxiliary alpha track
+func (s *avifSequence) moov(offset uint32) []byte {
+	_, total := s.duration()
+	tracks := uint32(1)
+	if s.frames[0].alpha != nil {
+		tracks = 2
+	}
+
+	moov := appendFullBox(nil, "mvhd", 1, 0, be(
+		uint64(0), uint64(0), uint32(avifTimescale), total,
+		uint32(0x10000), uint16(0x100), make([]byte, 10), unityMatrix, make([]byte, 24),
+		tracks+1,
+	))
+
+	var color [][]byte
+	for _, img := range s.frames {
+		color = append(color, img.color.data)
+	}
+	entry := s.sampleEntry(s.frames[0].color, "colr")
+	moov = append(moov, s.trak(1, "pict", color, offset, entry)...)
+
+	if tracks == 2 {
+		var alpha [][]byte
+		for _, img := range s.frames {
+			alpha = append(alpha, img.alpha.data)
+		}
+		entry := s.sampleEntry(s.frames[0].alpha)
+		entry = appendFullBox(entry, "auxi", 0, 0, be(avifAlphaURN, []byte{0}))
+		moov = append(moov, s.trak(2, "auxv", alpha, offset+s.colorSize(), entry)...)
+	}
+
+	return appendBox(nil, "moov", moov)
+}
+
+// sampleEntry returns the AV1 sample entry of a track, without the box
+// header, with the configuration and the given properties of the item
+func (s *avifSequence) sampleEntry(item *avifItem, props ...string) []byte {
+	compressor := make([]byte, 32)
+	compressor[0] = byte(copy(compressor[1:], "AOM Coding"))
+
+	entry := be(
+		make([]byte, 6), uint16(1), make([]byte, 16),
+		uint16(s.width), uint16(s.height), uint32(0x480000), uint32(0x480000), uint32(0),
+		uint16(1), compressor, uint16(0x18), uint16(0xffff),
+	)
+	entry = append(entry, item.prop("av1C").raw...)
+	for _, p := range item.props {
+		for _, typ := range props {
+			if p.box.typ == typ {
+				entry = append(entry, p.box.raw...)
+			}
+		}
+	}
+
+	// every sample is an intra frame
+	return appendFullBox(entry, "ccst", 0, 0, be(uint32(0xc0000000)))
+}
+
+// trak describes the samples of a track, stored in a single chunk
+func (s *avifSequence) trak(id uint32, handler string, samples [][]byte, offset uint32, entry []byte) []byte {
+	play, total := s.duration()
+
+	trak := appendFullBox(nil, "tkhd", 1, 1, be(
+		uint64(0), uint64(0), id, uint32(0), total, make([]byte, 16),
+		unityMatrix, uint32(s.width)<<16, uint32(s.height)<<16,
+	))
+	if handler == "auxv" {
+		trak = appendBox(trak, "tref", appendBox(nil, "auxl", be(uint32(1))))
+	}
+
+	// the edit list repeats the frames unless they're played once
+	var repeat uint32
+	if s.loops != 1 {
+		repeat = 1
+	}
+	elst := appendFullBox(nil, "elst", 1, repeat, be(uint32(1), play, uint64(0), uint16(1), uint16(0)))
+	trak = appendBox(trak, "edts", elst)
+
+	var stts []byte
+	entries := uint32(0)
+	for idx := 0; idx < len(s.delays); {
+		n := 1
+		for idx+n < len(s.delays) && s.delays[idx+n] == s.delays[idx] {
+			n++
+		}
+		stts = append(stts, be(uint32(n), s.delays[idx])...)
+		entries++
+		idx += n
+	}
+
+	stsz := be(uint32(0), uint32(len(samples)))
+	for _, sample := range samples {
+		stsz = append(stsz, be(uint32(len(sample)))...)
+	}
+
+	stbl := appendFullBox(nil, "stsd", 0, 0, be(uint32(1)), appendBox(nil, "av01", entry))
+	stbl = appendFullBox(stbl, "stts", 0, 0, be(entries), stts)
+	stbl = appendFullBox(stbl, "stsc", 0, 0, be(uint32(1), uint32(1), uint32(len(samples)), uint32(1)))
+	stbl = appendFullBox(stbl, "stsz", 0, 0, stsz)
+	stbl = appendFullBox(stbl, "stco", 0, 0, be(uint32(1), offset))
+
+	dinf := appendBox(nil, "dinf", appendFullBox(nil, "dref", 0, 0, be(uint32(1)), appendFullBox(nil, "url ", 0, 1)))
+	minf := appendFullBox(nil, "vmhd", 0, 1, make([]byte, 8))
+	minf = append(minf, dinf...)
+	minf = appendBox(minf, "stbl", stbl)
+
+	mdia := appendFullBox(nil, "mdhd", 1, 0, be(uint64(0), uint64(0), uint32(avifTimescale), play, uint16(0x55c4), uint16(0)))
+	mdia = appendFullBox(mdia, "hdlr", 0, 0, be(uint32(0), handler, make([]byte, 13)))
+	mdia = appendBox(mdia, "minf", minf)
+
+	return appendBox(nil, "trak", append(trak, appendBox(nil, "mdia", mdia)...))
+}
+
+// isAVIFSequence tells whether data is an AVIF image sequence, which bimg
+// doesn't recognize
+func isAVIFSequence(data []byte) bool {
+	return len(data) >= 12 && string(data[4:12]) == "ftypavis"
+}
+
+// imageType names the type of an encoded image
+func imageType(data []byte) string {
+	if isAVIFSequence(data) {
+		return "avif"
+	}
+	return bimg.DetermineImageTypeName(data)
+}
@@ -0,0 +1,170 @@
+package imagine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/juju/errors"
+)
+
+// ErrTooManyFiles is returned when a bulk upload carries more files than
+// allowed
+var ErrTooManyFiles = errors.New("too many files")
+
+// BulkParams configures the bulk upload endpoint
+type BulkParams struct {
+	// MaxFiles is the maximum number of files of a bulk upload. Defaults
+	// to 20.
+	MaxFiles int
+}
+
+// withDefaults sets the default values for the bulk upload parameters
+func (p *BulkParams) withDefaults() {
+	if p.MaxFiles == 0 {
+		p.MaxFiles = 20
+	}
+}
+
+// BulkUploadResult is the outcome of the upload of one file of a bulk upload
+type BulkUploadResult struct {
+	Filename string `json:"filename"`
+	Slug     string `json:"slug,omitempty"`
+	Width    int    `json:"width,omitempty"`
+	Height   int    `json:"height,omitempty"`
+
+	// Status is the HTTP status the file would have been answered with on
+	// its own, along with the error message of failed uploads
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// bulkFile is a file read from a bulk upload
+type bulkFile struct {
+	name string
+	data []byte
+	err  error
+}
+
+// BulkUploadHandlerFunc handles the upload of several images at once, sent as
+// file fields of a multipart form
+func (i *Imagine) BulkUploadHandlerFunc() http.HandlerFunc {
+	return http.HandlerFunc(i.bulkUploadHandler)
+}
+
+// BulkUpload uploads several images concurrently, within the worker limit.
+// Failed uploads don't prevent the others from being stored, the results are
+// in the order of the images.
+func (i *Imagine) BulkUpload(images ...[]byte) []BulkUploadResult {
+	files := make([]bulkFile, len(images))
+	for idx, data := range images {
+		files[idx] = bulkFile{data: data}
+	}
+	return i.bulkUpload(files, i.params.UploadPolicy)
+}
+
+// bulkUpload uploads the files concurrently, the results are in the order of
+// the files
+func (i *Imagine) bulkUpload(files []bulkFile, policy UploadPolicy) []BulkUploadResult {
+	results := make([]BulkUploadResult, len(files))
+
+	var wg sync.WaitGroup
+	for idx, file := range files {
+		results[idx].Filename = file.name
+		if file.err != nil {
+			results[idx].Status = errorStatus(file.err)
+			results[idx].Error = file.err.Error()
+			continue
+		}
+
+		wg.Add(1)
+		go func(result *BulkUploadResult, data []byte) {
+			defer wg.Done()
+
+			i.workers <- struct{}{}
+			defer func() { <-i.workers }()
+
+			uploaded, err := i.upload(data, policy)
+			if err != nil {
+				result.Status = errorStatus(err)
+				result.Error = err.Error()
+				return
+			}
+
+			result.Status = http.StatusOK
+			result.Slug = uploaded.Slug
+			result.Width, result.Height = uploaded.Width, uploaded.Height
+		}(&results[idx], file.data)
+	}
+	wg.Wait()
+
+	return results
+}
+
+func (i *Imagine) bulkUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	maxFiles := i.params.Bulk.MaxFiles
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxFiles)*int64(i.params.MaxImageSize+multipartOverhead))
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var files []bulkFile
+	for {
+		part, err := reader.NextPart()
+		var maxBytesErr *http.MaxBytesError
+		if err == io.EOF {
+			break
+		} else if err != nil && errors.As(err, &maxBytesErr) {
+			http.Error(w, "bulk upload exceeds the maximum size", http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if part.FormName() != "file" {
+			continue
+		}
+		if len(files) == maxFiles {
+			err := errors.Annotatef(ErrTooManyFiles, "more than %d files", maxFiles)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// read one byte more than allowed to tell full files from truncated
+		// ones, the rest of a large file is skipped by the next part
+		file := bulkFile{name: part.FileName()}
+		file.data, file.err = ioutil.ReadAll(io.LimitReader(part, int64(i.params.MaxImageSize)+1))
+		if file.err != nil && errors.As(file.err, &maxBytesErr) {
+			http.Error(w, "bulk upload exceeds the maximum size", http.StatusRequestEntityTooLarge)
+			return
+		} else if file.err == nil && len(file.data) > i.params.MaxImageSize {
+			file.err = errors.Annotatef(ErrFileTooLarge, "over a limit of %d bytes", i.params.MaxImageSize)
+		}
+		files = append(files, file)
+	}
+
+	if len(files) == 0 {
+		http.Error(w, "no file uploaded", http.StatusBadRequest)
+		return
+	}
+
+	results := i.bulkUpload(files, i.params.UploadPolicy)
+	fmt.Printf("[Imagine] Bulk upload of %d files done\n", len(results))
+
+	// failed files are reported in their result, the request itself succeeds
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(results)
+}
@@ -0,0 +1,70 @@
+package imagine_test
+
+import (
+	"encoding/json"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/risico/imagine"
+)
+
+func TestBulkUpload(t *testing.T) {
+	storage := imagine.NewInMemoryStorage(imagine.MemoryStoreParams{})
+	i, err := imagine.New(imagine.Params{
+		Storage: storage,
+		Cache:   imagine.NewInMemoryStorage(imagine.MemoryStoreParams{}),
+		Workers: 2,
+		Bulk:    imagine.BulkParams{MaxFiles: 3},
+	})
+	assert.NoError(t, err)
+
+	t.Run("partial success", func(t *testing.T) {
+		request := multipartRequest(t, "/", "file",
+			solidImage(t, 30, 20, color.White),
+			[]byte("not an image"),
+			solidImage(t, 10, 40, color.Black),
+		)
+		response := httptest.NewRecorder()
+		i.BulkUploadHandlerFunc().ServeHTTP(response, request)
+		assert.Equal(t, http.StatusOK, response.Code)
+
+		var results []imagine.BulkUploadResult
+		assert.NoError(t, json.NewDecoder(response.Body).Decode(&results))
+		if !assert.Len(t, results, 3) {
+			return
+		}
+
+		assert.Equal(t, "image0.png", results[0].Filename)
+		assert.Equal(t, http.StatusOK, results[0].Status)
+		assert.Equal(t, 30, results[0].Width)
+		assert.Equal(t, 20, results[0].Height)
+		_, found, err := storage.Get(results[0].Slug)
+		assert.NoError(t, err)
+		assert.True(t, found)
+
+		assert.Empty(t, results[1].Slug)
+		assert.Equal(t, http.StatusInternalServerError, results[1].Status)
+		assert.Contains(t, results[1].Error, "invalid image type")
+
+		assert.Equal(t, 10, results[2].Width)
+		assert.Equal(t, 40, results[2].Height)
+	})
+
+	t.Run("too many files", func(t *testing.T) {
+		image := solidImage(t, 10, 10, color.White)
+		request := multipartRequest(t, "/", "file", image, image, image, image)
+		response := httptest.NewRecorder()
+		i.BulkUploadHandlerFunc().ServeHTTP(response, request)
+		assert.Equal(t, http.StatusBadRequest, response.Code)
+	})
+
+	t.Run("programmatic", func(t *testing.T) {
+		results := i.BulkUpload(solidImage(t, 5, 5, color.White), []byte("not an image"))
+		assert.Equal(t, http.StatusOK, results[0].Status)
+		assert.Equal(t, http.StatusInternalServerError, results[1].Status)
+	})
+}
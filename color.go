@@ -0,0 +1,130 @@
+package imagine
+
+import (
+	"github.com/h2non/bimg"
+	"github.com/juju/errors"
+)
+
+const (
+	// ColorSpaceSRGB converts images carrying an ICC profile, and CMYK
+	// images, to sRGB
+	ColorSpaceSRGB = "srgb"
+	// ColorSpaceP3 converts images to Display P3 and embeds the profile, for
+	// clients able to render wide gamut colors
+	ColorSpaceP3 = "p3"
+	// ColorSpaceKeep leaves the colors and the embedded profile untouched
+	ColorSpaceKeep = "keep"
+)
+
+// ColorParams configures the color management of processed images
+type ColorParams struct {
+	// ColorSpace is the color space images are delivered in, it can be
+	// overridden per request. Defaults to ColorSpaceSRGB.
+	ColorSpace string
+
+	// SRGBProfile, P3Profile and CMYKProfile are the ICC profiles used for
+	// the conversions, either a path to an ICC file or the name of a libvips
+	// built-in profile. They default to the srgb, p3 and cmyk built-ins.
+	// CMYKProfile is only used for CMYK images without an embedded profile.
+	SRGBProfile string
+	P3Profile   string
+	CMYKProfile string
+}
+
+// withDefaults sets the default values for the color parameters
+func (p *ColorParams) withDefaults() {
+	if p.ColorSpace == "" {
+		p.ColorSpace = ColorSpaceSRGB
+	}
+	if p.SRGBProfile == "" {
+		p.SRGBProfile = "srgb"
+	}
+	if p.P3Profile == "" {
+		p.P3Profile = "p3"
+	}
+	if p.CMYKProfile == "" {
+		p.CMYKProfile = "cmyk"
+	}
+}
+
+// validColorSpace tells whether space is a known color space
+func validColorSpace(space string) bool {
+	switch space {
+	case ColorSpaceSRGB, ColorSpaceP3, ColorSpaceKeep:
+		return true
+	}
+	return false
+}
+
+// colorSpace returns the color space applying to params
+func (i *Imagine) colorSpace(params *ImageParams) string {
+	if params != nil && params.ColorSpace != "" {
+		return params.ColorSpace
+	}
+	return i.params.Color.ColorSpace
+}
+
+// convertColors sets the ICC transform of options converting an image
+// described by metadata to space. It returns the profile which has to be
+// embedded in the output, if any.
+func (i *Imagine) convertColors(options *bimg.Options, space string, metadata bimg.ImageMetadata) string {
+	// grayscale output has no use for a color profile
+	if space == ColorSpaceKeep || options.Interpretation == bimg.InterpretationBW {
+		return ""
+	}
+
+	cmyk := metadata.Space == "cmyk"
+	if cmyk {
+		// keep libvips from converting CMYK to sRGB before the ICC transform
+		options.Interpretation = bimg.InterpretationCMYK
+	}
+
+	switch space {
+	case ColorSpaceP3:
+		options.OutputICC = i.params.Color.P3Profile
+		if !metadata.Profile {
+			options.InputICC = i.params.Color.SRGBProfile
+			if cmyk {
+				options.InputICC = i.params.Color.CMYKProfile
+			}
+		}
+		return options.OutputICC
+
+	default:
+		// images without a profile are already assumed to be sRGB
+		if !metadata.Profile && !cmyk {
+			return ""
+		}
+		options.OutputICC = i.params.Color.SRGBProfile
+		if !metadata.Profile {
+			options.InputICC = i.params.Color.CMYKProfile
+		}
+		return ""
+	}
+}
+
+// embedProfile processes an image whose metadata has to be stripped while
+// keeping its color profile. libvips strips the profile along with the rest
+// of the metadata, so the image is converted to a lossless intermediate first
+// and the profile is attached again when encoding the final format.
+func embedProfile(image []byte, options bimg.Options, outputType bimg.ImageType, profile string) ([]byte, error) {
+	options.Type = bimg.PNG
+	converted, err := bimg.NewImage(image).Process(options)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// an identity transform attaching the profile to the untagged image
+	embedded, err := bimg.NewImage(converted).Process(bimg.Options{
+		Type:      outputType,
+		Quality:   options.Quality,
+		Lossless:  options.Lossless,
+		InputICC:  profile,
+		OutputICC: profile,
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return embedded, nil
+}
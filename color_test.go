@@ -0,0 +1,285 @@
+package imagine_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/risico/imagine"
+)
+
+// wideGamutProfile is the description of the test ICC profile, it's looked
+// up in the output to tell whether the original profile was kept
+const wideGamutProfile = "Imagine Test Wide Gamut"
+
+func TestColorConversion(t *testing.T) {
+	storage := imagine.NewInMemoryStorage(imagine.MemoryStoreParams{})
+	i, err := imagine.New(imagine.Params{
+		Storage: storage,
+		Cache:   imagine.NewInMemoryStorage(imagine.MemoryStoreParams{}),
+	})
+	assert.NoError(t, err)
+
+	assert.NoError(t, storage.Set(testSlug+".jpg", jpegWithProfile(t, wideGamutICC())))
+
+	tests := []struct {
+		name        string
+		params      imagine.ImageParams
+		keepProfile bool
+		hasProfile  bool
+	}{
+		{
+			name:       "srgb by default",
+			params:     imagine.ImageParams{Width: 16, Format: "jpeg", Metadata: "icc"},
+			hasProfile: true,
+		},
+		{
+			name:        "keep the original profile",
+			params:      imagine.ImageParams{Width: 16, Format: "jpeg", ColorSpace: imagine.ColorSpaceKeep},
+			keepProfile: true,
+			hasProfile:  true,
+		},
+		{
+			name:       "embed display p3",
+			params:     imagine.ImageParams{Width: 16, Format: "jpeg", ColorSpace: imagine.ColorSpaceP3},
+			hasProfile: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pi, err := i.Get(testSlug+".jpg", &tt.params)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.keepProfile, bytes.Contains(pi.Image, []byte(wideGamutProfile)))
+			assert.Equal(t, tt.hasProfile, bytes.Contains(pi.Image, []byte("ICC_PROFILE")))
+		})
+	}
+
+	t.Run("untagged images are left alone", func(t *testing.T) {
+		assert.NoError(t, storage.Set(testSlug+".png", solidImage(t, 16, 16, color.RGBA{200, 100, 50, 255})))
+
+		pi, err := i.Get(testSlug+".png", &imagine.ImageParams{Width: 16, Format: "jpeg", Metadata: "icc"})
+		assert.NoError(t, err)
+		assert.False(t, bytes.Contains(pi.Image, []byte("ICC_PROFILE")))
+	})
+
+	t.Run("cmyk", func(t *testing.T) {
+		assert.NoError(t, storage.Set(testSlug+".jpeg", cmykJPEG(16, 16, [4]uint8{255, 0, 0, 0})))
+
+		pi, err := i.Get(testSlug+".jpeg", &imagine.ImageParams{Width: 16, Format: "jpeg"})
+		assert.NoError(t, err)
+		assertCyan(t, pi.Image)
+	})
+}
+
+func TestUploadNormalizesCMYK(t *testing.T) {
+	i, err := imagine.New(imagine.Params{
+		Storage: imagine.NewInMemoryStorage(imagine.MemoryStoreParams{}),
+		Cache:   imagine.NewInMemoryStorage(imagine.MemoryStoreParams{}),
+	})
+	assert.NoError(t, err)
+
+	slug, err := i.Upload(cmykJPEG(16, 16, [4]uint8{255, 0, 0, 0}))
+	assert.NoError(t, err)
+
+	info, err := i.Info(slug, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "srgb", info.ColorSpace)
+	assert.Equal(t, 3, info.Channels)
+
+	t.Run("invalid color space", func(t *testing.T) {
+		_, err := imagine.New(imagine.Params{Color: imagine.ColorParams{ColorSpace: "adobe"}})
+		assert.Error(t, err)
+	})
+}
+
+// assertCyan decodes a JPEG and checks its center pixel is cyan
+func assertCyan(t *testing.T, data []byte) {
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	center := img.Bounds().Size().Div(2)
+	r, g, b, _ := img.At(center.X, center.Y).RGBA()
+	assert.Less(t, r>>8, uint32(100))
+	assert.Greater(t, g>>8, uint32(150))
+	assert.Greater(t, b>>8, uint32(150))
+}
+
+// jpegWithProfile encodes a JPEG with the ICC profile embedded
+func jpegWithProfile(t *testing.T, profile []byte) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 32, 32))
+	for x := 0; x < 32; x++ {
+		for y := 0; y < 32; y++ {
+			img.Set(x, y, color.RGBA{200, 100, 50, 255})
+		}
+	}
+	var buf bytes.Buffer
+	assert.NoError(t, jpeg.Encode(&buf, img, nil))
+
+	// single chunk APP2 segment
+	payload := append([]byte("ICC_PROFILE\x00\x01\x01"), profile...)
+	segment := []byte{0xFF, 0xE2, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	segment = append(segment, payload...)
+
+	data := buf.Bytes()
+	return append(append([]byte{0xFF, 0xD8}, segment...), data[2:]...)
+}
+
+// wideGamutICC builds an ICC v2 matrix/TRC display profile with the Adobe RGB
+// (1998) primaries
+func wideGamutICC() []byte {
+	be := binary.BigEndian
+	s15 := func(b []byte, v ...float64) []byte {
+		for _, f := range v {
+			b = be.AppendUint32(b, uint32(int32(math.Round(f*65536))))
+		}
+		return b
+	}
+	xyz := func(x, y, z float64) []byte {
+		return s15([]byte("XYZ \x00\x00\x00\x00"), x, y, z)
+	}
+
+	desc := []byte("desc\x00\x00\x00\x00")
+	desc = be.AppendUint32(desc, uint32(len(wideGamutProfile)+1))
+	desc = append(append(desc, wideGamutProfile...), 0)
+	desc = append(desc, make([]byte, 4+4+2+1+67)...)
+
+	// gamma 2.2 as u8Fixed8
+	curve := []byte("curv\x00\x00\x00\x00\x00\x00\x00\x01\x02\x33\x00\x00")
+
+	tags := []struct {
+		signature string
+		data      []byte
+	}{
+		{"desc", desc},
+		{"wtpt", xyz(0.9642, 1, 0.8249)},
+		{"rXYZ", xyz(0.6097, 0.3111, 0.0195)},
+		{"gXYZ", xyz(0.2053, 0.6257, 0.0609)},
+		{"bXYZ", xyz(0.1492, 0.0632, 0.7446)},
+		{"rTRC", curve},
+		{"gTRC", curve},
+		{"bTRC", curve},
+	}
+
+	table := be.AppendUint32(nil, uint32(len(tags)))
+	var data []byte
+	offset := 128 + 4 + 12*len(tags)
+	for _, tag := range tags {
+		table = append(table, tag.signature...)
+		table = be.AppendUint32(table, uint32(offset+len(data)))
+		table = be.AppendUint32(table, uint32(len(tag.data)))
+		data = append(data, tag.data...)
+		for len(data)%4 != 0 {
+			data = append(data, 0)
+		}
+	}
+
+	header := make([]byte, 128)
+	be.PutUint32(header, uint32(128+len(table)+len(data)))
+	be.PutUint32(header[8:], 0x02100000)
+	copy(header[12:], "mntrRGB XYZ ")
+	copy(header[36:], "acsp")
+	s15(header[68:68], 0.9642, 1, 0.8249)
+
+	return append(append(header, table...), data...)
+}
+
+// cmykJPEG encodes a solid color CMYK JPEG, flagged by an Adobe APP14 segment
+// and stored inverted the way Photoshop does. The standard library can't
+// encode CMYK so the DC only baseline stream is written by hand.
+func cmykJPEG(width, height int, cmyk [4]uint8) []byte {
+	be := binary.BigEndian
+	segment := func(b []byte, marker byte, payload []byte) []byte {
+		b = append(b, 0xFF, marker)
+		b = be.AppendUint16(b, uint16(len(payload)+2))
+		return append(b, payload...)
+	}
+
+	data := []byte{0xFF, 0xD8}
+	data = segment(data, 0xEE, []byte("Adobe\x00\x64\x00\x00\x00\x00\x00"))
+
+	// a quantization table of ones keeps the DC values exact
+	dqt := make([]byte, 65)
+	for idx := 1; idx < 65; idx++ {
+		dqt[idx] = 1
+	}
+	data = segment(data, 0xDB, dqt)
+
+	sof := []byte{8}
+	sof = be.AppendUint16(sof, uint16(height))
+	sof = be.AppendUint16(sof, uint16(width))
+	sof = append(sof, 4)
+	for c := byte(1); c <= 4; c++ {
+		sof = append(sof, c, 0x11, 0)
+	}
+	data = segment(data, 0xC0, sof)
+
+	// DC categories 0 to 11 all get a 4 bit code equal to the category, the
+	// AC table only holds the end of block code 0
+	dc := make([]byte, 17, 29)
+	dc[4] = 12
+	for category := byte(0); category < 12; category++ {
+		dc = append(dc, category)
+	}
+	data = segment(data, 0xC4, dc)
+	ac := make([]byte, 18)
+	ac[0], ac[1] = 0x10, 1
+	data = segment(data, 0xC4, ac)
+
+	sos := []byte{4}
+	for c := byte(1); c <= 4; c++ {
+		sos = append(sos, c, 0)
+	}
+	data = segment(data, 0xDA, append(sos, 0, 63, 0))
+
+	var bits, count uint32
+	write := func(value uint32, n uint32) {
+		for n > 0 {
+			n--
+			bits = bits<<1 | (value>>n)&1
+			count++
+			if count == 8 {
+				data = append(data, byte(bits))
+				if bits == 0xFF {
+					data = append(data, 0)
+				}
+				bits, count = 0, 0
+			}
+		}
+	}
+
+	blocks := ((width + 7) / 8) * ((height + 7) / 8)
+	var predictions [4]int
+	for block := 0; block < blocks; block++ {
+		for c := 0; c < 4; c++ {
+			value := (int(255-cmyk[c]) - 128) * 8
+			diff := value - predictions[c]
+			predictions[c] = value
+
+			category := uint32(0)
+			for magnitude := diff; magnitude != 0; magnitude /= 2 {
+				category++
+			}
+			if diff < 0 {
+				diff += 1<<category - 1
+			}
+			write(category, 4)
+			write(uint32(diff), category)
+			write(0, 1)
+		}
+	}
+	if count > 0 {
+		write(0xFF, 8-count)
+	}
+
+	return append(data, 0xFF, 0xD9)
+}
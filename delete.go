@@ -0,0 +1,161 @@
+package imagine
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// DeleteParams configures the delete endpoint, which refuses every request
+// unless Token or Authorize is set
+type DeleteParams struct {
+	// Token is the bearer token delete and list requests must carry in
+	// their Authorization header
+	Token string
+
+	// Authorize decides whether a delete or list request is allowed,
+	// instead of the token
+	Authorize func(r *http.Request) bool
+}
+
+// derivatives returns the cache keys derived from slug. Cache keys start
+// with the slug they derive from, so they are listed by prefix. Caches which
+// can't list keep the derivatives until they expire.
+func (i *Imagine) derivatives(slug string) ([]string, error) {
+	lister, ok := i.params.Cache.(Lister)
+	if !ok {
+		fmt.Printf("[Imagine] Cache can't list, leaving the derivatives of %s to expire\n", slug)
+		return nil, nil
+	}
+
+	var keys []string
+	options := ListOptions{Prefix: slug, Limit: maxListLimit}
+	for {
+		page, err := lister.List(options)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		for _, entry := range page.Entries {
+			keys = append(keys, entry.Key)
+		}
+		if page.NextCursor == "" {
+			return keys, nil
+		}
+		options.Cursor = page.NextCursor
+	}
+}
+
+// deleteKey deletes key from store, keys already missing aren't an error
+func deleteKey(store Store, key string) error {
+	err := store.Delete(key)
+	if err != nil && (errors.Cause(err) == ErrKeyNotFound || errors.Is(err, os.ErrNotExist)) {
+		return nil
+	}
+	return errors.Trace(err)
+}
+
+// Delete removes an image along with everything derived from it: the
+// processed variants and analyses in the cache, its original and its
+// perceptual hashes
+func (i *Imagine) Delete(slug string) error {
+	_, found, err := statEntry(i.params.Storage, slug)
+	if err != nil {
+		return errors.Trace(err)
+	} else if !found {
+		return errors.Annotatef(ErrImageNotFound, "slug %s", slug)
+	}
+
+	if err := i.purgeDerivatives(slug); err != nil {
+		return errors.Trace(err)
+	}
+
+	if i.hashes != nil {
+		if err := i.hashes.remove(slug); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if i.params.Originals != nil {
+		if err := deleteKey(i.params.Originals, slug); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	// the image goes last so a failed delete can be retried
+	if err := deleteKey(i.params.Storage, slug); err != nil {
+		return errors.Trace(err)
+	}
+	fmt.Printf("[Imagine] Deleted image %s\n", slug)
+
+	return nil
+}
+
+// purgeDerivatives deletes the processed variants and analyses of an image
+// from the cache
+func (i *Imagine) purgeDerivatives(slug string) error {
+	keys, err := i.derivatives(slug)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, key := range keys {
+		if err := deleteKey(i.params.Cache, key); err != nil {
+			return errors.Annotatef(err, "could not delete derivative %s", key)
+		}
+	}
+	fmt.Printf("[Imagine] Deleted %d derivatives of %s\n", len(keys), slug)
+
+	return nil
+}
+
+// DeleteHandlerFunc handles the DELETE requests, removing images and their
+// derivatives. Requests are authorized by DeleteParams.
+func (i *Imagine) DeleteHandlerFunc() http.HandlerFunc {
+	return http.HandlerFunc(i.deleteHandler)
+}
+
+// authorize checks the delete or list request is allowed
+func (i *Imagine) authorize(r *http.Request) bool {
+	params := i.params.Delete
+	if params.Authorize != nil {
+		return params.Authorize(r)
+	}
+	if params.Token == "" {
+		return false
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(params.Token)) == 1
+}
+
+func (i *Imagine) deleteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !i.authorize(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="imagine"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	slug, err := parseSlugFromPath(r.URL.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = i.Delete(slug)
+	if err != nil && errors.Cause(err) == ErrImageNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,125 @@
+package imagine_test
+
+import (
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/risico/imagine"
+)
+
+// unlistedStore hides the Lister of a store
+type unlistedStore struct {
+	imagine.Store
+}
+
+func TestDelete(t *testing.T) {
+	storage := imagine.NewInMemoryStorage(imagine.MemoryStoreParams{})
+	cache := imagine.NewInMemoryStorage(imagine.MemoryStoreParams{})
+	originals := imagine.NewInMemoryStorage(imagine.MemoryStoreParams{})
+	i, err := imagine.New(imagine.Params{
+		Storage:   storage,
+		Cache:     cache,
+		Originals: originals,
+		Delete:    imagine.DeleteParams{Token: "secret"},
+	})
+	assert.NoError(t, err)
+
+	// derivatives are cached under keys which can't be guessed from the slug
+	cached := func(slug string) int {
+		count := 0
+		for _, params := range []*imagine.ImageParams{{Width: 10}, {Width: 20, Format: "webp"}} {
+			key, err := params.CacheKey(imagine.SHA256Hasher())
+			assert.NoError(t, err)
+			if _, found, _ := cache.Get(slug + key); found {
+				count++
+			}
+		}
+		if _, found, _ := originals.Get(slug); found {
+			count++
+		}
+		return count
+	}
+	upload := func(c color.Color) string {
+		slug, err := i.Upload(solidImage(t, 40, 30, c))
+		assert.NoError(t, err)
+		_, err = i.Get(slug, &imagine.ImageParams{Width: 10})
+		assert.NoError(t, err)
+		_, err = i.Get(slug, &imagine.ImageParams{Width: 20, Format: "webp"})
+		assert.NoError(t, err)
+		assert.Equal(t, 3, cached(slug))
+		return slug
+	}
+
+	t.Run("delete", func(t *testing.T) {
+		slug := upload(color.White)
+		assert.NoError(t, i.Delete(slug))
+		assert.Equal(t, 0, cached(slug))
+		_, found, _ := storage.Get(slug)
+		assert.False(t, found)
+
+		err := i.Delete(slug)
+		assert.Equal(t, imagine.ErrImageNotFound, errors.Cause(err))
+	})
+
+	t.Run("handler", func(t *testing.T) {
+		slug := upload(color.Black)
+		// the handler reads the slug from the path like the other handlers
+		assert.NoError(t, storage.Set(testSlug+".png", solidImage(t, 10, 10, color.Black)))
+		_, err := i.Get(testSlug+".png", &imagine.ImageParams{Width: 10})
+		assert.NoError(t, err)
+
+		for token, expected := range map[string]int{
+			"":              http.StatusUnauthorized,
+			"Bearer wrong":  http.StatusUnauthorized,
+			"Bearer secret": http.StatusNoContent,
+		} {
+			request := httptest.NewRequest(http.MethodDelete, "/images/"+testSlug+".png", nil)
+			if token != "" {
+				request.Header.Set("Authorization", token)
+			}
+			response := httptest.NewRecorder()
+			i.DeleteHandlerFunc().ServeHTTP(response, request)
+			assert.Equal(t, expected, response.Code, token)
+		}
+		assert.Equal(t, 0, cached(testSlug+".png"))
+
+		request := httptest.NewRequest(http.MethodDelete, "/images/"+testSlug+".png", nil)
+		request.Header.Set("Authorization", "Bearer secret")
+		response := httptest.NewRecorder()
+		i.DeleteHandlerFunc().ServeHTTP(response, request)
+		assert.Equal(t, http.StatusNotFound, response.Code)
+
+		// other images are left alone
+		assert.Equal(t, 3, cached(slug))
+	})
+
+	t.Run("cache without listing", func(t *testing.T) {
+		storage := imagine.NewInMemoryStorage(imagine.MemoryStoreParams{})
+		i, err := imagine.New(imagine.Params{Storage: storage, Cache: &unlistedStore{cache}})
+		assert.NoError(t, err)
+
+		// the derivatives can't be found, they are left to expire
+		slug, err := i.Upload(solidImage(t, 40, 30, color.Gray{Y: 128}))
+		assert.NoError(t, err)
+		_, err = i.Get(slug, &imagine.ImageParams{Width: 10})
+		assert.NoError(t, err)
+		assert.NoError(t, i.Delete(slug))
+		_, found, _ := storage.Get(slug)
+		assert.False(t, found)
+	})
+
+	t.Run("disabled without credentials", func(t *testing.T) {
+		i, err := imagine.New(imagine.Params{Storage: storage, Cache: cache})
+		assert.NoError(t, err)
+
+		request := httptest.NewRequest(http.MethodDelete, "/images/"+testSlug+".png", nil)
+		response := httptest.NewRecorder()
+		i.DeleteHandlerFunc().ServeHTTP(response, request)
+		assert.Equal(t, http.StatusUnauthorized, response.Code)
+	})
+}
@@ -0,0 +1,261 @@
+package imagine
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/h2non/bimg"
+	"github.com/juju/errors"
+)
+
+// ErrPageOutOfRange is returned when the requested page doesn't exist
+var ErrPageOutOfRange = errors.New("page out of range")
+
+// InputParams configures the input formats browsers can't display as they
+// are: HEIF, TIFF, SVG and PDF
+type InputParams struct {
+	// ConvertOnUpload converts these formats to JPEG, or PNG when the image
+	// has an alpha channel, before storing them. Otherwise they're stored as
+	// they are and converted when requested.
+	ConvertOnUpload bool
+
+	// DPI is the density SVG and PDF documents are rasterized at unless
+	// requested otherwise. Defaults to 72.
+	DPI int
+
+	// MaxDPI is the highest density which can be requested. Defaults to 600.
+	MaxDPI int
+}
+
+// withDefaults sets the default values for the input parameters
+func (p *InputParams) withDefaults() {
+	if p.DPI == 0 {
+		p.DPI = 72
+	}
+	if p.MaxDPI == 0 {
+		p.MaxDPI = 600
+	}
+}
+
+// heifBrands are the ftyp brands of HEIF images, bimgHEIFBrands the ones
+// bimg recognizes
+var (
+	heifBrands = map[string]bool{
+		"heic": true, "heix": true, "hevc": true, "hevx": true, "heim": true,
+		"heis": true, "hevm": true, "hevs": true, "mif1": true, "msf1": true,
+	}
+	bimgHEIFBrands = map[string]bool{
+		"heic": true, "heis": true, "hevc": true, "mif1": true, "msf1": true, "avif": true,
+	}
+)
+
+// detectImageType tells the format of an image from its magic bytes
+func detectImageType(data []byte) bimg.ImageType {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8, 0xFF}):
+		return bimg.JPEG
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return bimg.PNG
+	case bytes.HasPrefix(data, []byte("GIF87a")), bytes.HasPrefix(data, []byte("GIF89a")):
+		return bimg.GIF
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return bimg.WEBP
+	case bytes.HasPrefix(data, []byte("II*\x00")), bytes.HasPrefix(data, []byte("MM\x00*")):
+		return bimg.TIFF
+	case bytes.HasPrefix(data, []byte("%PDF-")):
+		return bimg.PDF
+	case len(data) >= 16 && string(data[4:8]) == "ftyp":
+		return ftypImageType(data)
+	case isSVG(data):
+		return bimg.SVG
+	}
+
+	return bimg.UNKNOWN
+}
+
+// ftypBrands returns the major and compatible brands of an ISO BMFF file
+func ftypBrands(data []byte) []string {
+	size := int(binary.BigEndian.Uint32(data))
+	if size > len(data) || size < 16 {
+		size = 16
+	}
+
+	brands := []string{string(data[8:12])}
+	for pos := 16; pos+4 <= size; pos += 4 {
+		brands = append(brands, string(data[pos:pos+4]))
+	}
+	return brands
+}
+
+// ftypImageType tells AVIF from HEIF images by their brands
+func ftypImageType(data []byte) bimg.ImageType {
+	t := bimg.UNKNOWN
+	for _, brand := range ftypBrands(data) {
+		switch {
+		case brand == "avif" || brand == "avis":
+			return bimg.AVIF
+		case heifBrands[brand]:
+			t = bimg.HEIF
+		}
+	}
+	return t
+}
+
+// normalizeHEIFBrand swaps the major brand of HEIF images for a compatible
+// brand bimg recognizes, libheif reads them all but bimg only detects a few
+func normalizeHEIFBrand(data []byte) []byte {
+	brands := ftypBrands(data)
+	if bimgHEIFBrands[brands[0]] {
+		return data
+	}
+
+	for _, brand := range brands[1:] {
+		if bimgHEIFBrands[brand] {
+			normalized := append([]byte(nil), data...)
+			copy(normalized[8:12], brand)
+			return normalized
+		}
+	}
+	return data
+}
+
+// isSVG tells whether data is an SVG document, skipping the prolog
+func isSVG(data []byte) bool {
+	head := data
+	if len(head) > 4096 {
+		head = head[:4096]
+	}
+	if bytes.IndexByte(head, 0) >= 0 {
+		return false
+	}
+
+	head = bytes.TrimPrefix(head, []byte("\xEF\xBB\xBF"))
+	for {
+		head = bytes.TrimSpace(head)
+		var end []byte
+		switch {
+		case bytes.HasPrefix(head, []byte("<?")):
+			end = []byte("?>")
+		case bytes.HasPrefix(head, []byte("<!--")):
+			end = []byte("-->")
+		case bytes.HasPrefix(head, []byte("<!")):
+			end = []byte(">")
+		default:
+			return bytes.HasPrefix(head, []byte("<svg"))
+		}
+
+		idx := bytes.Index(head, end)
+		if idx < 0 {
+			return false
+		}
+		head = head[idx+len(end):]
+	}
+}
+
+// webOutputType returns the format an image is delivered in when no format
+// is requested, formats browsers can't display are turned into WebP
+func webOutputType(t bimg.ImageType) bimg.ImageType {
+	switch t {
+	case bimg.JPEG, bimg.PNG, bimg.GIF, bimg.WEBP, bimg.AVIF:
+		return t
+	}
+	return bimg.WEBP
+}
+
+// normalizeInput prepares uploaded images for storage: SVG documents are
+// sanitized and HEIF brands made readable by bimg
+func normalizeInput(data []byte) ([]byte, error) {
+	switch detectImageType(data) {
+	case bimg.SVG:
+		sanitized, err := sanitizeSVG(data, 1)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return sanitized, nil
+	case bimg.HEIF, bimg.AVIF:
+		return normalizeHEIFBrand(data), nil
+	}
+
+	return data, nil
+}
+
+// prepareDocument renders the requested page of PDF documents and applies
+// the density to SVG and PDF documents. Other images are returned untouched.
+func (i *Imagine) prepareDocument(data []byte, page, dpi int) ([]byte, error) {
+	if page == 0 {
+		page = 1
+	}
+	if dpi == 0 {
+		dpi = i.params.Inputs.DPI
+	}
+	scale := float64(dpi) / 72
+
+	switch detectImageType(data) {
+	case bimg.PDF:
+		if page == 1 && dpi == 72 {
+			return data, nil
+		}
+		document, err := selectPDFPage(data, page, scale, i.params.MaxImageSize)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return document, nil
+
+	case bimg.SVG:
+		if page > 1 {
+			return nil, errors.Annotatef(ErrPageOutOfRange, "page %d of 1", page)
+		}
+		document, err := sanitizeSVG(data, scale)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return document, nil
+	}
+
+	if page > 1 {
+		return nil, errors.Annotatef(ErrPageOutOfRange, "page %d of 1", page)
+	}
+	return data, nil
+}
+
+// convertInput converts the formats browsers can't display to JPEG, or PNG
+// when the image has an alpha channel. Web formats are returned untouched.
+func (i *Imagine) convertInput(data []byte) ([]byte, error) {
+	if t := detectImageType(data); webOutputType(t) == t {
+		return data, nil
+	}
+
+	data, err := i.prepareDocument(data, 1, 0)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := i.checkSource(data); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	metadata, err := bimg.Metadata(data)
+	if err != nil {
+		return nil, errors.Annotate(err, "could not read image metadata")
+	}
+
+	options := bimg.Options{Type: bimg.JPEG, Quality: 95}
+	if metadata.Alpha {
+		options = bimg.Options{Type: bimg.PNG}
+	}
+	i.convertColors(&options, ColorSpaceSRGB, metadata)
+	options.StripMetadata = i.stripsMetadata(i.params.MetadataPolicy, options.Type, metadata)
+
+	converted, err := bimg.NewImage(data).Process(options)
+	if err != nil {
+		return nil, errors.Annotate(err, "could not convert image")
+	}
+
+	if !options.StripMetadata {
+		converted, err = i.filterMetadata(converted, i.params.MetadataPolicy)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	return converted, nil
+}
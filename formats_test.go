@@ -0,0 +1,265 @@
+package imagine_test
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	_ "image/png"
+	"strings"
+	"testing"
+
+	"github.com/h2non/bimg"
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/risico/imagine"
+)
+
+const testSVG = `<?xml version="1.0"?>
+<!-- drawn by hand -->
+<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" width="100" height="50" onload="alert(1)">
+	<script>alert(document.cookie)</script>
+	<rect width="100" height="50" fill="red"/>
+	<rect width="10" height="10" fill="url(https://example.com/fill.svg#p)" stroke="url(#gradient)"/>
+	<rect width="10" height="10" filter="url( 'http://example.com/filter.svg' )" mask="URL(//example.com/mask)"/>
+	<image xlink:href="https://example.com/track.png" width="1" height="1"/>
+	<a href="javascript:alert(1)"><text>link</text></a>
+	<image href="data:image/svg+xml;base64,PHN2ZyBvbmxvYWQ9ImFsZXJ0KDEpIi8+" width="1" height="1"/>
+	<image href="data:image/png;base64,iVBORw0KGgo=" width="1" height="1"/>
+</svg>`
+
+func TestInputFormats(t *testing.T) {
+	storage := imagine.NewInMemoryStorage(imagine.MemoryStoreParams{})
+	i, err := imagine.New(imagine.Params{
+		Storage: storage,
+		Cache:   imagine.NewInMemoryStorage(imagine.MemoryStoreParams{}),
+	})
+	assert.NoError(t, err)
+
+	t.Run("svg is sanitized on upload", func(t *testing.T) {
+		if !bimg.IsTypeSupported(bimg.SVG) {
+			t.Skip("libvips built without svg support")
+		}
+
+		slug, err := i.Upload([]byte(testSVG))
+		assert.NoError(t, err)
+
+		stored, _, err := storage.Get(slug)
+		assert.NoError(t, err)
+		assert.Contains(t, string(stored), "<rect")
+		assert.NotContains(t, string(stored), "script")
+		assert.NotContains(t, string(stored), "onload")
+		assert.NotContains(t, string(stored), "example.com")
+		assert.NotContains(t, string(stored), "javascript")
+		assert.NotContains(t, string(stored), "svg+xml")
+		assert.Contains(t, string(stored), "data:image/png")
+		assert.Contains(t, string(stored), "url(#gradient)")
+	})
+
+	t.Run("svg density", func(t *testing.T) {
+		if !bimg.IsTypeSupported(bimg.SVG) {
+			t.Skip("libvips built without svg support")
+		}
+		assert.NoError(t, storage.Set(testSlug+".svg", []byte(testSVG)))
+
+		pi, err := i.Get(testSlug+".svg", &imagine.ImageParams{Format: "png", DPI: 144})
+		assert.NoError(t, err)
+		assertSize(t, 200, 100, pi.Image)
+
+		_, err = i.Get(testSlug+".svg", &imagine.ImageParams{Format: "png", Page: 2})
+		assert.Equal(t, imagine.ErrPageOutOfRange, errors.Cause(err))
+	})
+
+	t.Run("pdf pages", func(t *testing.T) {
+		if !bimg.IsTypeSupported(bimg.PDF) {
+			t.Skip("libvips built without pdf support")
+		}
+		assert.NoError(t, storage.Set(testSlug+".pdf", testPDF(100, 200, 300)))
+
+		pi, err := i.Get(testSlug+".pdf", &imagine.ImageParams{Format: "png"})
+		assert.NoError(t, err)
+		assertSize(t, 100, 100, pi.Image)
+
+		pi, err = i.Get(testSlug+".pdf", &imagine.ImageParams{Format: "png", Page: 2})
+		assert.NoError(t, err)
+		assertSize(t, 200, 100, pi.Image)
+
+		pi, err = i.Get(testSlug+".pdf", &imagine.ImageParams{Format: "png", Page: 3, DPI: 144})
+		assert.NoError(t, err)
+		assertSize(t, 600, 200, pi.Image)
+
+		_, err = i.Get(testSlug+".pdf", &imagine.ImageParams{Format: "png", Page: 4})
+		assert.Equal(t, imagine.ErrPageOutOfRange, errors.Cause(err))
+	})
+
+	t.Run("malformed pdf", func(t *testing.T) {
+		var bomb bytes.Buffer
+		w := zlib.NewWriter(&bomb)
+		w.Write(make([]byte, 2<<20))
+		w.Close()
+
+		documents := []struct {
+			name     string
+			document []byte
+		}{
+			{"self referencing length", streamPDF("/Length 1 0 R", "data", false)},
+			{"empty xref entries", streamPDF("/Type /XRef /W [0 0 0] /Index [0 4000000000000] /Size 1 /Length 0", "", true)},
+			{"flate bomb", streamPDF(fmt.Sprintf("/Type /XRef /W [1 1 1] /Size 1 /Filter /FlateDecode /Length %d", bomb.Len()),
+				bomb.String(), true)},
+			{"negative offset", offsetPDF("-000000005")},
+			{"offset past the end", offsetPDF("9999999999")},
+			{"negative object stream first", objectStreamPDF(-5, 0)},
+			{"negative object stream offset", objectStreamPDF(0, -3)},
+			{"object stream offset past the end", objectStreamPDF(0, 1000)},
+			{"deep nesting", streamPDF("/Kids "+strings.Repeat("[", 1000)+strings.Repeat("]", 1000)+" /Length 0", "", false)},
+		}
+		for idx, d := range documents {
+			// the pages of the valid document are cached under testSlug
+			slug := fmt.Sprintf("%s%d.pdf", testSlug[1:], idx)
+			assert.NoError(t, storage.Set(slug, d.document))
+			_, err := i.Get(slug, &imagine.ImageParams{Format: "png", Page: 2})
+			assert.Equal(t, imagine.ErrUnsupportedPDF, errors.Cause(err), d.name)
+		}
+	})
+
+	t.Run("heif brands", func(t *testing.T) {
+		heic := []byte("\x00\x00\x00\x18ftypheix\x00\x00\x00\x00mif1heic" +
+			"\x00\x00\x00\x14ispe\x00\x00\x00\x00\x00\x00\x00\x40\x00\x00\x00\x30")
+		slug, err := i.Upload(heic)
+		if !bimg.IsTypeSupported(bimg.HEIF) {
+			assert.Error(t, err)
+			return
+		}
+		assert.NoError(t, err)
+
+		stored, _, err := storage.Get(slug)
+		assert.NoError(t, err)
+		assert.Equal(t, "mif1", string(stored[8:12]))
+		assert.Equal(t, bimg.HEIF, bimg.DetermineImageType(stored))
+	})
+
+	t.Run("unknown formats are rejected", func(t *testing.T) {
+		_, err := i.Upload([]byte("<html><body>not an image</body></html>"))
+		assert.Error(t, err)
+	})
+}
+
+func TestConvertOnUpload(t *testing.T) {
+	if !bimg.IsTypeSupported(bimg.SVG) {
+		t.Skip("libvips built without svg support")
+	}
+
+	storage := imagine.NewInMemoryStorage(imagine.MemoryStoreParams{})
+	i, err := imagine.New(imagine.Params{
+		Storage: storage,
+		Cache:   imagine.NewInMemoryStorage(imagine.MemoryStoreParams{}),
+		Inputs:  imagine.InputParams{ConvertOnUpload: true, DPI: 144},
+	})
+	assert.NoError(t, err)
+
+	slug, err := i.Upload([]byte(testSVG))
+	assert.NoError(t, err)
+
+	stored, _, err := storage.Get(slug)
+	assert.NoError(t, err)
+	assert.Equal(t, bimg.PNG, bimg.DetermineImageType(stored))
+	assertSize(t, 200, 100, stored)
+}
+
+func assertSize(t *testing.T, width, height int, data []byte) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, width, config.Width)
+	assert.Equal(t, height, config.Height)
+}
+
+// testPDF writes a document with one blank page per width, all 100pt high
+func testPDF(widths ...int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+
+	var offsets []int
+	object := func(body string) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	kids := ""
+	for idx := range widths {
+		kids += fmt.Sprintf(" %d 0 R", idx+3)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s ] /Count %d >>", kids, len(widths)))
+	for _, width := range widths {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d 100] /Resources << >> >>", width))
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f\r\n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n\r\n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	return buf.Bytes()
+}
+
+// offsetPDF writes a document whose catalog is listed at offset by its cross
+// reference table
+func offsetPDF(offset string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n1 0 obj\n<< /Type /Catalog /Pages 2 0 R >>\nendobj\n")
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 2\n0000000000 65535 f\r\n%s 00000 n\r\n", offset)
+	fmt.Fprintf(&buf, "trailer\n<< /Size 2 /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", xref)
+	return buf.Bytes()
+}
+
+// objectStreamPDF writes a document whose catalog is compressed in an object
+// stream starting at first, at offset from it
+func objectStreamPDF(first, offset int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.5\n")
+
+	objects := buf.Len()
+	content := fmt.Sprintf("2 %d << /Type /Catalog >>", offset)
+	fmt.Fprintf(&buf, "1 0 obj\n<< /Type /ObjStm /N 1 /First %d /Length %d >>\nstream\n%s\nendstream\nendobj\n",
+		first, len(content), content)
+
+	// the entries are the type, offset or object stream, and generation or
+	// index of the objects
+	xref := buf.Len()
+	var entries bytes.Buffer
+	for _, entry := range [][]int{{0, 0, 0}, {1, objects, 0}, {2, 1, 0}, {1, xref, 0}} {
+		entries.WriteByte(byte(entry[0]))
+		entries.Write([]byte{byte(entry[1] >> 24), byte(entry[1] >> 16), byte(entry[1] >> 8), byte(entry[1])})
+		entries.WriteByte(byte(entry[2]))
+	}
+	fmt.Fprintf(&buf, "3 0 obj\n<< /Type /XRef /W [1 4 1] /Size 4 /Root 2 0 R /Length %d >>\nstream\n", entries.Len())
+	buf.Write(entries.Bytes())
+	fmt.Fprintf(&buf, "\nendstream\nendobj\nstartxref\n%d\n%%%%EOF\n", xref)
+	return buf.Bytes()
+}
+
+// streamPDF writes a document made of a single stream object, referenced by
+// a cross reference table, or being the cross reference stream
+func streamPDF(dict, stream string, xrefStream bool) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.5\n")
+
+	offset := buf.Len()
+	fmt.Fprintf(&buf, "1 0 obj\n<< %s >>\nstream\n%s\nendstream\nendobj\n", dict, stream)
+	if xrefStream {
+		fmt.Fprintf(&buf, "startxref\n%d\n%%%%EOF\n", offset)
+		return buf.Bytes()
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 2\n0000000000 65535 f\r\n%010d 00000 n\r\n", offset)
+	fmt.Fprintf(&buf, "trailer\n<< /Size 2 /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", xref)
+	return buf.Bytes()
+}
@@ -1,14 +1,19 @@
 package imagine
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math"
+	"mime"
 	"net/http"
 	"net/url"
 	"regexp"
+	"runtime"
 	"strconv"
+	"strings"
 
 	"github.com/h2non/bimg"
 	"github.com/juju/errors"
@@ -16,14 +21,86 @@ import (
 
 var ErrImageNotFound = errors.New("image not found")
 
+// ErrFileTooLarge is returned when an upload is over MaxImageSize
+var ErrFileTooLarge = errors.New("file exceeds the maximum image size")
+
+// multipartOverhead is the room left for the multipart headers and
+// boundaries on top of MaxImageSize
+const multipartOverhead = 64 * 1024
+
 // Params are the parameters used to create a new Imagine application
 type Params struct {
 	Cache   Store
 	Storage Store
 	Hasher  Hasher
 
-	// MaxImageSize is the maximum size of an image in bytes
+	// Originals keeps the untouched uploads, keyed by the slug of their
+	// optimized image, so they can be regenerated with another policy. It
+	// can be a cheaper, colder store than Storage. Disabled when nil.
+	Originals Store
+
+	// MaxImageSize is the maximum size in bytes of the images uploaded
+	// through the handlers, Upload itself takes images of any size.
+	// Defaults to 1MB.
 	MaxImageSize int
+
+	// BaseURL is where the images are served from, the upload responses
+	// give the URL of the image as BaseURL followed by its slug. Defaults
+	// to /.
+	BaseURL string
+
+	// Placeholders configures the BlurHash and ThumbHash generation
+	Placeholders PlaceholderParams
+
+	// MetadataPolicy is the metadata retained when processing images, it
+	// can be overridden per request. Defaults to MetadataStrip.
+	MetadataPolicy MetadataPolicy
+
+	// KeepPrivateMetadata keeps the GPS location, maker notes, owner and
+	// serial numbers under MetadataKeepAll
+	KeepPrivateMetadata bool
+
+	// Color configures the color space processed images are converted to
+	Color ColorParams
+
+	// Animation limits the frames and pixels of animated images
+	Animation AnimationParams
+
+	// Inputs configures the HEIF, TIFF, SVG and PDF inputs
+	Inputs InputParams
+
+	// Limits protects against decompression bombs and oversized requests
+	Limits LimitParams
+
+	// UploadPolicy configures how uploads are checked and optimized, it can
+	// be overridden per endpoint with UploadPolicyHandlerFunc
+	UploadPolicy UploadPolicy
+
+	// Workers is the maximum number of images of bulk uploads processed at
+	// the same time. Defaults to the number of CPUs.
+	Workers int
+
+	// Bulk configures the bulk upload endpoint
+	Bulk BulkParams
+
+	// Remote configures the upload of images by URL
+	Remote RemoteParams
+
+	// Tus configures the resumable uploads endpoint
+	Tus TusParams
+
+	// Similarity configures the perceptual hashing of uploads, to find
+	// similar images and handle near duplicates
+	Similarity SimilarityParams
+
+	// Delete configures who can delete images through the delete endpoint
+	Delete DeleteParams
+
+	// LQIP configures the inlined low quality image placeholders
+	LQIP LQIPParams
+
+	// Info configures which metadata the info endpoint exposes
+	Info InfoParams
 }
 
 // withDefaults sets the default values for the parameters
@@ -32,19 +109,61 @@ func (p *Params) withDefaults() {
 		p.MaxImageSize = 1024 * 1024
 	}
 
+	if p.BaseURL == "" {
+		p.BaseURL = "/"
+	}
+	if !strings.HasSuffix(p.BaseURL, "/") {
+		p.BaseURL += "/"
+	}
+
 	if p.Hasher == nil {
 		p.Hasher = SHA256Hasher()
 	}
+
+	if p.MetadataPolicy == "" {
+		p.MetadataPolicy = MetadataStrip
+	}
+
+	p.Placeholders.withDefaults()
+	p.Color.withDefaults()
+	p.Animation.withDefaults()
+	p.Inputs.withDefaults()
+	p.Limits.withDefaults()
+	p.UploadPolicy.withDefaults()
+	p.Bulk.withDefaults()
+	p.Remote.withDefaults()
+	p.Tus.withDefaults()
+	p.Similarity.withDefaults()
+
+	if p.Workers == 0 {
+		p.Workers = runtime.NumCPU()
+	}
+	p.LQIP.withDefaults()
+	p.Info.withDefaults()
 }
 
 // Imagine is our main application struct
 type Imagine struct {
 	params Params
+
+	// workers bounds the images processed concurrently
+	workers chan struct{}
+
+	// remote fetches the images uploaded by URL
+	remote *remoteFetcher
+
+	// tus serves the resumable uploads
+	tus *tusServer
+
+	// hashes indexes the perceptual hashes of the images, nil when disabled
+	hashes *hashIndex
 }
 
 // UploadHandler handles the upload of images
 func (i *Imagine) UploadHandlerFunc() http.HandlerFunc {
-	return http.HandlerFunc(i.uploadHandlerFunc)
+	return func(w http.ResponseWriter, r *http.Request) {
+		i.uploadHandler(w, r, i.params.UploadPolicy)
+	}
 }
 
 // ProcessHandler handles the generation of images
@@ -55,9 +174,43 @@ func (i *Imagine) GetHandlerFunc() http.HandlerFunc {
 // New creates a new Imagine application
 func New(params Params) (*Imagine, error) {
 	params.withDefaults()
-	return &Imagine{
-		params: params,
-	}, nil
+
+	if !params.MetadataPolicy.valid() {
+		return nil, errors.Errorf("invalid metadata policy %q", params.MetadataPolicy)
+	}
+
+	if !validColorSpace(params.Color.ColorSpace) {
+		return nil, errors.Errorf("invalid color space %q", params.Color.ColorSpace)
+	}
+
+	if err := params.UploadPolicy.validate(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if err := params.Similarity.validate(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	remote, err := newRemoteFetcher(params.Remote)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	i := &Imagine{
+		params:  params,
+		workers: make(chan struct{}, params.Workers),
+		remote:  remote,
+	}
+	i.tus = newTusServer(i, params.Tus)
+
+	if params.Similarity.Store != nil {
+		i.hashes, err = newHashIndex(params.Similarity.Store, params.Similarity.SyncInterval)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	return i, nil
 }
 
 // getHandler handles the GET requests
@@ -68,22 +221,29 @@ func (i *Imagine) getHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if r.URL.Query().Has("info") {
+		i.infoHandler(w, r, slug)
+		return
+	}
+
 	params, err := i.ParamsFromQueryString(r.URL.String())
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	pi, err := i.Get(slug, params)
-	if err != nil && errors.Cause(err) == ErrImageNotFound {
-		http.Error(w, err.Error(), http.StatusNotFound)
+	// conditional and HEAD requests can be answered without the image
+	if i.serveWithoutData(w, r, slug, params) {
 		return
-	} else if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+
+	pi, err := i.Get(slug, params)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
 		return
 	}
 
-	w.Header().Set("Content-Type", pi.Type)
+	w.Header().Set("Content-Type", mimeType(pi.Type))
 	w.Write(pi.Image)
 }
 
@@ -118,8 +278,7 @@ func (i *Imagine) Get(filename string, params *ImageParams) (*ProcessedImage, er
 		}
 	} else if found {
 		fmt.Printf("[Imagine] Found in cache, returning cached image\n")
-		bi := bimg.NewImage(image)
-		return &ProcessedImage{Image: bi.Image(), Type: bi.Type()}, nil
+		return &ProcessedImage{Image: image, Type: imageType(image)}, nil
 	}
 
 	// get it from storage if not in cache
@@ -153,7 +312,7 @@ func (i *Imagine) Get(filename string, params *ImageParams) (*ProcessedImage, er
 	}
 
 	return &ProcessedImage{
-		Type:  processedImage.Type(),
+		Type:  imageType(processedImage.Image()),
 		Image: processedImage.Image(),
 	}, nil
 }
@@ -167,29 +326,96 @@ func (i *Imagine) cacheKey(filename string, params *ImageParams) (string, error)
 	return fmt.Sprintf("%s%s", filename, paramsCacheKey), nil
 }
 
+// Upload validates, optimizes and stores an image, returning its slug
 func (i *Imagine) Upload(data []byte) (string, error) {
-	fmt.Printf("[Imagine] Upload called with data size: %d bytes (%.2f MB)\n", len(data), float64(len(data))/1024/1024)
-	
+	result, err := i.upload(data, i.params.UploadPolicy)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	return result.Slug, nil
+}
+
+// uploadResult is what the upload handler reports back about a stored image
+type uploadResult struct {
+	Slug string `json:"slug"`
+	URL  string `json:"url"`
+
+	// Format is the format the image is stored in, SourceFormat the one it
+	// was uploaded in
+	Format       string `json:"format"`
+	SourceFormat string `json:"source_format"`
+
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+	Size   int `json:"size"`
+
+	// Deduplicated tells the image was already stored, NearDuplicate that
+	// it's a stored image similar to the upload, and Reencoded that the
+	// stored image differs from the uploaded file
+	Deduplicated  bool `json:"deduplicated"`
+	NearDuplicate bool `json:"near_duplicate,omitempty"`
+	Reencoded     bool `json:"reencoded"`
+
+	BlurHash     string        `json:"blurhash,omitempty"`
+	Placeholders *Placeholders `json:"placeholders,omitempty"`
+}
+
+// optimize validates an upload and optimizes it following the policy,
+// returning the data to store
+func (i *Imagine) optimize(data []byte, policy UploadPolicy) ([]byte, error) {
 	if isValid := validateImage(data); !isValid {
 		contentType := http.DetectContentType(data)
 		fmt.Printf("[Imagine] Invalid image type. Detected content type: %s\n", contentType)
-		return "", errors.New("invalid image type")
+		return nil, errors.New("invalid image type")
+	}
+	if err := policy.checkFormat(data); err != nil {
+		return nil, errors.Trace(err)
 	}
 	fmt.Printf("[Imagine] Image validation passed\n")
 
+	// Sanitize SVG documents and make HEIF images readable
+	data, err := normalizeInput(data)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// Check the declared dimensions before anything decodes the image
+	if err := i.checkSource(data); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := policy.checkDimensions(data); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if i.params.Inputs.ConvertOnUpload {
+		data, err = i.convertInput(data)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
 	// Auto-orient and optimize the image before storing
 	img := bimg.NewImage(data)
 	
+	// Animations are stored untouched, recompressing them keeps the first
+	// frame only
+	animation := readAnimationHeader(data)
+	if animation != nil {
+		if err := i.checkAnimation(animation); err != nil {
+			return nil, errors.Trace(err)
+		}
+		fmt.Printf("[Imagine] Animated image with %d frames, skipping optimization\n", animation.frames)
+	}
+
 	// Get metadata to check orientation and size
 	metadata, err := img.Metadata()
-	if err == nil {
+	if err == nil && animation == nil {
 		fmt.Printf("[Imagine] Original image: %dx%d, orientation: %d\n", 
 			metadata.Size.Width, metadata.Size.Height, metadata.Orientation)
 		
 		// Build options for optimization
-		options := bimg.Options{
-			StripMetadata: true, // Remove metadata
-		}
+		options := bimg.Options{}
 		
 		// Auto-rotate if needed
 		if metadata.Orientation > 1 {
@@ -202,22 +428,21 @@ func (i *Imagine) Upload(data []byte) (string, error) {
 			}
 		}
 		
-		// If image is very large (>4096px), resize it for storage optimization
-		if metadata.Size.Width > 4096 || metadata.Size.Height > 4096 {
-			fmt.Printf("[Imagine] Image is very large, resizing to max 4096px for storage\n")
-			if metadata.Size.Width > metadata.Size.Height {
-				options.Width = 4096
-			} else {
-				options.Height = 4096
-			}
+		// If image is very large, resize it for storage optimization
+		if metadata.Size.Width > policy.MaxWidth || metadata.Size.Height > policy.MaxHeight {
+			fmt.Printf("[Imagine] Image is very large, resizing to max %dx%d for storage\n", policy.MaxWidth, policy.MaxHeight)
+			options.Width, options.Height = fitWithin(metadata.Size.Width, metadata.Size.Height, policy.MaxWidth, policy.MaxHeight)
 		}
 		
-		// Ensure file is under 10MB
-		targetSize := 10 * 1024 * 1024 // 10MB
+		// Ensure file is under the target size
+		targetSize := policy.TargetSize
 		currentSize := len(data)
+		reencodeType := formatType(policy.Format)
+		// JPEG can't keep the transparency of PNG files
+		reencode := reencodeType != bimg.JPEG || metadata.Type != "png"
 		
 		if currentSize > targetSize {
-			fmt.Printf("[Imagine] File size %.2f MB exceeds 10MB limit, optimizing...\n", float64(currentSize)/1024/1024)
+			fmt.Printf("[Imagine] File size %.2f MB exceeds %.2f MB limit, optimizing...\n", float64(currentSize)/1024/1024, float64(targetSize)/1024/1024)
 			
 			// Calculate dimension reduction needed
 			reductionFactor := math.Sqrt(float64(targetSize) / float64(currentSize))
@@ -227,94 +452,250 @@ func (i *Imagine) Upload(data []byte) (string, error) {
 				newWidth := int(float64(metadata.Size.Width) * reductionFactor)
 				newHeight := int(float64(metadata.Size.Height) * reductionFactor)
 				
-				// Cap at 4096px max
-				if newWidth > 4096 {
-					newWidth = 4096
-				}
-				if newHeight > 4096 {
-					newHeight = 4096
-				}
-				
-				if metadata.Size.Width > metadata.Size.Height {
-					options.Width = newWidth
-				} else {
-					options.Height = newHeight
-				}
+				options.Width, options.Height = fitWithin(newWidth, newHeight, policy.MaxWidth, policy.MaxHeight)
 				
 				fmt.Printf("[Imagine] Resizing to approximately %dx%d\n", newWidth, newHeight)
 			}
 			
-			// Use JPEG compression for large files (unless PNG with transparency)
-			if metadata.Type != "png" {
-				options.Type = bimg.JPEG
-				options.Quality = 92 // Good quality but more compression
+			// Re-encode large files
+			if reencode {
+				options.Type = reencodeType
+				options.Quality = policy.Quality
+			}
+		} else if len(data) > policy.CompressAbove && reencode { 
+			// For files between the thresholds, still optimize
+			fmt.Printf("[Imagine] File over %.2f MB, applying compression\n", float64(policy.CompressAbove)/1024/1024)
+			options.Type = reencodeType
+			options.Quality = policy.CompressQuality
+		}
+		
+		// Normalize CMYK sources to sRGB, browsers render them poorly
+		if metadata.Space == "cmyk" {
+			fmt.Printf("[Imagine] Converting CMYK image to sRGB\n")
+			i.convertColors(&options, ColorSpaceSRGB, metadata)
+			if options.Quality == 0 {
+				options.Quality = 95
 			}
-		} else if len(data) > 5*1024*1024 && metadata.Type != "png" { 
-			// For files between 5-10MB, still optimize
-			fmt.Printf("[Imagine] File over 5MB, applying compression\n")
-			options.Type = bimg.JPEG
-			options.Quality = 95
 		}
 		
 		// Apply optimizations if any were set
-		if options.Width > 0 || options.Height > 0 || options.Type > 0 {
-			data, err = img.Process(options)
+		if options.Width > 0 || options.Height > 0 || options.Type > 0 || options.OutputICC != "" {
+			outputType := options.Type
+			if outputType == bimg.UNKNOWN {
+				outputType = bimg.DetermineImageType(data)
+			}
+			options.StripMetadata = i.stripsMetadata(i.params.MetadataPolicy, outputType, metadata)
+
+			processed, err := img.Process(options)
+			if err == nil && !options.StripMetadata {
+				processed, err = i.filterMetadata(processed, i.params.MetadataPolicy)
+			}
 			if err != nil {
 				fmt.Printf("[Imagine] Warning: Failed to optimize: %v\n", err)
 				// Continue with original data if optimization fails
 			} else {
+				data = processed
 				fmt.Printf("[Imagine] Optimized to %d bytes (%.2f MB)\n", 
 					len(data), float64(len(data))/1024/1024)
 			}
 		}
 	}
-	
+
+	return data, nil
+}
+
+func (i *Imagine) upload(data []byte, policy UploadPolicy) (*uploadResult, error) {
+	fmt.Printf("[Imagine] Upload called with data size: %d bytes (%.2f MB)\n", len(data), float64(len(data))/1024/1024)
+
+	received := data
+	data, err := i.optimize(data, policy)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
 	// use the file hash as the filename (after processing)
 	filename, err := i.params.Hasher.Hash(data)
 	if err != nil {
 		fmt.Printf("[Imagine] Failed to hash data: %v\n", err)
-		return "", errors.Trace(err)
+		return nil, errors.Trace(err)
 	}
 	fmt.Printf("[Imagine] Generated hash filename: %s\n", filename)
 
-	err = i.params.Storage.Set(filename, data)
+	// the same image uploaded again keeps the same slug, no need to write it
+	_, deduplicated, err := statEntry(i.params.Storage, filename)
 	if err != nil {
-		fmt.Printf("[Imagine] Failed to store image: %v\n", err)
-		return "", errors.Trace(err)
+		fmt.Printf("[Imagine] Failed to look up image: %v\n", err)
+		return nil, errors.Trace(err)
+	}
+	// near duplicates are rejected or replaced by the stored image
+	var hashes *imageHashes
+	nearDuplicate := false
+	if !deduplicated {
+		linked, computed, err := i.checkDuplicates(filename, data)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if linked != "" {
+			stored, found, err := i.params.Storage.Get(linked)
+			if err == nil && found {
+				filename, data = linked, stored
+				deduplicated, nearDuplicate = true, true
+			}
+		}
+		hashes = computed
+	}
+
+	if deduplicated {
+		fmt.Printf("[Imagine] Image already stored with filename: %s\n", filename)
+	} else {
+		err = i.params.Storage.Set(filename, data)
+		if err != nil {
+			fmt.Printf("[Imagine] Failed to store image: %v\n", err)
+			return nil, errors.Trace(err)
+		}
+		fmt.Printf("[Imagine] Successfully stored image with filename: %s\n", filename)
+
+		if !policy.SkipOriginal {
+			if err := i.storeOriginal(filename, received); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+	}
+
+	if hashes != nil {
+		if err := i.hashes.add(filename, *hashes); err != nil {
+			fmt.Printf("[Imagine] Failed to index perceptual hashes: %v\n", err)
+			return nil, errors.Trace(err)
+		}
 	}
-	fmt.Printf("[Imagine] Successfully stored image with filename: %s\n", filename)
 
-	return filename, nil
+	result := &uploadResult{
+		Slug:          filename,
+		URL:           i.params.BaseURL + filename,
+		Format:        bimg.ImageTypeName(detectImageType(data)),
+		SourceFormat:  bimg.ImageTypeName(detectImageType(received)),
+		Size:          len(data),
+		Deduplicated:  deduplicated,
+		NearDuplicate: nearDuplicate,
+		Reencoded:     !bytes.Equal(received, data),
+	}
+	result.Width, result.Height, _ = imageDimensions(data)
+	if i.params.Placeholders.OnUpload {
+		result.Placeholders, err = i.computePlaceholders(filename, data,
+			i.params.Placeholders.XComponents, i.params.Placeholders.YComponents)
+		if err != nil {
+			// placeholders can always be computed later, don't fail the upload
+			fmt.Printf("[Imagine] Warning: Failed to compute placeholders: %v\n", err)
+		} else {
+			result.BlurHash = result.Placeholders.BlurHash
+		}
+	}
+
+	return result, nil
+}
+
+// errorStatus returns the HTTP status of an error processing or uploading
+// an image
+func errorStatus(err error) int {
+	switch errors.Cause(err) {
+	case ErrImageNotFound:
+		return http.StatusNotFound
+	case ErrFileTooLarge, ErrAnimationTooLarge, ErrImageTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case ErrFormatNotAllowed, ErrRemoteContentType:
+		return http.StatusUnsupportedMediaType
+	case ErrUploadRejected, ErrUnsupportedPDF, ErrAnimationUnsupported:
+		return http.StatusUnprocessableEntity
+	case ErrNearDuplicate:
+		return http.StatusConflict
+	case ErrInvalidSVG, ErrForbiddenURL, ErrFrameOutOfRange, ErrPageOutOfRange, ErrOutputTooLarge:
+		return http.StatusBadRequest
+	case ErrRemoteFetch:
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
 }
 
-func (i *Imagine) uploadHandlerFunc(w http.ResponseWriter, r *http.Request) {
+func (i *Imagine) uploadHandler(w http.ResponseWriter, r *http.Request, policy UploadPolicy) {
 	// nothing to do unless we deal with a POST request
 	if r.Method != http.MethodPost {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// TODO: maybe make this an array so we can support bulk uploads
+	// refuse to read bodies which can't hold an acceptable image, instead
+	// of truncating them
+	r.Body = http.MaxBytesReader(w, r.Body, int64(i.params.MaxImageSize+multipartOverhead))
+
+	// several files are uploaded at once with the bulk upload handler
 	file, _, err := r.FormFile("file")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	var maxBytesErr *http.MaxBytesError
+	if err != nil && errors.As(err, &maxBytesErr) {
+		http.Error(w, fmt.Sprintf("upload exceeds the maximum image size of %d bytes", i.params.MaxImageSize), http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 	defer file.Close()
 
-	imgBytes, err := ioutil.ReadAll(io.LimitReader(file, 1024*1024))
-	if err != nil {
+	// read one byte more than allowed to tell full files from truncated ones
+	imgBytes, err := ioutil.ReadAll(io.LimitReader(file, int64(i.params.MaxImageSize)+1))
+	if (err != nil && errors.As(err, &maxBytesErr)) || len(imgBytes) > i.params.MaxImageSize {
+		http.Error(w, fmt.Sprintf("upload exceeds the maximum image size of %d bytes", i.params.MaxImageSize), http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	filename, err := i.Upload(imgBytes)
+	result, err := i.upload(imgBytes, policy)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	i.writeUploadResult(w, r, result)
+}
+
+// writeUploadResult answers an upload with its slug, or a description of the
+// stored image for clients preferring JSON
+func (i *Imagine) writeUploadResult(w http.ResponseWriter, r *http.Request, result *uploadResult) {
+	w.Header().Add("Vary", "Accept")
+	if prefersJSON(r.Header.Get("Accept")) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(result)
 		return
 	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(filename))
+	w.Write([]byte(result.Slug))
+}
+
+// prefersJSON tells whether an Accept header explicitly ranks JSON above
+// plain text, which stays the default when they tie as with */*
+func prefersJSON(accept string) bool {
+	var text, json float64
+	for _, entry := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(entry)
+		if err != nil {
+			continue
+		}
+
+		quality := 1.0
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil {
+			quality = q
+		}
+		switch mediaType {
+		case "text/plain", "text/*", "*/*":
+			text = math.Max(text, quality)
+		case "application/json":
+			json = math.Max(json, quality)
+		}
+	}
+	return json > text
 }
 
 // Image params are the requested params to modify an image when retriving it
@@ -353,6 +734,25 @@ type ImageParams struct {
 	
 	// Preset for common configurations: thumb, small, medium, large, hero
 	Preset string
+
+	// Background letterboxes fit=contain: a hex color (rrggbb) or "dominant"
+	// to use the dominant color of the image
+	Background string
+
+	// Metadata overrides the metadata policy: none, icc, copyright or all
+	Metadata string
+
+	// ColorSpace overrides the color space: srgb, p3 or keep
+	ColorSpace string
+
+	// Frame extracts a still from animations, starting at 1
+	Frame int
+
+	// Page is the page of PDF documents to render, starting at 1
+	Page int
+
+	// DPI is the density SVG and PDF documents are rendered at
+	DPI int
 }
 
 // create a cache key from the image params
@@ -484,6 +884,63 @@ func (i *Imagine) ParamsFromQueryString(query string) (*ImageParams, error) {
 			return nil, errors.New("invalid gravity value")
 		}
 	}
+
+	if queryValues.Has("bg") {
+		bg := strings.ToLower(strings.TrimPrefix(queryValues.Get("bg"), "#"))
+		if bg != "dominant" && !hexColorMatcher.MatchString(bg) {
+			return nil, errors.New("bg must be a hex color or dominant")
+		}
+		p.Background = bg
+	}
+
+	if queryValues.Has("meta") {
+		meta := queryValues.Get("meta")
+		if !MetadataPolicy(meta).valid() {
+			return nil, errors.New("meta must be none, icc, copyright or all")
+		}
+		p.Metadata = meta
+	}
+
+	if queryValues.Has("frame") {
+		frame, err := strconv.Atoi(queryValues.Get("frame"))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if frame < 1 {
+			return nil, errors.New("frame must be 1 or more")
+		}
+		p.Frame = frame
+	}
+
+	if queryValues.Has("page") {
+		page, err := strconv.Atoi(queryValues.Get("page"))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if page < 1 {
+			return nil, errors.New("page must be 1 or more")
+		}
+		p.Page = page
+	}
+
+	if queryValues.Has("dpi") {
+		dpi, err := strconv.Atoi(queryValues.Get("dpi"))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if dpi < 1 || dpi > i.params.Inputs.MaxDPI {
+			return nil, errors.Errorf("dpi must be between 1 and %d", i.params.Inputs.MaxDPI)
+		}
+		p.DPI = dpi
+	}
+
+	if queryValues.Has("cs") {
+		cs := queryValues.Get("cs")
+		if !validColorSpace(cs) {
+			return nil, errors.New("cs must be srgb, p3 or keep")
+		}
+		p.ColorSpace = cs
+	}
 	
 	// Handle presets
 	if queryValues.Has("preset") {
@@ -568,19 +1025,38 @@ func (i *Imagine) ParamsFromQueryString(query string) (*ImageParams, error) {
 }
 
 // validateImage checks if the image is a valid image based on
-// the content type.
+// its magic bytes and the formats libvips was built with.
 func validateImage(img []byte) bool {
-	ct := http.DetectContentType(img)
-	switch ct {
-	case "image/jpeg", "image/png", "image/gif", "image/webp":
-		return true
-	}
-
-	return false
+	t := detectImageType(img)
+	return t != bimg.UNKNOWN && bimg.IsTypeSupported(t)
 }
 
 // processImage applies the requested transformations to the image via the supplied params
 func (i *Imagine) processImage(image []byte, params *ImageParams) (*bimg.Image, error) {
+	if err := i.checkOutput(params); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// Render the requested page and density of documents
+	image, err := i.prepareDocument(image, params.Page, params.DPI)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// Check the declared dimensions before anything decodes the image
+	if err := i.checkSource(image); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// Extract the requested frame of animations
+	if params.Frame > 0 {
+		frame, err := i.extractFrame(image, params.Frame)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		image = frame
+	}
+
 	// First auto-rotate the image if needed
 	img := bimg.NewImage(image)
 	metadata, err := img.Metadata()
@@ -641,6 +1117,13 @@ func (i *Imagine) processImage(image []byte, params *ImageParams) (*bimg.Image,
 			options.Width = params.Width
 			options.Height = params.Height
 			options.Embed = true
+			if params.Background != "" {
+				options.Background, err = backgroundColor(image, params.Background)
+				if err != nil {
+					return nil, errors.Trace(err)
+				}
+				options.Extend = bimg.ExtendBackground
+			}
 		case "fill":
 			options.Width = params.Width
 			options.Height = params.Height
@@ -721,8 +1204,8 @@ func (i *Imagine) processImage(image []byte, params *ImageParams) (*bimg.Image,
 		options.Quality = 85
 	}
 	
-	// Always strip metadata to reduce file size
-	options.StripMetadata = true
+	// Strip the metadata not retained by the policy
+	policy := i.metadataPolicy(params)
 
 	// Format conversion
 	if params.Format != "" {
@@ -744,15 +1227,73 @@ func (i *Imagine) processImage(image []byte, params *ImageParams) (*bimg.Image,
 		}
 	}
 
+	// Convert the colors to the requested color space
+	space := i.colorSpace(params)
+	profile := i.convertColors(&options, space, metadata)
+
+	// Formats browsers can't display are delivered as WebP
+	if options.Type == bimg.UNKNOWN {
+		options.Type = webOutputType(bimg.DetermineImageType(image))
+	}
+	outputType := options.Type
+	options.StripMetadata = metadata.Type == "" || i.stripsMetadata(policy, outputType, metadata)
+
+	// The filtered JPEG, WebP and PNG metadata always retains the ICC profile
+	keepsProfile := profile != "" || (space == ColorSpaceKeep && metadata.Profile)
+	if options.StripMetadata && keepsProfile && filtersMetadata(outputType) {
+		options.StripMetadata = false
+	}
+
+	// Animations are processed frame by frame, still formats get the
+	// first frame
+	if params.Frame == 0 && (outputType == bimg.GIF || outputType == bimg.WEBP || outputType == bimg.AVIF) {
+		anim, err := i.decodeAnimation(image)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if anim != nil {
+			return i.processAnimation(anim, options, outputType)
+		}
+	}
+
 	// Process the image with all options
-	image, err = bimg.NewImage(image).Process(options)
+	if profile != "" && options.StripMetadata {
+		image, err = embedProfile(image, options, outputType, profile)
+	} else {
+		image, err = bimg.NewImage(image).Process(options)
+	}
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
 
+	if !options.StripMetadata {
+		image, err = i.filterMetadata(image, policy)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
 	return bimg.NewImage(image), nil
 }
 
+// hexColorMatcher matches a rrggbb hex color
+var hexColorMatcher = regexp.MustCompile(`^[0-9a-f]{6}$`)
+
+// backgroundColor resolves the bg param to a color, bg is either "dominant"
+// or a rrggbb hex color
+func backgroundColor(image []byte, bg string) (bimg.Color, error) {
+	if bg == "dominant" {
+		return dominantColor(image)
+	}
+
+	rgb, err := strconv.ParseUint(bg, 16, 32)
+	if err != nil {
+		return bimg.Color{}, errors.Trace(err)
+	}
+
+	return bimg.Color{R: uint8(rgb >> 16), G: uint8(rgb >> 8), B: uint8(rgb)}, nil
+}
+
 // getGravity converts string gravity to bimg.Gravity
 func getGravity(gravity string) bimg.Gravity {
 	switch gravity {
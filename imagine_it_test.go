@@ -1,6 +1,8 @@
 package imagine_test
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"image"
 	"image/color"
@@ -69,6 +71,125 @@ func TestUploadHandler(t *testing.T) {
 	assert.NotEmpty(t, string(body))
 }
 
+func TestUploadResponse(t *testing.T) {
+	i, err := imagine.New(imagine.Params{
+		Storage: imagine.NewInMemoryStorage(imagine.MemoryStoreParams{}),
+		Cache:   imagine.NewInMemoryStorage(imagine.MemoryStoreParams{}),
+		BaseURL: "https://img.example.com/i",
+	})
+	assert.NoError(t, err)
+	image := solidImage(t, 30, 20, color.White)
+
+	upload := func(accept string) *httptest.ResponseRecorder {
+		request := multipartRequest(t, "/", "file", image)
+		request.Header.Set("Accept", accept)
+		response := httptest.NewRecorder()
+		i.UploadHandlerFunc().ServeHTTP(response, request)
+		assert.Equal(t, http.StatusOK, response.Code)
+		return response
+	}
+
+	var result struct {
+		Slug, URL, Format, SourceFormat string
+		Width, Height, Size             int
+		Deduplicated, Reencoded         bool
+	}
+	response := upload("application/json")
+	assert.Equal(t, "application/json", response.Header().Get("Content-Type"))
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &result))
+	assert.Equal(t, "https://img.example.com/i/"+result.Slug, result.URL)
+	assert.Equal(t, "png", result.Format)
+	assert.Equal(t, 30, result.Width)
+	assert.Equal(t, 20, result.Height)
+	assert.Equal(t, len(image), result.Size)
+	assert.False(t, result.Deduplicated)
+	assert.False(t, result.Reencoded)
+
+	response = upload("application/json, */*;q=0.8")
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &result))
+	assert.True(t, result.Deduplicated)
+
+	// plain text stays the default
+	for _, accept := range []string{"", "*/*", "application/json, */*", "text/plain, */*;q=0.1"} {
+		response = upload(accept)
+		assert.Equal(t, "text/plain; charset=utf-8", response.Header().Get("Content-Type"), accept)
+		assert.Equal(t, result.Slug, response.Body.String(), accept)
+	}
+}
+
+func TestConditionalGet(t *testing.T) {
+	storage := imagine.NewInMemoryStorage(imagine.MemoryStoreParams{})
+	i, err := imagine.New(imagine.Params{
+		Storage: storage,
+		Cache:   imagine.NewInMemoryStorage(imagine.MemoryStoreParams{}),
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, storage.Set(testSlug+".png", solidImage(t, 30, 20, color.White)))
+	target := "/" + testSlug + ".png?w=10"
+
+	get := func(method string, headers map[string]string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, target, nil)
+		for name, value := range headers {
+			request.Header.Set(name, value)
+		}
+		response := httptest.NewRecorder()
+		i.GetHandlerFunc().ServeHTTP(response, request)
+		return response
+	}
+
+	response := get(http.MethodGet, nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "image/png", response.Header().Get("Content-Type"))
+	etag := response.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+	lastModified := response.Header().Get("Last-Modified")
+	assert.NotEmpty(t, lastModified)
+	size := response.Body.Len()
+
+	response = get(http.MethodGet, map[string]string{"If-None-Match": etag})
+	assert.Equal(t, http.StatusNotModified, response.Code)
+	assert.Zero(t, response.Body.Len())
+
+	response = get(http.MethodGet, map[string]string{"If-Modified-Since": lastModified})
+	assert.Equal(t, http.StatusNotModified, response.Code)
+
+	response = get(http.MethodGet, map[string]string{"If-None-Match": `"other"`})
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	// the cached variant is described without being read
+	response = get(http.MethodHead, nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "image/png", response.Header().Get("Content-Type"))
+	assert.Equal(t, fmt.Sprint(size), response.Header().Get("Content-Length"))
+}
+
+func TestUploadSizeLimit(t *testing.T) {
+	i, err := imagine.New(imagine.Params{
+		Storage:      imagine.NewInMemoryStorage(imagine.MemoryStoreParams{}),
+		Cache:        imagine.NewInMemoryStorage(imagine.MemoryStoreParams{}),
+		MaxImageSize: 1024,
+	})
+	assert.NoError(t, err)
+
+	// the limit only applies to the handlers
+	image := gradientImage(t, 120, 90, plain)
+	assert.Greater(t, len(image), 1024)
+	_, err = i.Upload(image)
+	assert.NoError(t, err)
+
+	for name, size := range map[string]int{
+		"file over the limit": 1025,
+		"body over the limit": 1024 * 1024,
+	} {
+		t.Run(name, func(t *testing.T) {
+			response := httptest.NewRecorder()
+			i.UploadHandlerFunc().ServeHTTP(response, multipartRequest(t, "/", "file", make([]byte, size)))
+			assert.Equal(t, http.StatusRequestEntityTooLarge, response.Code)
+			assert.Contains(t, response.Body.String(), "maximum image size")
+		})
+	}
+}
+
 func TestGetImagineHandler(t *testing.T) {
 	t.SkipNow()
 	storage, err := imagine.NewLocalStorage(imagine.LocalStoreParams{
@@ -92,6 +213,23 @@ func TestGetImagineHandler(t *testing.T) {
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
 }
 
+// multipartRequest builds an upload request carrying data in the given form field
+func multipartRequest(t *testing.T, target, field string, data ...[]byte) *http.Request {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for idx, d := range data {
+		part, err := writer.CreateFormFile(field, fmt.Sprintf("image%d.png", idx))
+		assert.NoError(t, err)
+		_, err = part.Write(d)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, writer.Close())
+
+	request := httptest.NewRequest("POST", target, &body)
+	request.Header.Add("Content-Type", writer.FormDataContentType())
+	return request
+}
+
 func createImage() image.Image {
 	width := 200
 	height := 100
@@ -114,6 +114,77 @@ func TestParamsFromQueryString(t *testing.T) {
 				Format:    "jpeg",
 			},
 		},
+		{
+			name:  "dominant background",
+			query: "?w=300&h=200&fit=contain&bg=dominant",
+			expected: &imagine.ImageParams{
+				Width:      300,
+				Height:     200,
+				Fit:        "contain",
+				Background: "dominant",
+			},
+		},
+		{
+			name:  "hex background",
+			query: "?bg=%23FF8800",
+			expected: &imagine.ImageParams{
+				Background: "ff8800",
+			},
+		},
+		{
+			name:        "invalid background",
+			query:       "?bg=blue",
+			shouldError: true,
+		},
+		{
+			name:  "metadata policy",
+			query: "?meta=copyright",
+			expected: &imagine.ImageParams{
+				Metadata: "copyright",
+			},
+		},
+		{
+			name:        "invalid metadata policy",
+			query:       "?meta=gps",
+			shouldError: true,
+		},
+		{
+			name:  "frame",
+			query: "?frame=2",
+			expected: &imagine.ImageParams{
+				Frame: 2,
+			},
+		},
+		{
+			name:        "invalid frame",
+			query:       "?frame=0",
+			shouldError: true,
+		},
+		{
+			name:  "page and dpi",
+			query: "?page=2&dpi=144",
+			expected: &imagine.ImageParams{
+				Page: 2,
+				DPI:  144,
+			},
+		},
+		{
+			name:        "dpi too high",
+			query:       "?dpi=601",
+			shouldError: true,
+		},
+		{
+			name:  "color space",
+			query: "?cs=p3",
+			expected: &imagine.ImageParams{
+				ColorSpace: "p3",
+			},
+		},
+		{
+			name:        "invalid color space",
+			query:       "?cs=adobe",
+			shouldError: true,
+		},
 		{
 			name:        "invalid quality too high",
 			query:       "?q=101",
@@ -0,0 +1,156 @@
+package imagine
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/h2non/bimg"
+	"github.com/juju/errors"
+)
+
+// defaultEXIFFields are the EXIF fields exposed by the info endpoint unless
+// configured otherwise. Location, serial and maker specific fields are left
+// out on purpose.
+var defaultEXIFFields = []string{
+	"Make", "Model", "Software", "Datetime", "DateTimeOriginal", "DateTimeDigitized",
+	"ExposureTime", "FNumber", "ExposureProgram", "ISOSpeedRatings", "ShutterSpeedValue",
+	"ApertureValue", "BrightnessValue", "ExposureBiasValue", "MeteringMode", "Flash",
+	"FocalLength", "FocalLengthIn35mmFilm", "ExposureMode", "WhiteBalance",
+	"SceneCaptureType", "ColorSpace",
+}
+
+// InfoParams configures what the info endpoint exposes
+type InfoParams struct {
+	// EXIFFields lists the EXIF fields exposed, named after the bimg.EXIF
+	// struct fields (e.g. "Make", "GPSLatitude"). Defaults to the camera and
+	// exposure settings, GPS fields are only exposed when listed here.
+	EXIFFields []string
+
+	// DisableEXIF hides all EXIF fields
+	DisableEXIF bool
+}
+
+// withDefaults sets the default values for the info parameters
+func (p *InfoParams) withDefaults() {
+	if p.EXIFFields == nil {
+		p.EXIFFields = defaultEXIFFields
+	}
+}
+
+// ImageInfo describes a stored image or one of its variants
+type ImageInfo struct {
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	Format      string `json:"format"`
+	ColorSpace  string `json:"color_space"`
+	Channels    int    `json:"channels"`
+	Alpha       bool   `json:"alpha"`
+	ICCProfile  bool   `json:"icc_profile"`
+	Orientation int    `json:"orientation"`
+
+	// Size is the size of the image in bytes
+	Size int `json:"size"`
+
+	// EXIF holds the exposed, non empty EXIF fields
+	EXIF map[string]interface{} `json:"exif,omitempty"`
+}
+
+// Info returns the metadata of a stored image. When params holds any
+// transformation the metadata of the resulting variant is returned instead.
+func (i *Imagine) Info(slug string, params *ImageParams) (*ImageInfo, error) {
+	data, found, err := i.params.Storage.Get(slug)
+	if err != nil && !errors.Is(err, ErrKeyNotFound) {
+		return nil, errors.Trace(err)
+	} else if err != nil || !found {
+		return nil, errors.Annotatef(ErrImageNotFound, "slug %s", slug)
+	}
+
+	if params != nil && *params != (ImageParams{}) {
+		pi, err := i.Get(slug, params)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		data = pi.Image
+	}
+
+	metadata, err := bimg.Metadata(data)
+	if err != nil {
+		return nil, errors.Annotate(err, "could not read image metadata")
+	}
+
+	info := &ImageInfo{
+		Width:       metadata.Size.Width,
+		Height:      metadata.Size.Height,
+		Format:      metadata.Type,
+		ColorSpace:  metadata.Space,
+		Channels:    metadata.Channels,
+		Alpha:       metadata.Alpha,
+		ICCProfile:  metadata.Profile,
+		Orientation: metadata.Orientation,
+		Size:        len(data),
+	}
+
+	if !i.params.Info.DisableEXIF {
+		info.EXIF = exposedEXIF(metadata.EXIF, i.params.Info.EXIFFields)
+	}
+
+	return info, nil
+}
+
+// exposedEXIF returns the non empty EXIF fields out of the allowed ones
+func exposedEXIF(exif bimg.EXIF, fields []string) map[string]interface{} {
+	values := reflect.ValueOf(exif)
+	exposed := map[string]interface{}{}
+	for _, name := range fields {
+		field := values.FieldByName(name)
+		if !field.IsValid() || field.IsZero() {
+			continue
+		}
+		exposed[name] = field.Interface()
+	}
+
+	if len(exposed) == 0 {
+		return nil
+	}
+
+	return exposed
+}
+
+// InfoHandlerFunc returns the metadata of an image as JSON, it serves
+// paths like /<slug>.<ext>.json. Transformation query params describe the variant
+// to inspect, without any the original is described.
+func (i *Imagine) InfoHandlerFunc() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slug, err := parseSlugFromPath(strings.TrimSuffix(r.URL.Path, ".json"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		i.infoHandler(w, r, slug)
+	})
+}
+
+// infoHandler writes the info of slug, it's shared by the info handler and
+// the ?info query of the get handler
+func (i *Imagine) infoHandler(w http.ResponseWriter, r *http.Request, slug string) {
+	params, err := i.ParamsFromQueryString(r.URL.String())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	info, err := i.Info(slug, params)
+	if err != nil && errors.Cause(err) == ErrImageNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
@@ -0,0 +1,85 @@
+package imagine_test
+
+import (
+	"encoding/json"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/risico/imagine"
+)
+
+func TestInfoHandler(t *testing.T) {
+	storage := imagine.NewInMemoryStorage(imagine.MemoryStoreParams{})
+	i, err := imagine.New(imagine.Params{
+		Storage: storage,
+		Cache:   imagine.NewInMemoryStorage(imagine.MemoryStoreParams{}),
+	})
+	assert.NoError(t, err)
+
+	data := solidImage(t, 120, 80, color.RGBA{10, 20, 30, 255})
+	assert.NoError(t, storage.Set(testSlug+".png", data))
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		target  string
+		status  int
+		width   int
+		height  int
+	}{
+		{
+			name:    "json path",
+			handler: i.InfoHandlerFunc(),
+			target:  "/" + testSlug + ".png.json",
+			status:  http.StatusOK,
+			width:   120,
+			height:  80,
+		},
+		{
+			name:    "info query",
+			handler: i.GetHandlerFunc(),
+			target:  "/" + testSlug + ".png?info",
+			status:  http.StatusOK,
+			width:   120,
+			height:  80,
+		},
+		{
+			name:    "transformed variant",
+			handler: i.GetHandlerFunc(),
+			target:  "/" + testSlug + ".png?info&w=60&format=png",
+			status:  http.StatusOK,
+			width:   60,
+			height:  40,
+		},
+		{
+			name:    "not found",
+			handler: i.InfoHandlerFunc(),
+			target:  "/ffffffffffffffffffffffffffffffff.png.json",
+			status:  http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest("GET", tt.target, nil)
+			response := httptest.NewRecorder()
+			tt.handler.ServeHTTP(response, request)
+
+			assert.Equal(t, tt.status, response.Code)
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			var info imagine.ImageInfo
+			assert.NoError(t, json.NewDecoder(response.Body).Decode(&info))
+			assert.Equal(t, tt.width, info.Width)
+			assert.Equal(t, tt.height, info.Height)
+			assert.Equal(t, "png", info.Format)
+			assert.NotZero(t, info.Size)
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package imagine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	"github.com/h2non/bimg"
+	"github.com/juju/errors"
+)
+
+var (
+	// ErrImageTooLarge is returned for source images over the pixel or
+	// dimension limits
+	ErrImageTooLarge = errors.New("image exceeds the pixel or dimension limits")
+	// ErrOutputTooLarge is returned when the requested size is over the output
+	// limits
+	ErrOutputTooLarge = errors.New("requested size exceeds the output limits")
+)
+
+// LimitParams protects against decompression bombs: small files declaring
+// huge images. The limits are checked on the image headers, before decoding.
+// Animations are limited by AnimationParams.
+type LimitParams struct {
+	// MaxPixels is the maximum number of pixels of a source image. Defaults
+	// to 100 megapixels.
+	MaxPixels int
+
+	// MaxWidth and MaxHeight are the maximum dimensions of a source image.
+	// Default to 20000.
+	MaxWidth, MaxHeight int
+
+	// MaxOutputWidth and MaxOutputHeight are the maximum dimensions which
+	// can be requested. Default to 8192.
+	MaxOutputWidth, MaxOutputHeight int
+}
+
+// withDefaults sets the default values for the limits
+func (p *LimitParams) withDefaults() {
+	if p.MaxPixels == 0 {
+		p.MaxPixels = 100 * 1000 * 1000
+	}
+	if p.MaxWidth == 0 {
+		p.MaxWidth = 20000
+	}
+	if p.MaxHeight == 0 {
+		p.MaxHeight = 20000
+	}
+	if p.MaxOutputWidth == 0 {
+		p.MaxOutputWidth = 8192
+	}
+	if p.MaxOutputHeight == 0 {
+		p.MaxOutputHeight = 8192
+	}
+}
+
+// checkSource reads the dimensions declared by an image and checks them
+// against the limits, along with the frames of animations
+func (i *Imagine) checkSource(data []byte) error {
+	if h := readAnimationHeader(data); h != nil {
+		if err := i.checkAnimation(h); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	width, height, err := imageDimensions(data)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	limits := i.params.Limits
+	if width > limits.MaxWidth || height > limits.MaxHeight {
+		return errors.Annotatef(ErrImageTooLarge, "%dx%d over a limit of %dx%d",
+			width, height, limits.MaxWidth, limits.MaxHeight)
+	}
+	if pixels := width * height; pixels > limits.MaxPixels {
+		return errors.Annotatef(ErrImageTooLarge, "%d pixels over a limit of %d", pixels, limits.MaxPixels)
+	}
+	return nil
+}
+
+// checkOutput checks the requested dimensions against the limits
+func (i *Imagine) checkOutput(params *ImageParams) error {
+	limits := i.params.Limits
+	width, height := params.Width, params.Height
+	if params.Thumbnail > width {
+		width = params.Thumbnail
+	}
+	if params.Thumbnail > height {
+		height = params.Thumbnail
+	}
+
+	if width > limits.MaxOutputWidth || height > limits.MaxOutputHeight {
+		return errors.Annotatef(ErrOutputTooLarge, "%dx%d over a limit of %dx%d",
+			width, height, limits.MaxOutputWidth, limits.MaxOutputHeight)
+	}
+	return nil
+}
+
+// imageDimensions returns the dimensions declared by the image header. The
+// formats Go can't read are left to libvips, which loads images lazily and
+// only reads their header for their metadata.
+func imageDimensions(data []byte) (int, int, error) {
+	switch detectImageType(data) {
+	case bimg.JPEG, bimg.PNG, bimg.GIF:
+		config, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return 0, 0, errors.Annotate(err, "could not read image header")
+		}
+		return config.Width, config.Height, nil
+
+	case bimg.WEBP:
+		if width, height, ok := webpDimensions(data); ok {
+			return width, height, nil
+		}
+
+	case bimg.HEIF, bimg.AVIF:
+		if width, height, ok := heifDimensions(data); ok {
+			return width, height, nil
+		}
+	}
+
+	metadata, err := bimg.Metadata(data)
+	if err != nil {
+		return 0, 0, errors.Annotate(err, "could not read image metadata")
+	}
+	return metadata.Size.Width, metadata.Size.Height, nil
+}
+
+// webpDimensions reads the canvas size of extended WebP files or the frame
+// header of simple lossy and lossless files
+func webpDimensions(data []byte) (int, int, bool) {
+	chunks, err := webpChunks(data)
+	if err != nil || len(chunks) == 0 {
+		return 0, 0, false
+	}
+
+	c := chunks[0].data
+	switch {
+	case chunks[0].id == "VP8X" && len(c) >= 10:
+		return 1 + int(uint24(c[4:])), 1 + int(uint24(c[7:])), true
+	case chunks[0].id == "VP8 " && len(c) >= 10 && bytes.Equal(c[3:6], []byte{0x9d, 0x01, 0x2a}):
+		return int(binary.LittleEndian.Uint16(c[6:]) & 0x3fff), int(binary.LittleEndian.Uint16(c[8:]) & 0x3fff), true
+	case chunks[0].id == "VP8L" && len(c) >= 5 && c[0] == 0x2f:
+		bits := binary.LittleEndian.Uint32(c[1:])
+		return 1 + int(bits&0x3fff), 1 + int(bits>>14&0x3fff), true
+	}
+	return 0, 0, false
+}
+
+// heifDimensions reads the largest image spatial extents property of HEIF
+// and AVIF files, the primary image is never smaller than its thumbnails
+func heifDimensions(data []byte) (int, int, bool) {
+	width, height := 0, 0
+	for pos := 0; ; {
+		idx := bytes.Index(data[pos:], []byte("ispe"))
+		if idx < 0 || pos+idx+16 > len(data) {
+			break
+		}
+		// the extents follow the box version and flags
+		box := data[pos+idx+8:]
+		w, h := int(binary.BigEndian.Uint32(box)), int(binary.BigEndian.Uint32(box[4:]))
+		if w*h > width*height {
+			width, height = w, h
+		}
+		pos += idx + 4
+	}
+	return width, height, width > 0 && height > 0
+}
@@ -0,0 +1,78 @@
+package imagine_test
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/risico/imagine"
+)
+
+func TestLimits(t *testing.T) {
+	storage := imagine.NewInMemoryStorage(imagine.MemoryStoreParams{})
+	i, err := imagine.New(imagine.Params{
+		Storage: storage,
+		Cache:   imagine.NewInMemoryStorage(imagine.MemoryStoreParams{}),
+		Limits: imagine.LimitParams{
+			MaxPixels:      100 * 100,
+			MaxOutputWidth: 400,
+		},
+	})
+	assert.NoError(t, err)
+
+	t.Run("decompression bomb", func(t *testing.T) {
+		bomb := pngDeclaring(t, 50000, 50000)
+		_, err := i.Upload(bomb)
+		assert.Equal(t, imagine.ErrImageTooLarge, errors.Cause(err))
+
+		response := httptest.NewRecorder()
+		i.UploadHandlerFunc().ServeHTTP(response, multipartRequest(t, "/", "file", bomb))
+		assert.Equal(t, http.StatusRequestEntityTooLarge, response.Code)
+	})
+
+	t.Run("source pixels", func(t *testing.T) {
+		_, err := i.Upload(solidImage(t, 101, 100, color.White))
+		assert.Equal(t, imagine.ErrImageTooLarge, errors.Cause(err))
+
+		// images stored before the limits were set
+		assert.NoError(t, storage.Set(testSlug+".png", solidImage(t, 200, 200, color.White)))
+		_, err = i.Get(testSlug+".png", &imagine.ImageParams{Width: 10})
+		assert.Equal(t, imagine.ErrImageTooLarge, errors.Cause(err))
+
+		_, err = i.Upload(solidImage(t, 100, 100, color.White))
+		assert.NoError(t, err)
+	})
+
+	t.Run("output size", func(t *testing.T) {
+		assert.NoError(t, storage.Set(testSlug+".jpg", solidImage(t, 50, 50, color.White)))
+		_, err := i.Get(testSlug+".jpg", &imagine.ImageParams{Width: 401})
+		assert.Equal(t, imagine.ErrOutputTooLarge, errors.Cause(err))
+
+		request := httptest.NewRequest("GET", "/"+testSlug+".jpg?w=10000", nil)
+		response := httptest.NewRecorder()
+		i.GetHandlerFunc().ServeHTTP(response, request)
+		assert.Equal(t, http.StatusBadRequest, response.Code)
+
+		_, err = i.Get(testSlug+".jpg", &imagine.ImageParams{Width: 400})
+		assert.NoError(t, err)
+	})
+}
+
+// pngDeclaring returns a tiny PNG whose header declares a huge image
+func pngDeclaring(t *testing.T, width, height int) []byte {
+	data := solidImage(t, 1, 1, color.White)
+
+	// the IHDR chunk follows the signature, its CRC covers the type and data
+	ihdr := data[8+4 : 8+4+4+13]
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(width))
+	binary.BigEndian.PutUint32(ihdr[8:], uint32(height))
+	binary.BigEndian.PutUint32(data[8+4+4+13:], crc32.ChecksumIEEE(ihdr))
+
+	return data
+}
@@ -0,0 +1,108 @@
+package imagine
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// ErrListingUnsupported is returned when listing images stored in a store
+// which doesn't implement Lister
+var ErrListingUnsupported = errors.New("storage can't list images")
+
+// maxListLimit bounds the number of images of a listing page
+const maxListLimit = 1000
+
+// imageKey tells whether a storage key is an image rather than the hashes or
+// uploads in progress kept next to the images when their stores are shared
+func imageKey(key string) bool {
+	return !strings.HasPrefix(key, hashKeyPrefix) && !strings.HasPrefix(key, "tus-")
+}
+
+// List lists the stored images, sorted by slug. Storage must implement
+// Lister.
+func (i *Imagine) List(options ListOptions) (*ListPage, error) {
+	lister, ok := i.params.Storage.(Lister)
+	if !ok {
+		return nil, errors.Trace(ErrListingUnsupported)
+	}
+	options.withDefaults()
+
+	// skip the indexes kept next to the images, fetching
+	// pages until this one is full
+	page := &ListPage{Entries: []ListEntry{}}
+	for {
+		listed, err := lister.List(options)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		for idx, entry := range listed.Entries {
+			if !imageKey(entry.Key) {
+				continue
+			}
+			page.Entries = append(page.Entries, entry)
+
+			if len(page.Entries) == options.Limit {
+				if idx < len(listed.Entries)-1 || listed.NextCursor != "" {
+					page.NextCursor = entry.Key
+				}
+				return page, nil
+			}
+		}
+
+		if listed.NextCursor == "" {
+			return page, nil
+		}
+		options.Cursor = listed.NextCursor
+	}
+}
+
+// ListHandlerFunc lists the stored images as JSON, pages are selected with
+// the prefix, cursor and limit query params. It exposes every slug, so the
+// requests are authorized like the delete ones.
+func (i *Imagine) ListHandlerFunc() http.HandlerFunc {
+	return http.HandlerFunc(i.listHandler)
+}
+
+func (i *Imagine) listHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !i.authorize(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="imagine"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	options := ListOptions{
+		Prefix: query.Get("prefix"),
+		Cursor: query.Get("cursor"),
+	}
+	if query.Has("limit") {
+		limit, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || limit < 1 || limit > maxListLimit {
+			http.Error(w, "limit must be between 1 and "+strconv.Itoa(maxListLimit), http.StatusBadRequest)
+			return
+		}
+		options.Limit = limit
+	}
+
+	page, err := i.List(options)
+	if err != nil && errors.Cause(err) == ErrListingUnsupported {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
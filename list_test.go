@@ -0,0 +1,65 @@
+package imagine_test
+
+import (
+	"encoding/json"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/risico/imagine"
+)
+
+func TestListImages(t *testing.T) {
+	storage := imagine.NewInMemoryStorage(imagine.MemoryStoreParams{})
+	i, err := imagine.New(imagine.Params{
+		Storage:      storage,
+		Cache:        imagine.NewInMemoryStorage(imagine.MemoryStoreParams{}),
+		UploadPolicy: imagine.UploadPolicy{MaxWidth: 16, MaxHeight: 16},
+		Delete:       imagine.DeleteParams{Token: "secret"},
+		Similarity:   imagine.SimilarityParams{Store: storage},
+	})
+	assert.NoError(t, err)
+
+	slugs := map[string]bool{}
+	for _, c := range []color.Color{color.White, color.Black, color.Gray{Y: 128}} {
+		slug, err := i.Upload(solidImage(t, 32, 32, c))
+		assert.NoError(t, err)
+		slugs[slug] = true
+	}
+
+	// listing needs the token
+	request := httptest.NewRequest("GET", "/images", nil)
+	response := httptest.NewRecorder()
+	i.ListHandlerFunc().ServeHTTP(response, request)
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+
+	// the perceptual hashes kept next to the images aren't listed
+	listed := map[string]bool{}
+	cursor := ""
+	for pages := 0; pages < 3; pages++ {
+		request := httptest.NewRequest("GET", "/images?limit=2&cursor="+cursor, nil)
+		request.Header.Set("Authorization", "Bearer secret")
+		response := httptest.NewRecorder()
+		i.ListHandlerFunc().ServeHTTP(response, request)
+		assert.Equal(t, http.StatusOK, response.Code)
+
+		var page imagine.ListPage
+		assert.NoError(t, json.NewDecoder(response.Body).Decode(&page))
+		for _, entry := range page.Entries {
+			listed[entry.Key] = true
+		}
+		if cursor = page.NextCursor; cursor == "" {
+			break
+		}
+	}
+	assert.Equal(t, slugs, listed)
+
+	request = httptest.NewRequest("GET", "/images?limit=0", nil)
+	request.Header.Set("Authorization", "Bearer secret")
+	response = httptest.NewRecorder()
+	i.ListHandlerFunc().ServeHTTP(response, request)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+}
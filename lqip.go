@@ -0,0 +1,250 @@
+package imagine
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/h2non/bimg"
+	"github.com/juju/errors"
+)
+
+// ErrLQIPTooLarge is returned when a placeholder can't be squeezed under the
+// requested byte budget
+var ErrLQIPTooLarge = errors.New("placeholder exceeds the byte budget")
+
+const (
+	// LQIPDataURI renders the placeholder as a base64 data URI
+	LQIPDataURI = "datauri"
+	// LQIPSVG renders the placeholder as an inline SVG applying a blur filter
+	// on top of the embedded image
+	LQIPSVG = "svg"
+)
+
+// lqipMaxAttempts bounds the number of variants tried to fit the budget
+const lqipMaxAttempts = 16
+
+// LQIPParams configures the low quality image placeholders
+type LQIPParams struct {
+	// MaxBytes is the maximum size of the rendered placeholder. Defaults to 2KB.
+	MaxBytes int
+}
+
+// withDefaults sets the default values for the LQIP parameters
+func (p *LQIPParams) withDefaults() {
+	if p.MaxBytes == 0 {
+		p.MaxBytes = 2 * 1024
+	}
+}
+
+// LQIPOptions are the per request options of a low quality image placeholder
+type LQIPOptions struct {
+	// Mode is either LQIPDataURI (default) or LQIPSVG
+	Mode string
+
+	// MaxBytes overrides the configured byte budget, it can only lower it
+	MaxBytes int
+}
+
+// LQIP is a low quality image placeholder ready to be inlined in a page
+type LQIP struct {
+	Mode  string `json:"mode"`
+	Value string `json:"value"`
+
+	// Width and Height are the dimensions of the embedded tiny image
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// LQIP renders a tiny variant of an image as a data URI or inline SVG. The
+// variant is shrunk and compressed further until it fits the byte budget,
+// only the resulting placeholder is cached.
+func (i *Imagine) LQIP(slug string, params *ImageParams, opts LQIPOptions) (*LQIP, error) {
+	mode := opts.Mode
+	if mode == "" {
+		mode = LQIPDataURI
+	}
+	if mode != LQIPDataURI && mode != LQIPSVG {
+		return nil, errors.New("lqip mode must be datauri or svg")
+	}
+
+	maxBytes := i.params.LQIP.MaxBytes
+	if opts.MaxBytes > 0 && opts.MaxBytes < maxBytes {
+		maxBytes = opts.MaxBytes
+	}
+
+	key, err := i.cacheKey(slug, params)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	key = fmt.Sprintf("%slqip-%s-%d", key, mode, maxBytes)
+
+	// only the placeholder is cached, not the variants tried to fit it
+	cached, found, err := i.params.Cache.Get(key)
+	if err != nil && errors.Cause(err) != ErrKeyNotFound {
+		return nil, errors.Trace(err)
+	} else if err == nil && found {
+		lqip := &LQIP{}
+		if err := json.Unmarshal(cached, lqip); err == nil {
+			return lqip, nil
+		}
+	}
+
+	// missing slugs would render the much larger placeholder image
+	image, found, err := i.params.Storage.Get(slug)
+	if err != nil && errors.Cause(err) != ErrKeyNotFound {
+		return nil, errors.Trace(err)
+	} else if err != nil || !found {
+		return nil, errors.Annotatef(ErrImageNotFound, "slug %s", slug)
+	}
+
+	lqip, err := i.fitLQIP(image, params, mode, maxBytes)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	data, err := json.Marshal(lqip)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := i.params.Cache.Set(key, data); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return lqip, nil
+}
+
+// fitLQIP processes the image in memory, shrinking and compressing it until
+// the placeholder fits the byte budget
+func (i *Imagine) fitLQIP(image []byte, params *ImageParams, mode string, maxBytes int) (*LQIP, error) {
+	p := *params
+	lastWidth := 0
+	for attempt := 0; ; attempt++ {
+		processed, err := i.processImage(image, &p)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		size, err := processed.Size()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		pi := &ProcessedImage{Type: imageType(processed.Image()), Image: processed.Image()}
+		lqip := &LQIP{
+			Mode:   mode,
+			Value:  renderLQIP(mode, pi, size),
+			Width:  size.Width,
+			Height: size.Height,
+		}
+		if len(lqip.Value) <= maxBytes {
+			return lqip, nil
+		}
+
+		// shrink the image and lower its quality until it fits, giving up
+		// once neither goes down anymore
+		minimal := p.Quality != 0 && p.Quality <= 10
+		stuck := lastWidth != 0 && size.Width >= lastWidth
+		if attempt == lqipMaxAttempts || (minimal && (size.Width <= 4 || stuck)) {
+			return nil, errors.Annotatef(ErrLQIPTooLarge, "%d bytes over a %d bytes budget", len(lqip.Value), maxBytes)
+		}
+		lastWidth = size.Width
+
+		// the thumbnail and fit sizes would take precedence over the width
+		p.Thumbnail = 0
+		p.Fit = ""
+		p.Width = maxInt(4, size.Width*3/4)
+		p.Height = 0
+		if p.Quality == 0 || p.Quality > 10 {
+			p.Quality = maxInt(10, p.Quality-10)
+		}
+	}
+}
+
+// renderLQIP encodes the processed image according to the LQIP mode
+func renderLQIP(mode string, pi *ProcessedImage, size bimg.ImageSize) string {
+	dataURI := fmt.Sprintf("data:%s;base64,%s", mimeType(pi.Type), base64.StdEncoding.EncodeToString(pi.Image))
+	if mode == LQIPDataURI {
+		return dataURI
+	}
+
+	// the blur filter smooths the pixelation of the upscaled tiny image and
+	// the discrete alpha transfer keeps the edges from fading out
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d">`+
+		`<filter id="b" color-interpolation-filters="sRGB"><feGaussianBlur stdDeviation="1"/>`+
+		`<feComponentTransfer><feFuncA type="discrete" tableValues="1 1"/></feComponentTransfer></filter>`+
+		`<image preserveAspectRatio="none" filter="url(#b)" width="100%%" height="100%%" href="%s"/></svg>`,
+		size.Width, size.Height, dataURI)
+}
+
+// mimeType turns the bimg type names (e.g. webp) into a MIME type
+func mimeType(t string) string {
+	if strings.Contains(t, "/") {
+		return t
+	}
+	return "image/" + t
+}
+
+// LQIPHandlerFunc renders low quality image placeholders. The image is
+// processed with the placeholder preset unless a different preset is given.
+func (i *Imagine) LQIPHandlerFunc() http.HandlerFunc {
+	return http.HandlerFunc(i.lqipHandler)
+}
+
+// lqipHandler handles the LQIP requests
+func (i *Imagine) lqipHandler(w http.ResponseWriter, r *http.Request) {
+	slug, err := parseSlugFromPath(r.URL.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	if !query.Has("preset") {
+		query.Set("preset", "placeholder")
+	}
+	u := *r.URL
+	u.RawQuery = query.Encode()
+
+	params, err := i.ParamsFromQueryString(u.String())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	opts := LQIPOptions{Mode: query.Get("mode")}
+	if opts.Mode != "" && opts.Mode != LQIPDataURI && opts.Mode != LQIPSVG {
+		http.Error(w, "mode must be datauri or svg", http.StatusBadRequest)
+		return
+	}
+	if query.Has("max_bytes") {
+		opts.MaxBytes, err = strconv.Atoi(query.Get("max_bytes"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	lqip, err := i.LQIP(slug, params, opts)
+	if err != nil && errors.Cause(err) == ErrImageNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil && errors.Cause(err) == ErrLQIPTooLarge {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if query.Get("output") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(lqip)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(lqip.Value))
+}
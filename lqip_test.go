@@ -0,0 +1,129 @@
+package imagine_test
+
+import (
+	"encoding/json"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/risico/imagine"
+)
+
+func TestLQIPHandler(t *testing.T) {
+	storage := imagine.NewInMemoryStorage(imagine.MemoryStoreParams{})
+	cache := imagine.NewInMemoryStorage(imagine.MemoryStoreParams{})
+	i, err := imagine.New(imagine.Params{
+		Storage: storage,
+		Cache:   cache,
+	})
+	assert.NoError(t, err)
+
+	err = storage.Set(testSlug+".png", solidImage(t, 400, 300, color.RGBA{0, 128, 255, 255}))
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		query       string
+		accept      string
+		status      int
+		contentType string
+		prefix      string
+	}{
+		{
+			name:        "data uri",
+			status:      http.StatusOK,
+			contentType: "text/plain; charset=utf-8",
+			prefix:      "data:image/",
+		},
+		{
+			name:        "svg",
+			query:       "?mode=svg",
+			status:      http.StatusOK,
+			contentType: "text/plain; charset=utf-8",
+			prefix:      "<svg",
+		},
+		{
+			name:        "json output",
+			query:       "?output=json",
+			status:      http.StatusOK,
+			contentType: "application/json",
+			prefix:      "{",
+		},
+		{
+			name:        "json accept header",
+			accept:      "application/json",
+			status:      http.StatusOK,
+			contentType: "application/json",
+			prefix:      "{",
+		},
+		{
+			name:   "budget too small",
+			query:  "?max_bytes=10",
+			status: http.StatusUnprocessableEntity,
+		},
+		{
+			name:   "thumbnail budget too small",
+			query:  "?thumbnail=50&max_bytes=10",
+			status: http.StatusUnprocessableEntity,
+		},
+		{
+			name:   "invalid mode",
+			query:  "?mode=gif",
+			status: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest("GET", "/lqip/"+testSlug+".png"+tt.query, nil)
+			if tt.accept != "" {
+				request.Header.Set("Accept", tt.accept)
+			}
+			response := httptest.NewRecorder()
+			i.LQIPHandlerFunc().ServeHTTP(response, request)
+
+			assert.Equal(t, tt.status, response.Code)
+			if tt.status != http.StatusOK {
+				return
+			}
+			assert.Equal(t, tt.contentType, response.Header().Get("Content-Type"))
+			assert.True(t, strings.HasPrefix(response.Body.String(), tt.prefix))
+			assert.LessOrEqual(t, response.Body.Len(), 2*1024+1)
+		})
+	}
+
+	t.Run("missing image", func(t *testing.T) {
+		request := httptest.NewRequest("GET", "/lqip/"+strings.Repeat("f", 32)+".png", nil)
+		response := httptest.NewRecorder()
+		i.LQIPHandlerFunc().ServeHTTP(response, request)
+		assert.Equal(t, http.StatusNotFound, response.Code)
+	})
+
+	t.Run("shrinks to fit the budget", func(t *testing.T) {
+		params := &imagine.ImageParams{Width: 200, Quality: 90}
+		before, err := cache.(imagine.Lister).List(imagine.ListOptions{Prefix: testSlug, Limit: 1000})
+		assert.NoError(t, err)
+
+		lqip, err := i.LQIP(testSlug+".png", params, imagine.LQIPOptions{MaxBytes: 400})
+		assert.NoError(t, err)
+		assert.LessOrEqual(t, len(lqip.Value), 400)
+		assert.Less(t, lqip.Width, 200)
+
+		// the variants tried aren't cached, only the placeholder
+		after, err := cache.(imagine.Lister).List(imagine.ListOptions{Prefix: testSlug, Limit: 1000})
+		assert.NoError(t, err)
+		assert.Len(t, after.Entries, len(before.Entries)+1)
+
+		cached, err := i.LQIP(testSlug+".png", params, imagine.LQIPOptions{MaxBytes: 400})
+		assert.NoError(t, err)
+		assert.Equal(t, lqip, cached)
+
+		body, err := json.Marshal(lqip)
+		assert.NoError(t, err)
+		assert.Contains(t, string(body), `"mode":"datauri"`)
+	})
+}
@@ -0,0 +1,549 @@
+package imagine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+
+	"github.com/h2non/bimg"
+	"github.com/juju/errors"
+)
+
+// MetadataPolicy describes which metadata survives when an image is processed
+type MetadataPolicy string
+
+const (
+	// MetadataStrip removes all the metadata, this is the default
+	MetadataStrip MetadataPolicy = "none"
+	// MetadataKeepICC keeps the ICC color profile only
+	MetadataKeepICC MetadataPolicy = "icc"
+	// MetadataKeepCopyright keeps the ICC profile, the copyright and artist
+	// EXIF fields and the IPTC records
+	MetadataKeepCopyright MetadataPolicy = "copyright"
+	// MetadataKeepAll keeps all the metadata except the private tags (GPS
+	// location, maker notes, owner and serial numbers) unless
+	// Params.KeepPrivateMetadata is set
+	MetadataKeepAll MetadataPolicy = "all"
+)
+
+// valid tells whether p is one of the known policies
+func (p MetadataPolicy) valid() bool {
+	switch p {
+	case MetadataStrip, MetadataKeepICC, MetadataKeepCopyright, MetadataKeepAll:
+		return true
+	}
+	return false
+}
+
+// EXIF tags handled by the metadata policies
+const (
+	tagArtist          = 0x013B
+	tagJPEGThumbnail   = 0x0201
+	tagJPEGThumbLength = 0x0202
+	tagCopyright       = 0x8298
+	tagExifIFD         = 0x8769
+	tagGPSIFD          = 0x8825
+	tagInteropIFD      = 0xA005
+	tagMakerNote       = 0x927C
+	tagImageUniqueID   = 0xA420
+	tagCameraOwnerName = 0xA430
+	tagBodySerialNum   = 0xA431
+	tagLensSerialNum   = 0xA435
+)
+
+// privateTags are removed from the EXIF data unless private metadata is kept
+var privateTags = map[uint16]bool{
+	tagGPSIFD:          true,
+	tagMakerNote:       true,
+	tagImageUniqueID:   true,
+	tagCameraOwnerName: true,
+	tagBodySerialNum:   true,
+	tagLensSerialNum:   true,
+}
+
+// metadataPolicy returns the policy applying to params
+func (i *Imagine) metadataPolicy(params *ImageParams) MetadataPolicy {
+	if params != nil && params.Metadata != "" {
+		return MetadataPolicy(params.Metadata)
+	}
+	return i.params.MetadataPolicy
+}
+
+// filtersMetadata tells whether the metadata of outputType images can be
+// filtered according to the policies
+func filtersMetadata(outputType bimg.ImageType) bool {
+	return outputType == bimg.JPEG || outputType == bimg.WEBP || outputType == bimg.PNG
+}
+
+// stripsMetadata tells whether libvips has to strip all the metadata of an
+// image saved as outputType. Selective retention is done on JPEG, WebP and
+// PNG output, other formats only keep their metadata under MetadataKeepAll
+// along with the private tags.
+func (i *Imagine) stripsMetadata(policy MetadataPolicy, outputType bimg.ImageType, metadata bimg.ImageMetadata) bool {
+	if policy == MetadataStrip {
+		return true
+	}
+
+	if filtersMetadata(outputType) {
+		return false
+	}
+
+	return policy != MetadataKeepAll || !i.params.KeepPrivateMetadata
+}
+
+// filterMetadata drops the metadata of an image which is not allowed by the
+// policy. Formats which can't be filtered are returned untouched.
+func (i *Imagine) filterMetadata(data []byte, policy MetadataPolicy) ([]byte, error) {
+	switch bimg.DetermineImageType(data) {
+	case bimg.JPEG:
+		return filterJPEGMetadata(data, policy, i.params.KeepPrivateMetadata)
+	case bimg.WEBP:
+		return filterWebPMetadata(data, policy, i.params.KeepPrivateMetadata)
+	case bimg.PNG:
+		return filterPNGMetadata(data, policy, i.params.KeepPrivateMetadata)
+	}
+	return data, nil
+}
+
+// filterEXIF scrubs EXIF data in place, with or without its Exif header, and
+// tells whether anything is left to keep
+func filterEXIF(exif []byte, policy MetadataPolicy, keepPrivate bool) bool {
+	var keep func(uint16) bool
+	switch {
+	case policy == MetadataKeepAll && keepPrivate:
+		return true
+	case policy == MetadataKeepAll:
+		keep = func(tag uint16) bool { return !privateTags[tag] }
+	case policy == MetadataKeepCopyright:
+		keep = func(tag uint16) bool { return tag == tagCopyright || tag == tagArtist }
+	default:
+		return false
+	}
+
+	// never let EXIF data through that could not be scrubbed
+	return scrubTIFF(bytes.TrimPrefix(exif, exifHeader), keep, policy == MetadataKeepAll) == nil
+}
+
+// keepsXMP tells whether an XMP packet is kept
+func keepsXMP(packet []byte, policy MetadataPolicy, keepPrivate bool) bool {
+	if policy != MetadataKeepAll {
+		return false
+	}
+	// XMP can mirror the EXIF location
+	return keepPrivate || !bytes.Contains(packet, []byte("GPS"))
+}
+
+var (
+	exifHeader      = []byte("Exif\x00\x00")
+	xmpHeader       = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	iccHeader       = []byte("ICC_PROFILE\x00")
+	photoshopHeader = []byte("Photoshop 3.0\x00")
+)
+
+// filterJPEGMetadata walks the JPEG segments up to the image data and keeps
+// the metadata segments allowed by the policy
+func filterJPEGMetadata(data []byte, policy MetadataPolicy, keepPrivate bool) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, errors.New("not a jpeg image")
+	}
+
+	out := make([]byte, 0, len(data))
+	out = append(out, 0xFF, 0xD8)
+
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return nil, errors.Errorf("invalid jpeg marker at offset %d", pos)
+		}
+
+		marker := data[pos+1]
+		switch {
+		case marker == 0xFF:
+			// fill byte
+			pos++
+			continue
+		case marker == 0xDA || marker == 0xD9:
+			// start of scan or end of image, the rest is image data
+			return append(out, data[pos:]...), nil
+		case marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7):
+			// markers without a payload
+			out = append(out, data[pos:pos+2]...)
+			pos += 2
+			continue
+		}
+
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, errors.Errorf("invalid jpeg segment length at offset %d", pos)
+		}
+
+		segment := data[pos:end]
+		if keep, filtered := filterJPEGSegment(marker, segment, policy, keepPrivate); keep {
+			out = append(out, filtered...)
+		}
+		pos = end
+	}
+
+	return append(out, data[pos:]...), nil
+}
+
+// filterJPEGSegment decides whether a JPEG segment is kept and returns it,
+// possibly with part of its content removed
+func filterJPEGSegment(marker byte, segment []byte, policy MetadataPolicy, keepPrivate bool) (bool, []byte) {
+	payload := segment[4:]
+
+	switch {
+	case marker == 0xE1 && bytes.HasPrefix(payload, exifHeader):
+		filtered := append([]byte(nil), segment...)
+		if !filterEXIF(filtered[4:], policy, keepPrivate) {
+			return false, nil
+		}
+		return true, filtered
+
+	case marker == 0xE1 && bytes.HasPrefix(payload, xmpHeader):
+		return keepsXMP(payload, policy, keepPrivate), segment
+
+	case marker == 0xE2 && bytes.HasPrefix(payload, iccHeader):
+		return true, segment
+
+	case marker == 0xED && bytes.HasPrefix(payload, photoshopHeader):
+		return policy == MetadataKeepCopyright || policy == MetadataKeepAll, segment
+
+	case marker == 0xFE:
+		// comments
+		return policy == MetadataKeepAll, segment
+
+	case marker >= 0xE1 && marker <= 0xEF && marker != 0xEE:
+		// other application segments are vendor specific metadata, APP0
+		// (JFIF) and APP14 (Adobe) are needed to decode the image
+		return policy == MetadataKeepAll && keepPrivate, segment
+	}
+
+	return true, segment
+}
+
+// VP8X flags announcing the metadata chunks of a WebP image
+const (
+	webpFlagICC  = 0x20
+	webpFlagEXIF = 0x08
+	webpFlagXMP  = 0x04
+)
+
+// filterWebPMetadata walks the RIFF chunks of a WebP image and keeps the
+// metadata chunks allowed by the policy
+func filterWebPMetadata(data []byte, policy MetadataPolicy, keepPrivate bool) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errors.New("not a webp image")
+	}
+
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:12]...)
+
+	vp8x := -1
+	var flags byte
+	pos := 12
+	for pos+8 <= len(data) {
+		fourcc := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		if size < 0 || pos+8+size > len(data) {
+			return nil, errors.Errorf("invalid webp chunk size at offset %d", pos)
+		}
+		// chunks are padded to an even size, the last pad may be missing
+		end := pos + 8 + size + size&1
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk := data[pos:end]
+		pos = end
+
+		switch fourcc {
+		case "VP8X":
+			vp8x = len(out)
+		case "ICCP":
+			flags |= webpFlagICC
+		case "EXIF":
+			filtered := append([]byte(nil), chunk...)
+			if !filterEXIF(filtered[8:8+size], policy, keepPrivate) {
+				continue
+			}
+			chunk = filtered
+			flags |= webpFlagEXIF
+		case "XMP ":
+			if !keepsXMP(chunk[8:8+size], policy, keepPrivate) {
+				continue
+			}
+			flags |= webpFlagXMP
+		}
+		out = append(out, chunk...)
+	}
+
+	if vp8x >= 0 && vp8x+9 <= len(out) {
+		out[vp8x+8] = out[vp8x+8]&^(webpFlagICC|webpFlagEXIF|webpFlagXMP) | flags
+	}
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out, nil
+}
+
+var (
+	pngSignature = []byte("\x89PNG\r\n\x1a\n")
+	pngXMPKey    = []byte("XML:com.adobe.xmp\x00")
+)
+
+// filterPNGMetadata walks the chunks of a PNG image and keeps the metadata
+// chunks allowed by the policy
+func filterPNGMetadata(data []byte, policy MetadataPolicy, keepPrivate bool) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, errors.New("not a png image")
+	}
+
+	out := make([]byte, 0, len(data))
+	out = append(out, pngSignature...)
+
+	pos := len(pngSignature)
+	for pos+12 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		end := pos + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, errors.Errorf("invalid png chunk length at offset %d", pos)
+		}
+		chunk := data[pos:end]
+		payload := chunk[8 : 8+length]
+		pos = end
+
+		switch string(chunk[4:8]) {
+		case "eXIf":
+			filtered := append([]byte(nil), payload...)
+			if filterEXIF(filtered, policy, keepPrivate) {
+				out = appendPNGChunk(out, "eXIf", filtered)
+			}
+			continue
+		case "iTXt", "tEXt", "zTXt":
+			if !keepsPNGText(chunk[4:8], payload, policy, keepPrivate) {
+				continue
+			}
+		}
+		out = append(out, chunk...)
+	}
+
+	return append(out, data[pos:]...), nil
+}
+
+// keepsPNGText tells whether a PNG text chunk is kept. XMP packets follow
+// the XMP rules, the copyright and author texts are kept along with the
+// copyright and other texts are comments.
+func keepsPNGText(kind, payload []byte, policy MetadataPolicy, keepPrivate bool) bool {
+	if string(kind) == "iTXt" && bytes.HasPrefix(payload, pngXMPKey) {
+		// compressed packets can't be searched for a location
+		rest := payload[len(pngXMPKey):]
+		if len(rest) > 0 && rest[0] != 0 {
+			return policy == MetadataKeepAll && keepPrivate
+		}
+		return keepsXMP(rest, policy, keepPrivate)
+	}
+
+	keyword := payload
+	if end := bytes.IndexByte(payload, 0); end >= 0 {
+		keyword = payload[:end]
+	}
+	switch policy {
+	case MetadataKeepAll:
+		return true
+	case MetadataKeepCopyright:
+		return string(keyword) == "Copyright" || string(keyword) == "Author"
+	}
+	return false
+}
+
+// appendPNGChunk appends a chunk along with its CRC
+func appendPNGChunk(out []byte, kind string, payload []byte) []byte {
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(payload)))
+	copy(header[4:], kind)
+
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(payload)
+
+	out = append(out, header[:]...)
+	out = append(out, payload...)
+	return binary.BigEndian.AppendUint32(out, crc.Sum32())
+}
+
+// tiffScrubber removes entries from the IFDs of a TIFF structure in place,
+// zeroing the bytes they referenced so nothing is left behind
+type tiffScrubber struct {
+	b       []byte
+	order   binary.ByteOrder
+	visited map[uint32]bool
+}
+
+// scrubTIFF keeps the entries of the EXIF TIFF structure for which keep
+// returns true. The thumbnail IFD is kept only when keepThumbnail is set.
+func scrubTIFF(b []byte, keep func(uint16) bool, keepThumbnail bool) error {
+	if len(b) < 8 {
+		return errors.New("exif data too short")
+	}
+
+	t := &tiffScrubber{b: b, visited: map[uint32]bool{}}
+	switch string(b[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return errors.New("invalid tiff byte order")
+	}
+
+	ifd0 := t.order.Uint32(b[4:])
+	next, err := t.scrubIFD(ifd0, keep, 0)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if next != 0 {
+		if keepThumbnail {
+			_, err = t.scrubIFD(next, keep, 0)
+		} else {
+			err = t.zeroIFD(next, 0)
+			t.setNextIFD(ifd0, 0)
+		}
+	}
+
+	return errors.Trace(err)
+}
+
+// ifdEntries returns the number of entries of the IFD at offset
+func (t *tiffScrubber) ifdEntries(offset uint32, depth int) (int, error) {
+	if depth > 4 || t.visited[offset] {
+		return 0, errors.New("invalid tiff ifd chain")
+	}
+	if int(offset)+2 > len(t.b) {
+		return 0, errors.New("tiff ifd out of range")
+	}
+
+	n := int(t.order.Uint16(t.b[offset:]))
+	if int(offset)+2+12*n+4 > len(t.b) {
+		return 0, errors.New("tiff ifd out of range")
+	}
+
+	t.visited[offset] = true
+	return n, nil
+}
+
+// scrubIFD removes the entries rejected by keep from the IFD at offset and
+// returns the offset of the next IFD
+func (t *tiffScrubber) scrubIFD(offset uint32, keep func(uint16) bool, depth int) (uint32, error) {
+	n, err := t.ifdEntries(offset, depth)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	nextPos := int(offset) + 2 + 12*n
+	next := t.order.Uint32(t.b[nextPos:])
+
+	kept := 0
+	for e := 0; e < n; e++ {
+		entry := int(offset) + 2 + 12*e
+		tag := t.order.Uint16(t.b[entry:])
+
+		if !keep(tag) {
+			if isIFDPointer(tag) {
+				if err := t.zeroIFD(t.order.Uint32(t.b[entry+8:]), depth+1); err != nil {
+					return 0, errors.Trace(err)
+				}
+			}
+			t.zeroEntryData(entry)
+			continue
+		}
+
+		if isIFDPointer(tag) {
+			if _, err := t.scrubIFD(t.order.Uint32(t.b[entry+8:]), keep, depth+1); err != nil {
+				return 0, errors.Trace(err)
+			}
+		}
+
+		copy(t.b[int(offset)+2+12*kept:], t.b[entry:entry+12])
+		kept++
+	}
+
+	// compact the directory and move the next IFD pointer right after it
+	zero(t.b[int(offset)+2+12*kept : nextPos+4])
+	t.order.PutUint16(t.b[offset:], uint16(kept))
+	t.order.PutUint32(t.b[int(offset)+2+12*kept:], next)
+
+	return next, nil
+}
+
+// zeroIFD wipes the IFD at offset along with everything it references
+func (t *tiffScrubber) zeroIFD(offset uint32, depth int) error {
+	n, err := t.ifdEntries(offset, depth)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var thumbOffset, thumbLength uint32
+	for e := 0; e < n; e++ {
+		entry := int(offset) + 2 + 12*e
+		tag := t.order.Uint16(t.b[entry:])
+		switch {
+		case isIFDPointer(tag):
+			if err := t.zeroIFD(t.order.Uint32(t.b[entry+8:]), depth+1); err != nil {
+				return errors.Trace(err)
+			}
+		case tag == tagJPEGThumbnail:
+			thumbOffset = t.order.Uint32(t.b[entry+8:])
+		case tag == tagJPEGThumbLength:
+			thumbLength = t.order.Uint32(t.b[entry+8:])
+		}
+		t.zeroEntryData(entry)
+	}
+
+	if thumbLength > 0 && uint64(thumbOffset)+uint64(thumbLength) <= uint64(len(t.b)) {
+		zero(t.b[thumbOffset : thumbOffset+thumbLength])
+	}
+
+	zero(t.b[offset : int(offset)+2+12*n+4])
+	return nil
+}
+
+// zeroEntryData wipes the out of line value of the entry and the entry itself
+func (t *tiffScrubber) zeroEntryData(entry int) {
+	size := uint64(tiffTypeSize(t.order.Uint16(t.b[entry+2:]))) * uint64(t.order.Uint32(t.b[entry+4:]))
+	if size > 4 {
+		offset := uint64(t.order.Uint32(t.b[entry+8:]))
+		if offset+size <= uint64(len(t.b)) {
+			zero(t.b[offset : offset+size])
+		}
+	}
+	zero(t.b[entry : entry+12])
+}
+
+// setNextIFD updates the next IFD pointer of the IFD at offset
+func (t *tiffScrubber) setNextIFD(offset uint32, next uint32) {
+	n := int(t.order.Uint16(t.b[offset:]))
+	t.order.PutUint32(t.b[int(offset)+2+12*n:], next)
+}
+
+func isIFDPointer(tag uint16) bool {
+	return tag == tagExifIFD || tag == tagGPSIFD || tag == tagInteropIFD
+}
+
+// tiffTypeSize returns the size in bytes of a TIFF field type
+func tiffTypeSize(fieldType uint16) int {
+	switch fieldType {
+	case 3, 8:
+		return 2
+	case 4, 9, 11:
+		return 4
+	case 5, 10, 12:
+		return 8
+	}
+	return 1
+}
+
+func zero(b []byte) {
+	for idx := range b {
+		b[idx] = 0
+	}
+}
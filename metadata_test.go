@@ -0,0 +1,150 @@
+package imagine_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/risico/imagine"
+)
+
+func TestMetadataPolicy(t *testing.T) {
+	const (
+		camera    = "ACME-CAMERA-9000"
+		copyright = "(c) Jane Photographer"
+		datum     = "SECRET-GPS-DATUM"
+	)
+	source := jpegWithEXIF(t, camera, copyright, datum)
+
+	tests := []struct {
+		name        string
+		policy      imagine.MetadataPolicy
+		keepPrivate bool
+		contains    []string
+		missing     []string
+	}{
+		{
+			name:    "strip by default",
+			missing: []string{camera, copyright, datum},
+		},
+		{
+			name:     "copyright",
+			policy:   imagine.MetadataKeepCopyright,
+			contains: []string{copyright},
+			missing:  []string{camera, datum},
+		},
+		{
+			name:     "all but private tags",
+			policy:   imagine.MetadataKeepAll,
+			contains: []string{camera, copyright},
+			missing:  []string{datum},
+		},
+		{
+			name:        "all including private tags",
+			policy:      imagine.MetadataKeepAll,
+			keepPrivate: true,
+			contains:    []string{camera, copyright, datum},
+		},
+	}
+
+	for _, tt := range tests {
+		for _, format := range []string{"jpeg", "webp", "png"} {
+			t.Run(tt.name+" "+format, func(t *testing.T) {
+				storage := imagine.NewInMemoryStorage(imagine.MemoryStoreParams{})
+				i, err := imagine.New(imagine.Params{
+					Storage:             storage,
+					Cache:               imagine.NewInMemoryStorage(imagine.MemoryStoreParams{}),
+					MetadataPolicy:      tt.policy,
+					KeepPrivateMetadata: tt.keepPrivate,
+				})
+				assert.NoError(t, err)
+				assert.NoError(t, storage.Set(testSlug+".jpg", source))
+
+				pi, err := i.Get(testSlug+".jpg", &imagine.ImageParams{Width: 32, Format: format})
+				assert.NoError(t, err)
+
+				for _, s := range tt.contains {
+					assert.True(t, bytes.Contains(pi.Image, []byte(s)), "expected %q to be kept", s)
+				}
+				for _, s := range tt.missing {
+					assert.False(t, bytes.Contains(pi.Image, []byte(s)), "expected %q to be removed", s)
+				}
+			})
+		}
+	}
+
+	t.Run("per request override", func(t *testing.T) {
+		storage := imagine.NewInMemoryStorage(imagine.MemoryStoreParams{})
+		i, err := imagine.New(imagine.Params{
+			Storage: storage,
+			Cache:   imagine.NewInMemoryStorage(imagine.MemoryStoreParams{}),
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, storage.Set(testSlug+".jpg", source))
+
+		pi, err := i.Get(testSlug+".jpg", &imagine.ImageParams{Width: 32, Format: "jpeg", Metadata: "copyright"})
+		assert.NoError(t, err)
+		assert.True(t, bytes.Contains(pi.Image, []byte(copyright)))
+		assert.False(t, bytes.Contains(pi.Image, []byte(datum)))
+	})
+
+	t.Run("invalid policy", func(t *testing.T) {
+		_, err := imagine.New(imagine.Params{MetadataPolicy: "gps"})
+		assert.Error(t, err)
+	})
+}
+
+// jpegWithEXIF encodes a JPEG carrying an EXIF segment with the camera make,
+// the copyright and a GPS IFD holding the map datum
+func jpegWithEXIF(t *testing.T, camera, copyright, datum string) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for x := 0; x < 64; x++ {
+		for y := 0; y < 48; y++ {
+			img.Set(x, y, color.RGBA{uint8(x * 4), uint8(y * 5), 128, 255})
+		}
+	}
+	var buf bytes.Buffer
+	assert.NoError(t, jpeg.Encode(&buf, img, nil))
+
+	le := binary.LittleEndian
+	entry := func(b []byte, tag, typ uint16, count, value uint32) []byte {
+		e := make([]byte, 12)
+		le.PutUint16(e, tag)
+		le.PutUint16(e[2:], typ)
+		le.PutUint32(e[4:], count)
+		le.PutUint32(e[8:], value)
+		return append(b, e...)
+	}
+
+	// IFD0 at offset 8 with 3 entries, its values follow it
+	makeOffset := uint32(8 + 2 + 3*12 + 4)
+	copyrightOffset := makeOffset + uint32(len(camera)+1)
+	gpsOffset := copyrightOffset + uint32(len(copyright)+1)
+	datumOffset := gpsOffset + 2 + 12 + 4
+
+	tiff := []byte{'I', 'I', 0x2A, 0, 8, 0, 0, 0}
+	tiff = append(tiff, 3, 0)
+	tiff = entry(tiff, 0x010F, 2, uint32(len(camera)+1), makeOffset)
+	tiff = entry(tiff, 0x8298, 2, uint32(len(copyright)+1), copyrightOffset)
+	tiff = entry(tiff, 0x8825, 4, 1, gpsOffset)
+	tiff = append(tiff, 0, 0, 0, 0)
+	tiff = append(append(tiff, camera...), 0)
+	tiff = append(append(tiff, copyright...), 0)
+	tiff = append(tiff, 1, 0)
+	tiff = entry(tiff, 0x0012, 2, uint32(len(datum)+1), datumOffset)
+	tiff = append(tiff, 0, 0, 0, 0)
+	tiff = append(append(tiff, datum...), 0)
+
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	segment := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	segment = append(segment, payload...)
+
+	data := buf.Bytes()
+	return append(append([]byte{0xFF, 0xD8}, segment...), data[2:]...)
+}
@@ -0,0 +1,89 @@
+package imagine
+
+import (
+	"fmt"
+
+	"github.com/juju/errors"
+)
+
+// ErrOriginalNotFound is returned when regenerating an image whose original
+// upload wasn't kept
+var ErrOriginalNotFound = errors.New("original image not found")
+
+// storeOriginal keeps the upload of an image in the Originals store, under
+// the slug of the optimized image. It's normalized like every stored image
+// so documents are only kept sanitized.
+func (i *Imagine) storeOriginal(slug string, data []byte) error {
+	if i.params.Originals == nil {
+		return nil
+	}
+
+	data, err := normalizeInput(data)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := i.params.Originals.Set(slug, data); err != nil {
+		fmt.Printf("[Imagine] Failed to store original image: %v\n", err)
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// Original returns the upload of an image from the Originals store
+func (i *Imagine) Original(slug string) ([]byte, error) {
+	if i.params.Originals == nil {
+		return nil, errors.Annotatef(ErrOriginalNotFound, "image %s, originals aren't kept", slug)
+	}
+
+	data, found, err := i.params.Originals.Get(slug)
+	if err != nil && errors.Cause(err) != ErrKeyNotFound {
+		return nil, errors.Trace(err)
+	} else if err != nil || !found {
+		return nil, errors.Annotatef(ErrOriginalNotFound, "image %s", slug)
+	}
+	return data, nil
+}
+
+// Regenerate optimizes the original of an image again following another
+// policy and replaces the image with the result under the same slug, which
+// no longer is the hash of the image. Its variants are purged so they are
+// derived from the new image.
+//
+// Uploads are deduplicated by hash, so uploading the regenerated image
+// again, or its original with the regenerating policy, stores a copy under
+// a new slug. Only the similarity index, updated here, links them back.
+func (i *Imagine) Regenerate(slug string, policy UploadPolicy) error {
+	policy.withDefaults()
+	if err := policy.validate(); err != nil {
+		return errors.Trace(err)
+	}
+
+	original, err := i.Original(slug)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	fmt.Printf("[Imagine] Regenerating image %s from its original\n", slug)
+
+	data, err := i.optimize(original, policy)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := i.params.Storage.Set(slug, data); err != nil {
+		return errors.Trace(err)
+	}
+	if err := i.purgeDerivatives(slug); err != nil {
+		return errors.Trace(err)
+	}
+
+	if i.hashes != nil {
+		hashes, err := computeHashes(data)
+		if err != nil {
+			fmt.Printf("[Imagine] Warning: Failed to compute perceptual hashes: %v\n", err)
+			return nil
+		}
+		if err := i.hashes.add(slug, hashes); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
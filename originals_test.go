@@ -0,0 +1,85 @@
+package imagine_test
+
+import (
+	"image/color"
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/risico/imagine"
+)
+
+func TestOriginals(t *testing.T) {
+	storage := imagine.NewInMemoryStorage(imagine.MemoryStoreParams{})
+	originals := imagine.NewInMemoryStorage(imagine.MemoryStoreParams{})
+	i, err := imagine.New(imagine.Params{
+		Storage:      storage,
+		Cache:        imagine.NewInMemoryStorage(imagine.MemoryStoreParams{}),
+		Originals:    originals,
+		UploadPolicy: imagine.UploadPolicy{MaxWidth: 64, MaxHeight: 64},
+	})
+	assert.NoError(t, err)
+
+	image := solidImage(t, 200, 100, color.White)
+	slug, err := i.Upload(image)
+	assert.NoError(t, err)
+
+	kept, found, err := originals.Get(slug)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, image, kept)
+
+	variant, err := i.Get(slug, &imagine.ImageParams{Width: 32})
+	assert.NoError(t, err)
+	assertSize(t, 32, 16, variant.Image)
+
+	// the image is replaced under the same slug and its variants derived
+	// from the new one
+	assert.NoError(t, i.Regenerate(slug, imagine.UploadPolicy{MaxWidth: 128, MaxHeight: 128}))
+	stored, _, err := storage.Get(slug)
+	assert.NoError(t, err)
+	assertSize(t, 128, 64, stored)
+
+	variant, err = i.Get(slug, &imagine.ImageParams{Height: 48})
+	assert.NoError(t, err)
+	assertSize(t, 96, 48, variant.Image)
+	original, err := i.Original(slug)
+	assert.NoError(t, err)
+	assert.Equal(t, image, original)
+
+	err = i.Regenerate("missing", imagine.UploadPolicy{})
+	assert.Equal(t, imagine.ErrOriginalNotFound, errors.Cause(err))
+}
+
+func TestRegenerateDuplicates(t *testing.T) {
+	storage := imagine.NewInMemoryStorage(imagine.MemoryStoreParams{})
+	i, err := imagine.New(imagine.Params{
+		Storage:      storage,
+		Cache:        imagine.NewInMemoryStorage(imagine.MemoryStoreParams{}),
+		Originals:    imagine.NewInMemoryStorage(imagine.MemoryStoreParams{}),
+		UploadPolicy: imagine.UploadPolicy{MaxWidth: 64, MaxHeight: 64},
+		Similarity: imagine.SimilarityParams{
+			Store:      imagine.NewInMemoryStorage(imagine.MemoryStoreParams{}),
+			Duplicates: imagine.DuplicatesLink,
+		},
+	})
+	assert.NoError(t, err)
+
+	image := gradientImage(t, 200, 100, 0)
+	slug, err := i.Upload(image)
+	assert.NoError(t, err)
+
+	policy := imagine.UploadPolicy{MaxWidth: 128, MaxHeight: 128}
+	assert.NoError(t, i.Regenerate(slug, policy))
+
+	// the slug isn't the hash of the regenerated image, the similarity
+	// index links the uploads to it
+	regenerated, err := i.UploadWithPolicy(image, policy)
+	assert.NoError(t, err)
+	assert.Equal(t, slug, regenerated)
+
+	again, err := i.Upload(image)
+	assert.NoError(t, err)
+	assert.Equal(t, slug, again)
+}
@@ -0,0 +1,275 @@
+package imagine
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/h2non/bimg"
+	"github.com/juju/errors"
+)
+
+// paletteSampleSize is the longest side of the downscaled copy the palette is
+// extracted from, large enough to keep small accents and cheap to cluster
+const paletteSampleSize = 64
+
+// PaletteColor is a color of an image palette
+type PaletteColor struct {
+	Hex string `json:"hex"`
+	R   uint8  `json:"r"`
+	G   uint8  `json:"g"`
+	B   uint8  `json:"b"`
+
+	// Population is the percentage of the image pixels closest to this color
+	Population float64 `json:"population"`
+}
+
+// Palette describes the main colors of an image
+type Palette struct {
+	// Dominant is the color covering the largest part of the image
+	Dominant PaletteColor `json:"dominant"`
+
+	// Colors are the palette colors sorted by population
+	Colors []PaletteColor `json:"colors"`
+}
+
+// Palette returns the dominant color and a palette of up to n colors of a
+// stored image. Results are cached in the Cache store.
+func (i *Imagine) Palette(slug string, n int) (*Palette, error) {
+	if n < 1 || n > 16 {
+		return nil, errors.New("palette size must be between 1 and 16")
+	}
+
+	hash, err := i.params.Hasher.Hash([]byte(fmt.Sprintf("palette:%d", n)))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	cacheKey := fmt.Sprintf("%s%s", slug, hash)
+
+	cached, found, err := i.params.Cache.Get(cacheKey)
+	if err != nil && !errors.Is(err, ErrKeyNotFound) {
+		return nil, errors.Trace(err)
+	} else if err == nil && found {
+		var p Palette
+		if err := json.Unmarshal(cached, &p); err == nil {
+			return &p, nil
+		}
+	}
+
+	image, found, err := i.params.Storage.Get(slug)
+	if err != nil && !errors.Is(err, ErrKeyNotFound) {
+		return nil, errors.Trace(err)
+	} else if err != nil || !found {
+		return nil, errors.Annotatef(ErrImageNotFound, "slug %s", slug)
+	}
+
+	p, err := extractPalette(image, n)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if err := i.params.Cache.Set(cacheKey, data); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return p, nil
+}
+
+// dominantColor returns the dominant color of the image data
+func dominantColor(data []byte) (bimg.Color, error) {
+	p, err := extractPalette(data, 5)
+	if err != nil {
+		return bimg.Color{}, errors.Trace(err)
+	}
+
+	return bimg.Color{R: p.Dominant.R, G: p.Dominant.G, B: p.Dominant.B}, nil
+}
+
+// extractPalette clusters the colors of a downscaled copy of the image
+func extractPalette(data []byte, n int) (*Palette, error) {
+	sample, err := sampleImage(data, paletteSampleSize)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	clusters := clusterColors(sample, n)
+	if len(clusters) == 0 {
+		return nil, errors.New("image has no opaque pixels")
+	}
+
+	p := &Palette{Colors: clusters}
+	p.Dominant = clusters[0]
+
+	return p, nil
+}
+
+// colorBin accumulates the pixels falling in one cell of the color histogram
+type colorBin struct {
+	r, g, b float64
+	count   float64
+}
+
+// clusterColors runs a weighted k-means over a 15 bit color histogram of img,
+// ignoring mostly transparent pixels, and returns the clusters sorted by
+// population
+func clusterColors(img image.Image, k int) []PaletteColor {
+	pixels, width, height := toNRGBA(img)
+
+	bins := map[int]*colorBin{}
+	total := 0.0
+	for idx := 0; idx < width*height; idx++ {
+		r, g, b, a := pixels[idx*4], pixels[idx*4+1], pixels[idx*4+2], pixels[idx*4+3]
+		if a < 128 {
+			continue
+		}
+
+		key := int(r>>3)<<10 | int(g>>3)<<5 | int(b>>3)
+		bin, ok := bins[key]
+		if !ok {
+			bin = &colorBin{}
+			bins[key] = bin
+		}
+		bin.r += float64(r)
+		bin.g += float64(g)
+		bin.b += float64(b)
+		bin.count++
+		total++
+	}
+	if total == 0 {
+		return nil
+	}
+
+	// use the mean color of every bin, largest bins first so the seeds are
+	// picked from the most common colors
+	points := make([]colorBin, 0, len(bins))
+	for _, bin := range bins {
+		points = append(points, colorBin{r: bin.r / bin.count, g: bin.g / bin.count, b: bin.b / bin.count, count: bin.count})
+	}
+	sort.Slice(points, func(a, b int) bool {
+		if points[a].count != points[b].count {
+			return points[a].count > points[b].count
+		}
+		return points[a].r+points[a].g+points[a].b < points[b].r+points[b].g+points[b].b
+	})
+
+	// seed with common colors that are not too close to an existing seed
+	centroids := make([]colorBin, 0, k)
+	for _, minDistance := range []float64{48 * 48, 16 * 16, 0} {
+		for _, p := range points {
+			if len(centroids) == k {
+				break
+			}
+
+			distinct := true
+			for _, c := range centroids {
+				if colorDistance(p, c) <= minDistance {
+					distinct = false
+					break
+				}
+			}
+			if distinct {
+				centroids = append(centroids, p)
+			}
+		}
+	}
+
+	assignments := make([]int, len(points))
+	for iteration := 0; iteration < 10; iteration++ {
+		for idx, p := range points {
+			best := 0
+			for c := range centroids {
+				if colorDistance(p, centroids[c]) < colorDistance(p, centroids[best]) {
+					best = c
+				}
+			}
+			assignments[idx] = best
+		}
+
+		sums := make([]colorBin, len(centroids))
+		for idx, p := range points {
+			s := &sums[assignments[idx]]
+			s.r += p.r * p.count
+			s.g += p.g * p.count
+			s.b += p.b * p.count
+			s.count += p.count
+		}
+		for c := range centroids {
+			if sums[c].count > 0 {
+				centroids[c] = colorBin{r: sums[c].r / sums[c].count, g: sums[c].g / sums[c].count, b: sums[c].b / sums[c].count, count: sums[c].count}
+			}
+		}
+	}
+
+	colors := make([]PaletteColor, 0, len(centroids))
+	for _, c := range centroids {
+		if c.count == 0 {
+			continue
+		}
+		r, g, b := uint8(c.r+0.5), uint8(c.g+0.5), uint8(c.b+0.5)
+		colors = append(colors, PaletteColor{
+			Hex:        fmt.Sprintf("#%02x%02x%02x", r, g, b),
+			R:          r,
+			G:          g,
+			B:          b,
+			Population: c.count / total * 100,
+		})
+	}
+	sort.SliceStable(colors, func(a, b int) bool {
+		return colors[a].Population > colors[b].Population
+	})
+
+	return colors
+}
+
+func colorDistance(a, b colorBin) float64 {
+	dr, dg, db := a.r-b.r, a.g-b.g, a.b-b.b
+	return dr*dr + dg*dg + db*db
+}
+
+// PaletteHandlerFunc returns the dominant color and palette of an image as
+// JSON. The palette size can be set through the colors query param.
+func (i *Imagine) PaletteHandlerFunc() http.HandlerFunc {
+	return http.HandlerFunc(i.paletteHandler)
+}
+
+// paletteHandler handles the palette requests
+func (i *Imagine) paletteHandler(w http.ResponseWriter, r *http.Request) {
+	slug, err := parseSlugFromPath(r.URL.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	n := 5
+	if r.URL.Query().Has("colors") {
+		n, err = strconv.Atoi(r.URL.Query().Get("colors"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if n < 1 || n > 16 {
+			http.Error(w, "colors must be between 1 and 16", http.StatusBadRequest)
+			return
+		}
+	}
+
+	p, err := i.Palette(slug, n)
+	if err != nil && errors.Cause(err) == ErrImageNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
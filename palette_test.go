@@ -0,0 +1,87 @@
+package imagine_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/risico/imagine"
+)
+
+func TestPalette(t *testing.T) {
+	storage := imagine.NewInMemoryStorage(imagine.MemoryStoreParams{})
+	i, err := imagine.New(imagine.Params{
+		Storage: storage,
+		Cache:   imagine.NewInMemoryStorage(imagine.MemoryStoreParams{}),
+	})
+	assert.NoError(t, err)
+
+	// three quarters red, one quarter blue
+	img := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	for x := 0; x < 200; x++ {
+		for y := 0; y < 100; y++ {
+			c := color.RGBA{220, 20, 20, 255}
+			if x >= 150 {
+				c = color.RGBA{20, 20, 220, 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, img))
+	assert.NoError(t, storage.Set(testSlug+".png", buf.Bytes()))
+
+	p, err := i.Palette(testSlug+".png", 2)
+	assert.NoError(t, err)
+	assert.Len(t, p.Colors, 2)
+	assert.InDelta(t, 220, p.Dominant.R, 8)
+	assert.InDelta(t, 20, p.Dominant.B, 8)
+	assert.InDelta(t, 75, p.Colors[0].Population, 5)
+	assert.InDelta(t, 25, p.Colors[1].Population, 5)
+	assert.Equal(t, p.Dominant, p.Colors[0])
+
+	t.Run("handler", func(t *testing.T) {
+		request := httptest.NewRequest("GET", "/palette/"+testSlug+".png?colors=4", nil)
+		response := httptest.NewRecorder()
+		i.PaletteHandlerFunc().ServeHTTP(response, request)
+		assert.Equal(t, http.StatusOK, response.Code)
+
+		var body imagine.Palette
+		assert.NoError(t, json.NewDecoder(response.Body).Decode(&body))
+		assert.NotEmpty(t, body.Colors)
+		assert.LessOrEqual(t, len(body.Colors), 4)
+		assert.Regexp(t, "^#[0-9a-f]{6}$", body.Dominant.Hex)
+	})
+
+	t.Run("invalid colors", func(t *testing.T) {
+		request := httptest.NewRequest("GET", "/palette/"+testSlug+".png?colors=0", nil)
+		response := httptest.NewRecorder()
+		i.PaletteHandlerFunc().ServeHTTP(response, request)
+		assert.Equal(t, http.StatusBadRequest, response.Code)
+	})
+
+	t.Run("dominant letterbox", func(t *testing.T) {
+		pi, err := i.Get(testSlug+".png", &imagine.ImageParams{
+			Width:      100,
+			Height:     100,
+			Fit:        "contain",
+			Format:     "png",
+			Background: "dominant",
+		})
+		assert.NoError(t, err)
+
+		out, err := png.Decode(bytes.NewReader(pi.Image))
+		assert.NoError(t, err)
+		r, g, b, _ := out.At(0, 0).RGBA()
+		assert.InDelta(t, p.Dominant.R, r>>8, 8)
+		assert.InDelta(t, p.Dominant.G, g>>8, 8)
+		assert.InDelta(t, p.Dominant.B, b>>8, 8)
+	})
+}
@@ -0,0 +1,992 @@
+package imagine
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+
+	"github.com/juju/errors"
+)
+
+// ErrUnsupportedPDF is returned for PDF documents whose page or density
+// can't be changed
+var ErrUnsupportedPDF = errors.New("unsupported pdf document")
+
+// libvips renders the first page of PDF documents at 72 DPI and bimg can't
+// pass it any load option. Other pages and densities are rendered by
+// appending an incremental update to the document: a new page tree holding
+// only the requested page, scaled to the requested density.
+
+// PDF object types, numbers, strings and keywords are kept as raw bytes
+type (
+	pdfName  string
+	pdfRaw   []byte
+	pdfArray []interface{}
+	pdfDict  map[string]interface{}
+	pdfRef   struct{ num, gen int }
+)
+
+// pdfInheritable are the page attributes which can be set on the page tree
+var pdfInheritable = []string{"Resources", "MediaBox", "CropBox", "Rotate"}
+
+// pdfBoxes are the page boundaries scaled along with the content
+var pdfBoxes = []string{"MediaBox", "CropBox", "BleedBox", "TrimBox", "ArtBox"}
+
+// maxPDFDepth bounds the nesting of arrays and dictionaries
+const maxPDFDepth = 64
+
+// selectPDFPage returns a document rendering the nth page, starting at 1, of
+// a PDF document as its first page, scaled by scale. Decoded streams are
+// limited to maxStreamSize bytes.
+func selectPDFPage(data []byte, n int, scale float64, maxStreamSize int) ([]byte, error) {
+	doc, err := parsePDF(data, maxStreamSize)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	_, encrypted := doc.trailer["Encrypt"]
+	if encrypted && scale != 1 {
+		return nil, errors.Annotate(ErrUnsupportedPDF, "encrypted documents can't be scaled")
+	}
+
+	rootRef, ok := doc.trailer["Root"].(pdfRef)
+	if !ok {
+		return nil, errors.Annotate(ErrUnsupportedPDF, "missing document catalog")
+	}
+	catalog, err := doc.dict(rootRef)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	pagesRef, ok := catalog["Pages"].(pdfRef)
+	if !ok {
+		return nil, errors.Annotate(ErrUnsupportedPDF, "missing page tree")
+	}
+
+	pageRef, page, err := doc.findPage(pagesRef, n)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	size, err := strconv.Atoi(string(rawValue(doc.trailer["Size"])))
+	if err != nil {
+		return nil, errors.Annotate(ErrUnsupportedPDF, "invalid trailer size")
+	}
+
+	objects := map[pdfRef]interface{}{}
+	treeRef := pdfRef{num: size}
+	size++
+
+	page["Parent"] = treeRef
+	if scale != 1 {
+		for _, box := range pdfBoxes {
+			if _, ok := page[box]; !ok {
+				continue
+			}
+			scaled, err := doc.scaleBox(page[box], scale)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			page[box] = scaled
+		}
+		// annotations are not moved along with the content
+		delete(page, "Annots")
+
+		// wrap the content in a scaling transformation
+		before, after := pdfRef{num: size}, pdfRef{num: size + 1}
+		size += 2
+		factor := strconv.FormatFloat(scale, 'f', -1, 64)
+		objects[before] = pdfRaw(fmt.Sprintf("q %s 0 0 %s 0 0 cm\n", factor, factor))
+		objects[after] = pdfRaw("\nQ")
+
+		contents := pdfArray{before}
+		switch c := page["Contents"].(type) {
+		case pdfRef:
+			contents = append(contents, c)
+		case pdfArray:
+			contents = append(contents, c...)
+		}
+		page["Contents"] = append(contents, after)
+	}
+
+	catalog["Pages"] = treeRef
+	objects[rootRef] = catalog
+	objects[pageRef] = page
+	objects[treeRef] = pdfDict{"Type": pdfName("Pages"), "Kids": pdfArray{pageRef}, "Count": pdfRaw("1")}
+
+	trailer := pdfDict{
+		"Size": pdfRaw(strconv.Itoa(size)),
+		"Root": rootRef,
+		"Prev": pdfRaw(strconv.Itoa(doc.startxref)),
+	}
+	for _, key := range []string{"Encrypt", "ID"} {
+		if value, ok := doc.trailer[key]; ok {
+			trailer[key] = value
+		}
+	}
+
+	return appendPDFUpdate(data, objects, trailer), nil
+}
+
+// appendPDFUpdate appends the objects and a cross reference section pointing
+// to them. Objects given as raw bytes are written as streams.
+func appendPDFUpdate(data []byte, objects map[pdfRef]interface{}, trailer pdfDict) []byte {
+	refs := make([]pdfRef, 0, len(objects))
+	for ref := range objects {
+		refs = append(refs, ref)
+	}
+	sort.Slice(refs, func(a, b int) bool { return refs[a].num < refs[b].num })
+
+	var out bytes.Buffer
+	out.Write(data)
+	out.WriteString("\n")
+
+	offsets := map[pdfRef]int{}
+	for _, ref := range refs {
+		offsets[ref] = out.Len()
+		fmt.Fprintf(&out, "%d %d obj\n", ref.num, ref.gen)
+		if stream, ok := objects[ref].(pdfRaw); ok {
+			fmt.Fprintf(&out, "<< /Length %d >>\nstream\n%s\nendstream", len(stream), stream)
+		} else {
+			writePDFObject(&out, objects[ref])
+		}
+		out.WriteString("\nendobj\n")
+	}
+
+	xref := out.Len()
+	out.WriteString("xref\n")
+	for _, ref := range refs {
+		fmt.Fprintf(&out, "%d 1\n%010d %05d n\r\n", ref.num, offsets[ref], ref.gen)
+	}
+	out.WriteString("trailer\n")
+	writePDFObject(&out, trailer)
+	fmt.Fprintf(&out, "\nstartxref\n%d\n%%%%EOF\n", xref)
+
+	return out.Bytes()
+}
+
+// writePDFObject serializes an object
+func writePDFObject(w *bytes.Buffer, obj interface{}) {
+	switch o := obj.(type) {
+	case pdfDict:
+		keys := make([]string, 0, len(o))
+		for key := range o {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		w.WriteString("<<")
+		for _, key := range keys {
+			w.WriteString(" /" + key + " ")
+			writePDFObject(w, o[key])
+		}
+		w.WriteString(" >>")
+	case pdfArray:
+		w.WriteString("[")
+		for idx, item := range o {
+			if idx > 0 {
+				w.WriteString(" ")
+			}
+			writePDFObject(w, item)
+		}
+		w.WriteString("]")
+	case pdfRef:
+		fmt.Fprintf(w, "%d %d R", o.num, o.gen)
+	case pdfName:
+		w.WriteString("/" + string(o))
+	case pdfRaw:
+		w.Write(o)
+	}
+}
+
+// rawValue returns the raw bytes of a number or keyword
+func rawValue(obj interface{}) []byte {
+	raw, _ := obj.(pdfRaw)
+	return raw
+}
+
+// pdfXrefEntry locates an object, either at an offset of the file or inside
+// an object stream
+type pdfXrefEntry struct {
+	offset   int
+	stream   int
+	index    int
+	inStream bool
+}
+
+// pdfDocument gives access to the objects of a PDF document
+type pdfDocument struct {
+	data      []byte
+	startxref int
+	xref      map[int]pdfXrefEntry
+	trailer   pdfDict
+
+	// objectStreams caches the decoded object streams
+	objectStreams map[int]pdfObjectStream
+
+	// resolving are the objects being read, to detect references to an
+	// object from within itself
+	resolving map[int]bool
+
+	// maxStreamSize bounds the size of decoded streams
+	maxStreamSize int
+}
+
+// pdfObjectStream holds compressed objects, the offsets of the objects are
+// relative to first
+type pdfObjectStream struct {
+	data  []byte
+	first int
+}
+
+// parsePDF reads the cross reference sections of a document, newest first
+func parsePDF(data []byte, maxStreamSize int) (*pdfDocument, error) {
+	idx := bytes.LastIndex(data, []byte("startxref"))
+	if idx < 0 {
+		return nil, errors.Annotate(ErrUnsupportedPDF, "missing startxref")
+	}
+	p := &pdfParser{data: data, pos: idx + len("startxref")}
+	startxref, err := p.readInt()
+	if err != nil {
+		return nil, errors.Annotate(ErrUnsupportedPDF, "invalid startxref")
+	}
+
+	doc := &pdfDocument{
+		data:          data,
+		startxref:     startxref,
+		xref:          map[int]pdfXrefEntry{},
+		objectStreams: map[int]pdfObjectStream{},
+		resolving:     map[int]bool{},
+		maxStreamSize: maxStreamSize,
+	}
+
+	visited := map[int]bool{}
+	sections := []int{startxref}
+	for len(sections) > 0 {
+		offset := sections[0]
+		sections = sections[1:]
+		if visited[offset] || offset < 0 || offset >= len(data) {
+			continue
+		}
+		visited[offset] = true
+
+		trailer, err := doc.readXref(offset)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if doc.trailer == nil {
+			doc.trailer = trailer
+		}
+
+		// hybrid files list the compressed objects in a separate stream
+		for _, key := range []string{"XRefStm", "Prev"} {
+			if next, err := strconv.Atoi(string(rawValue(trailer[key]))); err == nil {
+				sections = append(sections, next)
+			}
+		}
+	}
+
+	return doc, nil
+}
+
+// readXref reads a cross reference table or stream, entries already read
+// from a newer section are kept
+func (d *pdfDocument) readXref(offset int) (pdfDict, error) {
+	p := &pdfParser{data: d.data, pos: offset}
+	p.skipSpace()
+
+	if !bytes.HasPrefix(d.data[p.pos:], []byte("xref")) {
+		return d.readXrefStream(p.pos)
+	}
+	p.pos += len("xref")
+
+	for {
+		p.skipSpace()
+		if bytes.HasPrefix(d.data[p.pos:], []byte("trailer")) {
+			p.pos += len("trailer")
+			break
+		}
+
+		start, err := p.readInt()
+		if err != nil {
+			return nil, errors.Annotate(ErrUnsupportedPDF, "invalid xref section")
+		}
+		count, err := p.readInt()
+		if err != nil {
+			return nil, errors.Annotate(ErrUnsupportedPDF, "invalid xref section")
+		}
+
+		for num := start; num < start+count; num++ {
+			offset, err := p.readInt()
+			if err != nil {
+				return nil, errors.Annotate(ErrUnsupportedPDF, "invalid xref entry")
+			}
+			if _, err := p.readInt(); err != nil {
+				return nil, errors.Annotate(ErrUnsupportedPDF, "invalid xref entry")
+			}
+			p.skipSpace()
+			if p.pos >= len(d.data) {
+				return nil, errors.Annotate(ErrUnsupportedPDF, "truncated xref")
+			}
+			inUse := d.data[p.pos] == 'n'
+			p.pos++
+
+			if _, ok := d.xref[num]; !ok && inUse {
+				d.xref[num] = pdfXrefEntry{offset: offset}
+			}
+		}
+	}
+
+	trailer, err := p.parseObject()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	dict, ok := trailer.(pdfDict)
+	if !ok {
+		return nil, errors.Annotate(ErrUnsupportedPDF, "invalid trailer")
+	}
+	return dict, nil
+}
+
+// readXrefStream reads a cross reference stream, its dictionary doubles as
+// the trailer
+func (d *pdfDocument) readXrefStream(offset int) (pdfDict, error) {
+	obj, stream, err := d.readObjectAt(offset)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	dict, ok := obj.(pdfDict)
+	if !ok || stream == nil {
+		return nil, errors.Annotate(ErrUnsupportedPDF, "invalid xref stream")
+	}
+
+	widths, err := d.ints(dict["W"])
+	if err != nil || len(widths) != 3 {
+		return nil, errors.Annotate(ErrUnsupportedPDF, "invalid xref stream widths")
+	}
+	index, err := d.ints(dict["Index"])
+	if err != nil || len(index) == 0 {
+		size, err := strconv.Atoi(string(rawValue(dict["Size"])))
+		if err != nil {
+			return nil, errors.Annotate(ErrUnsupportedPDF, "invalid xref stream size")
+		}
+		index = []int{0, size}
+	}
+
+	field := func(b []byte) int {
+		v := 0
+		for _, c := range b {
+			v = v<<8 | int(c)
+		}
+		return v
+	}
+
+	entrySize := widths[0] + widths[1] + widths[2]
+	if entrySize == 0 || widths[0] < 0 || widths[1] < 0 || widths[2] < 0 {
+		return nil, errors.Annotate(ErrUnsupportedPDF, "invalid xref stream widths")
+	}
+	// the sections can't list more entries than the stream holds
+	for s := 1; s < len(index); s += 2 {
+		if index[s] < 0 || index[s] > len(stream)/entrySize {
+			return nil, errors.Annotate(ErrUnsupportedPDF, "invalid xref stream index")
+		}
+	}
+
+	pos := 0
+	for s := 0; s+1 < len(index); s += 2 {
+		for num := index[s]; num < index[s]+index[s+1]; num++ {
+			if pos+entrySize > len(stream) {
+				return nil, errors.Annotate(ErrUnsupportedPDF, "truncated xref stream")
+			}
+			entry := stream[pos : pos+entrySize]
+			pos += entrySize
+
+			kind := 1
+			if widths[0] > 0 {
+				kind = field(entry[:widths[0]])
+			}
+			second := field(entry[widths[0] : widths[0]+widths[1]])
+			third := field(entry[widths[0]+widths[1]:])
+
+			if _, ok := d.xref[num]; ok {
+				continue
+			}
+			switch kind {
+			case 1:
+				d.xref[num] = pdfXrefEntry{offset: second}
+			case 2:
+				d.xref[num] = pdfXrefEntry{stream: second, index: third, inStream: true}
+			}
+		}
+	}
+
+	return dict, nil
+}
+
+// ints resolves an array of integers
+func (d *pdfDocument) ints(obj interface{}) ([]int, error) {
+	obj, err := d.resolve(obj)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	array, ok := obj.(pdfArray)
+	if !ok {
+		return nil, errors.Annotate(ErrUnsupportedPDF, "expected an array")
+	}
+
+	ints := make([]int, len(array))
+	for idx, item := range array {
+		ints[idx], err = strconv.Atoi(string(rawValue(item)))
+		if err != nil {
+			return nil, errors.Annotate(ErrUnsupportedPDF, "expected an integer")
+		}
+	}
+	return ints, nil
+}
+
+// resolve follows indirect references
+func (d *pdfDocument) resolve(obj interface{}) (interface{}, error) {
+	for depth := 0; depth < 32; depth++ {
+		ref, ok := obj.(pdfRef)
+		if !ok {
+			return obj, nil
+		}
+		var err error
+		obj, err = d.object(ref.num)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	return nil, errors.Annotate(ErrUnsupportedPDF, "reference loop")
+}
+
+// dict resolves a dictionary, the result is a copy which can be modified
+func (d *pdfDocument) dict(obj interface{}) (pdfDict, error) {
+	obj, err := d.resolve(obj)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	dict, ok := obj.(pdfDict)
+	if !ok {
+		return nil, errors.Annotate(ErrUnsupportedPDF, "expected a dictionary")
+	}
+
+	copied := pdfDict{}
+	for key, value := range dict {
+		copied[key] = value
+	}
+	return copied, nil
+}
+
+// object returns the object numbered num
+func (d *pdfDocument) object(num int) (interface{}, error) {
+	entry, ok := d.xref[num]
+	if !ok {
+		return nil, errors.Annotatef(ErrUnsupportedPDF, "object %d not found", num)
+	}
+
+	// e.g. a stream whose length references the stream itself
+	if d.resolving[num] {
+		return nil, errors.Annotatef(ErrUnsupportedPDF, "object %d references itself", num)
+	}
+	d.resolving[num] = true
+	defer delete(d.resolving, num)
+
+	if !entry.inStream {
+		obj, _, err := d.readObjectAt(entry.offset)
+		return obj, errors.Trace(err)
+	}
+
+	stream, ok := d.objectStreams[entry.stream]
+	if !ok {
+		container, ok := d.xref[entry.stream]
+		if !ok || container.inStream {
+			return nil, errors.Annotate(ErrUnsupportedPDF, "invalid object stream")
+		}
+		obj, raw, err := d.readObjectAt(container.offset)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		dict, ok := obj.(pdfDict)
+		if !ok || raw == nil {
+			return nil, errors.Annotate(ErrUnsupportedPDF, "invalid object stream")
+		}
+
+		first, err := strconv.Atoi(string(rawValue(dict["First"])))
+		if err != nil || first < 0 || first > len(raw) {
+			return nil, errors.Annotate(ErrUnsupportedPDF, "invalid object stream")
+		}
+		stream = pdfObjectStream{data: raw, first: first}
+		d.objectStreams[entry.stream] = stream
+	}
+
+	// the stream starts with pairs of object numbers and offsets
+	p := &pdfParser{data: stream.data}
+	offset := 0
+	for idx := 0; idx <= entry.index; idx++ {
+		var err error
+		if _, err = p.readInt(); err == nil {
+			offset, err = p.readInt()
+		}
+		if err != nil {
+			return nil, errors.Annotate(ErrUnsupportedPDF, "invalid object stream")
+		}
+	}
+
+	if offset < 0 || offset >= len(stream.data)-stream.first {
+		return nil, errors.Annotate(ErrUnsupportedPDF, "invalid object stream offset")
+	}
+	p.pos = stream.first + offset
+	obj, err := p.parseObject()
+	return obj, errors.Trace(err)
+}
+
+// readObjectAt reads the indirect object at offset along with its decoded
+// stream, if any
+func (d *pdfDocument) readObjectAt(offset int) (interface{}, []byte, error) {
+	// the offsets come from the cross references of the document
+	if offset < 0 || offset >= len(d.data) {
+		return nil, nil, errors.Annotatef(ErrUnsupportedPDF, "invalid object offset %d", offset)
+	}
+	p := &pdfParser{data: d.data, pos: offset}
+	if _, err := p.readInt(); err != nil {
+		return nil, nil, errors.Annotate(ErrUnsupportedPDF, "invalid object header")
+	}
+	if _, err := p.readInt(); err != nil {
+		return nil, nil, errors.Annotate(ErrUnsupportedPDF, "invalid object header")
+	}
+	p.skipSpace()
+	if !bytes.HasPrefix(d.data[p.pos:], []byte("obj")) {
+		return nil, nil, errors.Annotate(ErrUnsupportedPDF, "invalid object header")
+	}
+	p.pos += len("obj")
+
+	obj, err := p.parseObject()
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	p.skipSpace()
+	dict, ok := obj.(pdfDict)
+	if !ok || !bytes.HasPrefix(d.data[p.pos:], []byte("stream")) {
+		return obj, nil, nil
+	}
+
+	p.pos += len("stream")
+	if bytes.HasPrefix(d.data[p.pos:], []byte("\r\n")) {
+		p.pos += 2
+	} else if p.pos < len(d.data) && d.data[p.pos] == '\n' {
+		p.pos++
+	}
+
+	lengthObj, err := d.resolve(dict["Length"])
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	length, err := strconv.Atoi(string(rawValue(lengthObj)))
+	if err != nil || length < 0 || p.pos+length > len(d.data) {
+		return nil, nil, errors.Annotate(ErrUnsupportedPDF, "invalid stream length")
+	}
+
+	stream, err := d.decodeStream(dict, d.data[p.pos:p.pos+length])
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	return obj, stream, nil
+}
+
+// decodeStream decodes the Flate compressed streams holding cross
+// references and objects
+func (d *pdfDocument) decodeStream(dict pdfDict, raw []byte) ([]byte, error) {
+	filter, err := d.resolve(dict["Filter"])
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if array, ok := filter.(pdfArray); ok && len(array) == 1 {
+		filter = array[0]
+	}
+
+	switch filter {
+	case nil:
+		return raw, nil
+	case pdfName("FlateDecode"):
+	default:
+		return nil, errors.Annotatef(ErrUnsupportedPDF, "unsupported stream filter %v", filter)
+	}
+
+	reader, err := zlib.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, errors.Annotate(ErrUnsupportedPDF, err.Error())
+	}
+	decoded, err := io.ReadAll(io.LimitReader(reader, int64(d.maxStreamSize)+1))
+	if err != nil {
+		return nil, errors.Annotate(ErrUnsupportedPDF, err.Error())
+	}
+	if len(decoded) > d.maxStreamSize {
+		return nil, errors.Annotatef(ErrUnsupportedPDF, "stream over %d bytes once decoded", d.maxStreamSize)
+	}
+
+	params, _ := d.resolve(dict["DecodeParms"])
+	if array, ok := params.(pdfArray); ok && len(array) == 1 {
+		params, _ = d.resolve(array[0])
+	}
+	paramsDict, _ := params.(pdfDict)
+	predictor, _ := strconv.Atoi(string(rawValue(paramsDict["Predictor"])))
+	if predictor < 10 {
+		if predictor > 1 {
+			return nil, errors.Annotatef(ErrUnsupportedPDF, "unsupported predictor %d", predictor)
+		}
+		return decoded, nil
+	}
+
+	columns := 1
+	if c, err := strconv.Atoi(string(rawValue(paramsDict["Columns"]))); err == nil {
+		columns = c
+	}
+	return unpredictPNG(decoded, columns)
+}
+
+// unpredictPNG reverts the PNG predictors applied to rows of bytes
+func unpredictPNG(data []byte, columns int) ([]byte, error) {
+	stride := columns + 1
+	if columns < 1 || len(data)%stride != 0 {
+		return nil, errors.Annotate(ErrUnsupportedPDF, "invalid predicted stream")
+	}
+
+	out := make([]byte, 0, len(data)/stride*columns)
+	previous := make([]byte, columns)
+	for pos := 0; pos < len(data); pos += stride {
+		filter, row := data[pos], append([]byte(nil), data[pos+1:pos+stride]...)
+		for x := range row {
+			var left, upLeft byte
+			if x > 0 {
+				left, upLeft = row[x-1], previous[x-1]
+			}
+			up := previous[x]
+
+			switch filter {
+			case 1:
+				row[x] += left
+			case 2:
+				row[x] += up
+			case 3:
+				row[x] += byte((int(left) + int(up)) / 2)
+			case 4:
+				row[x] += paeth(left, up, upLeft)
+			}
+		}
+		out = append(out, row...)
+		previous = row
+	}
+
+	return out, nil
+}
+
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	switch {
+	case pa <= pb && pa <= pc:
+		return a
+	case pb <= pc:
+		return b
+	}
+	return c
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// findPage walks the page tree down to the nth page, the attributes it
+// inherits from the tree are copied to the returned page
+func (d *pdfDocument) findPage(tree pdfRef, n int) (pdfRef, pdfDict, error) {
+	node, err := d.dict(tree)
+	if err != nil {
+		return pdfRef{}, nil, errors.Trace(err)
+	}
+	total, _ := strconv.Atoi(string(rawValue(node["Count"])))
+	if n > total {
+		return pdfRef{}, nil, errors.Annotatef(ErrPageOutOfRange, "page %d of %d", n, total)
+	}
+
+	inherited := pdfDict{}
+	remaining := n
+	for depth := 0; depth < 64; depth++ {
+		for _, key := range pdfInheritable {
+			if value, ok := node[key]; ok {
+				inherited[key] = value
+			}
+		}
+
+		kids, err := d.resolve(node["Kids"])
+		if err != nil {
+			return pdfRef{}, nil, errors.Trace(err)
+		}
+		array, _ := kids.(pdfArray)
+
+		var next pdfDict
+		for _, kid := range array {
+			ref, ok := kid.(pdfRef)
+			if !ok {
+				continue
+			}
+			child, err := d.dict(ref)
+			if err != nil {
+				return pdfRef{}, nil, errors.Trace(err)
+			}
+
+			if child["Type"] != pdfName("Pages") {
+				remaining--
+				if remaining == 0 {
+					for key, value := range inherited {
+						if _, ok := child[key]; !ok {
+							child[key] = value
+						}
+					}
+					return ref, child, nil
+				}
+				continue
+			}
+
+			count, _ := strconv.Atoi(string(rawValue(child["Count"])))
+			if remaining <= count {
+				next = child
+				break
+			}
+			remaining -= count
+		}
+
+		if next == nil {
+			break
+		}
+		node = next
+	}
+
+	return pdfRef{}, nil, errors.Annotatef(ErrPageOutOfRange, "page %d not found in the page tree", n)
+}
+
+// scaleBox multiplies the coordinates of a page boundary
+func (d *pdfDocument) scaleBox(obj interface{}, scale float64) (pdfArray, error) {
+	obj, err := d.resolve(obj)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	box, ok := obj.(pdfArray)
+	if !ok || len(box) != 4 {
+		return nil, errors.Annotate(ErrUnsupportedPDF, "invalid page boundary")
+	}
+
+	scaled := make(pdfArray, 4)
+	for idx, item := range box {
+		item, err := d.resolve(item)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		v, err := strconv.ParseFloat(string(rawValue(item)), 64)
+		if err != nil {
+			return nil, errors.Annotate(ErrUnsupportedPDF, "invalid page boundary")
+		}
+		scaled[idx] = pdfRaw(strconv.FormatFloat(v*scale, 'f', -1, 64))
+	}
+	return scaled, nil
+}
+
+// pdfParser reads PDF objects
+type pdfParser struct {
+	data []byte
+	pos  int
+
+	// depth is the nesting of the array or dictionary being parsed
+	depth int
+}
+
+func isPDFSpace(c byte) bool {
+	switch c {
+	case 0, '\t', '\n', '\f', '\r', ' ':
+		return true
+	}
+	return false
+}
+
+func isPDFDelimiter(c byte) bool {
+	switch c {
+	case '(', ')', '<', '>', '[', ']', '{', '}', '/', '%':
+		return true
+	}
+	return isPDFSpace(c)
+}
+
+// skipSpace skips white space and comments
+func (p *pdfParser) skipSpace() {
+	for p.pos < len(p.data) {
+		switch c := p.data[p.pos]; {
+		case isPDFSpace(c):
+			p.pos++
+		case c == '%':
+			for p.pos < len(p.data) && p.data[p.pos] != '\n' && p.data[p.pos] != '\r' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// token reads a regular token
+func (p *pdfParser) token() []byte {
+	start := p.pos
+	for p.pos < len(p.data) && !isPDFDelimiter(p.data[p.pos]) {
+		p.pos++
+	}
+	return p.data[start:p.pos]
+}
+
+func (p *pdfParser) readInt() (int, error) {
+	p.skipSpace()
+	v, err := strconv.Atoi(string(p.token()))
+	if err != nil {
+		return 0, errors.Annotate(ErrUnsupportedPDF, "expected an integer")
+	}
+	return v, nil
+}
+
+// nest enters an array or dictionary, failing past maxPDFDepth
+func (p *pdfParser) nest() error {
+	if p.depth >= maxPDFDepth {
+		return errors.Annotate(ErrUnsupportedPDF, "objects nested too deeply")
+	}
+	p.depth++
+	return nil
+}
+
+func (p *pdfParser) unnest() {
+	p.depth--
+}
+
+// parseObject reads a direct object, references are kept as pdfRef
+func (p *pdfParser) parseObject() (interface{}, error) {
+	p.skipSpace()
+	if p.pos >= len(p.data) {
+		return nil, errors.Annotate(ErrUnsupportedPDF, "unexpected end of data")
+	}
+
+	switch c := p.data[p.pos]; {
+	case c == '/':
+		p.pos++
+		return pdfName(p.token()), nil
+
+	case bytes.HasPrefix(p.data[p.pos:], []byte("<<")):
+		if err := p.nest(); err != nil {
+			return nil, errors.Trace(err)
+		}
+		defer p.unnest()
+
+		p.pos += 2
+		dict := pdfDict{}
+		for {
+			p.skipSpace()
+			if bytes.HasPrefix(p.data[p.pos:], []byte(">>")) {
+				p.pos += 2
+				return dict, nil
+			}
+			key, err := p.parseObject()
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			name, ok := key.(pdfName)
+			if !ok {
+				return nil, errors.Annotate(ErrUnsupportedPDF, "expected a dictionary key")
+			}
+			value, err := p.parseObject()
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			dict[string(name)] = value
+		}
+
+	case c == '<':
+		end := bytes.IndexByte(p.data[p.pos:], '>')
+		if end < 0 {
+			return nil, errors.Annotate(ErrUnsupportedPDF, "unterminated hex string")
+		}
+		raw := pdfRaw(p.data[p.pos : p.pos+end+1])
+		p.pos += end + 1
+		return raw, nil
+
+	case c == '[':
+		if err := p.nest(); err != nil {
+			return nil, errors.Trace(err)
+		}
+		defer p.unnest()
+
+		p.pos++
+		array := pdfArray{}
+		for {
+			p.skipSpace()
+			if p.pos < len(p.data) && p.data[p.pos] == ']' {
+				p.pos++
+				return array, nil
+			}
+			item, err := p.parseObject()
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			array = append(array, item)
+		}
+
+	case c == '(':
+		start := p.pos
+		depth := 0
+		for ; p.pos < len(p.data); p.pos++ {
+			switch p.data[p.pos] {
+			case '\\':
+				p.pos++
+			case '(':
+				depth++
+			case ')':
+				depth--
+				if depth == 0 {
+					p.pos++
+					return pdfRaw(p.data[start:p.pos]), nil
+				}
+			}
+		}
+		return nil, errors.Annotate(ErrUnsupportedPDF, "unterminated string")
+
+	case c == '+' || c == '-' || c == '.' || (c >= '0' && c <= '9'):
+		number := p.token()
+		if _, err := strconv.Atoi(string(number)); err != nil {
+			return pdfRaw(number), nil
+		}
+
+		// two integers followed by R make a reference
+		start := p.pos
+		p.skipSpace()
+		gen := p.token()
+		p.skipSpace()
+		if len(gen) > 0 && p.pos < len(p.data) && p.data[p.pos] == 'R' &&
+			(p.pos+1 == len(p.data) || isPDFDelimiter(p.data[p.pos+1])) {
+			num, _ := strconv.Atoi(string(number))
+			if g, err := strconv.Atoi(string(gen)); err == nil {
+				p.pos++
+				return pdfRef{num: num, gen: g}, nil
+			}
+		}
+		p.pos = start
+		return pdfRaw(number), nil
+
+	default:
+		keyword := p.token()
+		switch string(keyword) {
+		case "true", "false", "null":
+			return pdfRaw(keyword), nil
+		}
+		return nil, errors.Annotatef(ErrUnsupportedPDF, "unexpected token %q", keyword)
+	}
+}
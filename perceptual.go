@@ -0,0 +1,556 @@
+package imagine
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"math/bits"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// ErrNearDuplicate is returned when an upload is too similar to a stored
+// image and the duplicates policy rejects it
+var ErrNearDuplicate = errors.New("image is a near duplicate of a stored image")
+
+// ErrSimilarityDisabled is returned when searching similar images without a
+// perceptual hash index
+var ErrSimilarityDisabled = errors.New("similarity search is disabled")
+
+// The perceptual hash algorithms
+const (
+	// AverageHash compares each pixel to the mean, it's the fastest but
+	// sensitive to contrast and gamma changes
+	AverageHash = "ahash"
+	// DifferenceHash compares neighbour pixels, it follows gradients
+	DifferenceHash = "dhash"
+	// PerceptualHash compares low frequencies, it's the most robust to
+	// re-encoding, resizing and color adjustments
+	PerceptualHash = "phash"
+)
+
+// DuplicatePolicy tells what to do with uploads similar to stored images
+type DuplicatePolicy string
+
+const (
+	// DuplicatesAllow stores near duplicates like any other upload
+	DuplicatesAllow DuplicatePolicy = "allow"
+	// DuplicatesReject refuses near duplicates with ErrNearDuplicate
+	DuplicatesReject DuplicatePolicy = "reject"
+	// DuplicatesLink doesn't store near duplicates, the upload returns the
+	// slug of the closest stored image instead
+	DuplicatesLink DuplicatePolicy = "link"
+)
+
+// hashKeyPrefix prefixes the keys of the perceptual hashes in their store
+const hashKeyPrefix = "phash-"
+
+// hashKey is the key of the perceptual hashes of slug in their store
+func hashKey(slug string) string {
+	return hashKeyPrefix + slug
+}
+
+// SimilarityParams configures the perceptual hashing of uploads and the
+// search of similar images
+type SimilarityParams struct {
+	// Store keeps the perceptual hashes of the uploaded images, one entry
+	// per image, and must implement Lister. Perceptual hashing is disabled
+	// when nil.
+	Store Store
+
+	// SyncInterval is how often the index is synced with its store, to find
+	// the images hashed by other instances. Defaults to a minute.
+	SyncInterval time.Duration
+
+	// Algorithm is the hash images are compared with: ahash, dhash or
+	// phash. Defaults to phash.
+	Algorithm string
+
+	// MaxDistance is the Hamming distance, out of 64 bits, under which
+	// images are near duplicates. Defaults to 10.
+	MaxDistance int
+
+	// Duplicates is the policy applied to near duplicates. Defaults to
+	// allow.
+	Duplicates DuplicatePolicy
+
+	// Limit is the default number of similar images returned. Defaults to
+	// 10.
+	Limit int
+}
+
+// withDefaults sets the default values for the similarity parameters
+func (p *SimilarityParams) withDefaults() {
+	if p.Algorithm == "" {
+		p.Algorithm = PerceptualHash
+	}
+	if p.MaxDistance == 0 {
+		p.MaxDistance = 10
+	}
+	if p.Duplicates == "" {
+		p.Duplicates = DuplicatesAllow
+	}
+	if p.Limit == 0 {
+		p.Limit = 10
+	}
+	if p.SyncInterval == 0 {
+		p.SyncInterval = time.Minute
+	}
+}
+
+// validate checks the similarity parameters
+func (p *SimilarityParams) validate() error {
+	switch p.Algorithm {
+	case AverageHash, DifferenceHash, PerceptualHash:
+	default:
+		return errors.Errorf("invalid perceptual hash algorithm %q", p.Algorithm)
+	}
+
+	switch p.Duplicates {
+	case DuplicatesAllow, DuplicatesReject, DuplicatesLink:
+	default:
+		return errors.Errorf("invalid duplicates policy %q", p.Duplicates)
+	}
+	return nil
+}
+
+// SimilarImage is a stored image similar to another one
+type SimilarImage struct {
+	Slug string `json:"slug"`
+
+	// Distance is the Hamming distance between the perceptual hashes of the
+	// images, 0 for images looking the same
+	Distance int `json:"distance"`
+}
+
+// imageHashes are the perceptual hashes of an image
+type imageHashes struct {
+	AHash uint64 `json:"a"`
+	DHash uint64 `json:"d"`
+	PHash uint64 `json:"p"`
+}
+
+// get returns the hash computed with algorithm
+func (h imageHashes) get(algorithm string) uint64 {
+	switch algorithm {
+	case AverageHash:
+		return h.AHash
+	case DifferenceHash:
+		return h.DHash
+	}
+	return h.PHash
+}
+
+// computeHashes computes the perceptual hashes of the image data
+func computeHashes(data []byte) (imageHashes, error) {
+	// the hashes only look at 32x32 pixels at most
+	sample, err := sampleImage(data, 64)
+	if err != nil {
+		return imageHashes{}, errors.Trace(err)
+	}
+
+	return imageHashes{
+		AHash: averageHash(grayscale(sample, 8, 8)),
+		DHash: differenceHash(grayscale(sample, 9, 8)),
+		PHash: perceptualHash(grayscale(sample, 32, 32)),
+	}, nil
+}
+
+// grayscale resizes img to width x height luma values, averaging the pixels
+// of each area
+func grayscale(img image.Image, width, height int) []float64 {
+	bounds := img.Bounds()
+	sourceWidth, sourceHeight := bounds.Dx(), bounds.Dy()
+	luma := make([]float64, width*height)
+
+	for y := 0; y < height; y++ {
+		y0 := y * sourceHeight / height
+		y1 := (y + 1) * sourceHeight / height
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < width; x++ {
+			x0 := x * sourceWidth / width
+			x1 := (x + 1) * sourceWidth / width
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var sum float64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					c := color.GrayModel.Convert(img.At(bounds.Min.X+sx, bounds.Min.Y+sy)).(color.Gray)
+					sum += float64(c.Y)
+				}
+			}
+			luma[y*width+x] = sum / float64((y1-y0)*(x1-x0))
+		}
+	}
+
+	return luma
+}
+
+// averageHash sets the bits of the 8x8 pixels brighter than the mean
+func averageHash(luma []float64) uint64 {
+	var mean float64
+	for _, value := range luma {
+		mean += value
+	}
+	mean /= float64(len(luma))
+
+	var hash uint64
+	for _, value := range luma {
+		hash <<= 1
+		if value > mean {
+			hash |= 1
+		}
+	}
+	return hash
+}
+
+// differenceHash sets the bits of the 9x8 pixels brighter than their right
+// neighbour
+func differenceHash(luma []float64) uint64 {
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if luma[y*9+x] > luma[y*9+x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// perceptualHash sets the bits of the 8x8 lowest frequencies of the DCT of
+// 32x32 pixels above their median
+func perceptualHash(luma []float64) uint64 {
+	const size = 32
+
+	// separable DCT-II, rows then columns, only keeping the low frequencies
+	rows := make([]float64, size*8)
+	for y := 0; y < size; y++ {
+		for u := 0; u < 8; u++ {
+			var sum float64
+			for x := 0; x < size; x++ {
+				sum += luma[y*size+x] * math.Cos(float64((2*x+1)*u)*math.Pi/(2*size))
+			}
+			rows[y*8+u] = sum
+		}
+	}
+
+	coefficients := make([]float64, 64)
+	for v := 0; v < 8; v++ {
+		for u := 0; u < 8; u++ {
+			var sum float64
+			for y := 0; y < size; y++ {
+				sum += rows[y*8+u] * math.Cos(float64((2*y+1)*v)*math.Pi/(2*size))
+			}
+			coefficients[v*8+u] = sum
+		}
+	}
+
+	// the DC coefficient is the mean brightness, it would skew the median
+	sorted := append([]float64(nil), coefficients[1:]...)
+	sort.Float64s(sorted)
+	median := sorted[len(sorted)/2]
+
+	var hash uint64
+	for _, value := range coefficients {
+		hash <<= 1
+		if value > median {
+			hash |= 1
+		}
+	}
+	return hash
+}
+
+// hashIndex keeps the perceptual hashes of the stored images in memory, each
+// image has its own entry in the store. Searches compare every hash, which
+// stays fast up to hundreds of thousands of images.
+type hashIndex struct {
+	store    Store
+	lister   Lister
+	interval time.Duration
+
+	mu     sync.RWMutex
+	hashes map[string]imageHashes
+
+	// syncing guards synced, the last time the index was synced
+	syncing sync.Mutex
+	synced  time.Time
+}
+
+// newHashIndex loads the perceptual hash index from store
+func newHashIndex(store Store, interval time.Duration) (*hashIndex, error) {
+	lister, ok := store.(Lister)
+	if !ok {
+		return nil, errors.Annotate(ErrListingUnsupported, "perceptual hash store")
+	}
+
+	index := &hashIndex{store: store, lister: lister, interval: interval, hashes: map[string]imageHashes{}}
+	if err := index.sync(); err != nil {
+		return nil, errors.Annotate(err, "could not load the perceptual hash index")
+	}
+	return index, nil
+}
+
+// sync loads the hashes added to the store by other instances and drops the
+// removed ones, at most once per interval
+func (x *hashIndex) sync() error {
+	x.syncing.Lock()
+	defer x.syncing.Unlock()
+
+	if time.Since(x.synced) < x.interval {
+		return nil
+	}
+
+	// only the slugs known before listing can be dropped, the others may
+	// have been added since
+	x.mu.RLock()
+	known := make(map[string]bool, len(x.hashes))
+	for slug := range x.hashes {
+		known[slug] = true
+	}
+	x.mu.RUnlock()
+
+	listed := map[string]bool{}
+	options := ListOptions{Prefix: hashKeyPrefix, Limit: maxListLimit}
+	for {
+		page, err := x.lister.List(options)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		for _, entry := range page.Entries {
+			listed[strings.TrimPrefix(entry.Key, hashKeyPrefix)] = true
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		options.Cursor = page.NextCursor
+	}
+
+	added := map[string]imageHashes{}
+	for slug := range listed {
+		if known[slug] {
+			continue
+		}
+
+		data, found, err := x.store.Get(hashKey(slug))
+		if err != nil && errors.Cause(err) != ErrKeyNotFound {
+			return errors.Trace(err)
+		} else if err != nil || !found {
+			// removed since it was listed
+			continue
+		}
+
+		var hashes imageHashes
+		if err := json.Unmarshal(data, &hashes); err != nil {
+			return errors.Annotatef(err, "invalid perceptual hashes of %s", slug)
+		}
+		added[slug] = hashes
+	}
+
+	x.mu.Lock()
+	for slug := range known {
+		if !listed[slug] {
+			delete(x.hashes, slug)
+		}
+	}
+	for slug, hashes := range added {
+		x.hashes[slug] = hashes
+	}
+	x.mu.Unlock()
+
+	x.synced = time.Now()
+	return nil
+}
+
+// get returns the hashes of slug
+func (x *hashIndex) get(slug string) (imageHashes, bool) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	hashes, found := x.hashes[slug]
+	return hashes, found
+}
+
+// add records the hashes of slug
+func (x *hashIndex) add(slug string, hashes imageHashes) error {
+	data, err := json.Marshal(hashes)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := x.store.Set(hashKey(slug), data); err != nil {
+		return errors.Trace(err)
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.hashes[slug] = hashes
+	return nil
+}
+
+// remove drops the hashes of slug
+func (x *hashIndex) remove(slug string) error {
+	if err := deleteKey(x.store, hashKey(slug)); err != nil {
+		return errors.Trace(err)
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	delete(x.hashes, slug)
+	return nil
+}
+
+// nearest returns the images within maxDistance of hash, closest first
+func (x *hashIndex) nearest(hash uint64, algorithm string, maxDistance, limit int, exclude string) []SimilarImage {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	similar := []SimilarImage{}
+	for slug, hashes := range x.hashes {
+		distance := bits.OnesCount64(hash ^ hashes.get(algorithm))
+		if slug != exclude && distance <= maxDistance {
+			similar = append(similar, SimilarImage{Slug: slug, Distance: distance})
+		}
+	}
+
+	sort.Slice(similar, func(a, b int) bool {
+		if similar[a].Distance != similar[b].Distance {
+			return similar[a].Distance < similar[b].Distance
+		}
+		return similar[a].Slug < similar[b].Slug
+	})
+	if len(similar) > limit {
+		similar = similar[:limit]
+	}
+	return similar
+}
+
+// checkDuplicates hashes an upload and applies the duplicates policy, it
+// returns the slug of the stored image the upload links to, if any
+func (i *Imagine) checkDuplicates(slug string, data []byte) (string, *imageHashes, error) {
+	if i.hashes == nil {
+		return "", nil, nil
+	}
+
+	hashes, err := computeHashes(data)
+	if err != nil {
+		// the upload is still fine, it just won't be found as similar
+		fmt.Printf("[Imagine] Warning: Failed to compute perceptual hashes: %v\n", err)
+		return "", nil, nil
+	}
+
+	params := i.params.Similarity
+	if params.Duplicates == DuplicatesAllow {
+		return "", &hashes, nil
+	}
+
+	if err := i.hashes.sync(); err != nil {
+		return "", nil, errors.Trace(err)
+	}
+	similar := i.hashes.nearest(hashes.get(params.Algorithm), params.Algorithm, params.MaxDistance, 1, slug)
+	if len(similar) == 0 {
+		return "", &hashes, nil
+	}
+
+	closest := similar[0]
+	fmt.Printf("[Imagine] Upload is a near duplicate of %s (distance %d)\n", closest.Slug, closest.Distance)
+	if params.Duplicates == DuplicatesReject {
+		return "", nil, errors.Annotatef(ErrNearDuplicate, "%s at distance %d", closest.Slug, closest.Distance)
+	}
+	return closest.Slug, nil, nil
+}
+
+// Similar returns the stored images closest to slug, at most limit of them
+// within maxDistance. Zero values use the defaults of SimilarityParams.
+func (i *Imagine) Similar(slug string, maxDistance, limit int) ([]SimilarImage, error) {
+	if i.hashes == nil {
+		return nil, errors.Trace(ErrSimilarityDisabled)
+	}
+	if maxDistance == 0 {
+		maxDistance = i.params.Similarity.MaxDistance
+	}
+	if limit == 0 {
+		limit = i.params.Similarity.Limit
+	}
+
+	if err := i.hashes.sync(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	hashes, found := i.hashes.get(slug)
+	if !found {
+		// images stored before hashing was enabled are indexed on demand
+		image, found, err := i.params.Storage.Get(slug)
+		if err != nil && errors.Cause(err) != ErrKeyNotFound {
+			return nil, errors.Trace(err)
+		} else if err != nil || !found {
+			return nil, errors.Annotatef(ErrImageNotFound, "slug %s", slug)
+		}
+
+		hashes, err = computeHashes(image)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if err := i.hashes.add(slug, hashes); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	algorithm := i.params.Similarity.Algorithm
+	return i.hashes.nearest(hashes.get(algorithm), algorithm, maxDistance, limit, slug), nil
+}
+
+// SimilarHandlerFunc returns the stored images closest to an image as JSON.
+// The maximum distance and the number of images can be set through the
+// distance and limit query params.
+func (i *Imagine) SimilarHandlerFunc() http.HandlerFunc {
+	return http.HandlerFunc(i.similarHandler)
+}
+
+// similarHandler handles the similar images requests
+func (i *Imagine) similarHandler(w http.ResponseWriter, r *http.Request) {
+	slug, err := parseSlugFromPath(r.URL.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var values [2]int
+	for idx, key := range []string{"distance", "limit"} {
+		if !r.URL.Query().Has(key) {
+			continue
+		}
+		values[idx], err = strconv.Atoi(r.URL.Query().Get(key))
+		if err != nil || values[idx] < 1 || values[idx] > 64 {
+			http.Error(w, key+" must be between 1 and 64", http.StatusBadRequest)
+			return
+		}
+	}
+
+	similar, err := i.Similar(slug, values[0], values[1])
+	if err != nil && errors.Cause(err) == ErrImageNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil && errors.Cause(err) == ErrSimilarityDisabled {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(similar)
+}
@@ -0,0 +1,178 @@
+package imagine_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/risico/imagine"
+)
+
+func TestSimilarity(t *testing.T) {
+	storage := imagine.NewInMemoryStorage(imagine.MemoryStoreParams{})
+	index := imagine.NewInMemoryStorage(imagine.MemoryStoreParams{})
+	newImagine := func(duplicates imagine.DuplicatePolicy) *imagine.Imagine {
+		i, err := imagine.New(imagine.Params{
+			Storage:    storage,
+			Cache:      imagine.NewInMemoryStorage(imagine.MemoryStoreParams{}),
+			Similarity: imagine.SimilarityParams{Store: index, Duplicates: duplicates},
+		})
+		assert.NoError(t, err)
+		return i
+	}
+
+	i := newImagine(imagine.DuplicatesAllow)
+	photo, err := i.Upload(gradientImage(t, 120, 90, plain))
+	assert.NoError(t, err)
+	other, err := i.Upload(gradientImage(t, 120, 90, transposed))
+	assert.NoError(t, err)
+
+	similar, err := i.Similar(photo, 0, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, similar)
+
+	// the same picture at another size is a near duplicate
+	resized := gradientImage(t, 80, 60, plain)
+
+	t.Run("link", func(t *testing.T) {
+		slug, err := newImagine(imagine.DuplicatesLink).Upload(resized)
+		assert.NoError(t, err)
+		assert.Equal(t, photo, slug)
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		_, err := newImagine(imagine.DuplicatesReject).Upload(resized)
+		assert.Equal(t, imagine.ErrNearDuplicate, errors.Cause(err))
+
+		slug, err := newImagine(imagine.DuplicatesReject).Upload(gradientImage(t, 120, 90, mirrored))
+		assert.NoError(t, err)
+		assert.NotEqual(t, other, slug)
+	})
+
+	t.Run("allow and search", func(t *testing.T) {
+		// the index is reloaded from its store
+		i := newImagine(imagine.DuplicatesAllow)
+		slug, err := i.Upload(resized)
+		assert.NoError(t, err)
+		assert.NotEqual(t, photo, slug)
+
+		similar, err := i.Similar(photo, 0, 0)
+		assert.NoError(t, err)
+		if assert.Len(t, similar, 1) {
+			assert.Equal(t, slug, similar[0].Slug)
+			assert.LessOrEqual(t, similar[0].Distance, 10)
+		}
+	})
+
+	t.Run("shared index", func(t *testing.T) {
+		syncing, err := imagine.New(imagine.Params{
+			Storage:    storage,
+			Similarity: imagine.SimilarityParams{Store: index, SyncInterval: time.Millisecond},
+		})
+		assert.NoError(t, err)
+
+		// each image has its own entry, the hashes stored by other
+		// instances are found once synced
+		slug, err := newImagine(imagine.DuplicatesAllow).Upload(gradientImage(t, 90, 120, mirrored))
+		assert.NoError(t, err)
+		_, found, err := index.Get("phash-" + slug)
+		assert.NoError(t, err)
+		assert.True(t, found)
+
+		time.Sleep(2 * time.Millisecond)
+		similar, err := syncing.Similar(other, 64, 100)
+		assert.NoError(t, err)
+		slugs := []string{}
+		for _, image := range similar {
+			slugs = append(slugs, image.Slug)
+		}
+		assert.Contains(t, slugs, slug)
+	})
+
+	t.Run("regenerate", func(t *testing.T) {
+		i, err := imagine.New(imagine.Params{
+			Storage:   storage,
+			Cache:     imagine.NewInMemoryStorage(imagine.MemoryStoreParams{}),
+			Originals: imagine.NewInMemoryStorage(imagine.MemoryStoreParams{}),
+			Similarity: imagine.SimilarityParams{
+				Store:      imagine.NewInMemoryStorage(imagine.MemoryStoreParams{}),
+				Duplicates: imagine.DuplicatesReject,
+			},
+		})
+		assert.NoError(t, err)
+
+		slug, err := i.Upload(gradientImage(t, 300, 200, transposed))
+		assert.NoError(t, err)
+		// the new version is a near duplicate of the previous one
+		assert.NoError(t, i.Regenerate(slug, imagine.UploadPolicy{MaxWidth: 150, MaxHeight: 150}))
+	})
+
+	t.Run("handler", func(t *testing.T) {
+		// images stored without hashes are indexed when searched
+		assert.NoError(t, storage.Set(testSlug+".png", gradientImage(t, 100, 75, plain)))
+
+		request := httptest.NewRequest("GET", "/similar/"+testSlug+".png?limit=1", nil)
+		response := httptest.NewRecorder()
+		i.SimilarHandlerFunc().ServeHTTP(response, request)
+		assert.Equal(t, http.StatusOK, response.Code)
+
+		var similar []imagine.SimilarImage
+		assert.NoError(t, json.NewDecoder(response.Body).Decode(&similar))
+		assert.Len(t, similar, 1)
+
+		request = httptest.NewRequest("GET", "/similar/ffffffffffffffffffffffffffffffff.png", nil)
+		response = httptest.NewRecorder()
+		i.SimilarHandlerFunc().ServeHTTP(response, request)
+		assert.Equal(t, http.StatusNotFound, response.Code)
+	})
+
+	t.Run("invalid params", func(t *testing.T) {
+		_, err := imagine.New(imagine.Params{
+			Storage:    storage,
+			Similarity: imagine.SimilarityParams{Store: index, Algorithm: "md5"},
+		})
+		assert.Error(t, err)
+	})
+}
+
+// the variants of gradientImage
+const (
+	plain = iota
+	transposed
+	mirrored
+)
+
+// gradientImage renders a diagonal gradient with a bright disc, transposed
+// or mirrored following variant
+func gradientImage(t *testing.T, width, height, variant int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			u, v := float64(x)/float64(width), float64(y)/float64(height)
+			switch variant {
+			case transposed:
+				u, v = 1-v, u
+			case mirrored:
+				u = 1 - u
+			}
+			level := uint8(255 * (u + v) / 3)
+			if (u-0.3)*(u-0.3)+(v-0.6)*(v-0.6) < 0.04 {
+				level = 255
+			}
+			img.Set(x, y, color.RGBA{level, level / 2, 255 - level, 255})
+		}
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, img))
+	return buf.Bytes()
+}
@@ -0,0 +1,199 @@
+package imagine
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/h2non/bimg"
+	"github.com/juju/errors"
+)
+
+// PlaceholderParams configures the BlurHash and ThumbHash placeholders
+type PlaceholderParams struct {
+	// XComponents and YComponents are the default number of BlurHash
+	// components on each axis (1-9). They default to 4x3.
+	XComponents, YComponents int
+
+	// OnUpload computes the placeholders eagerly during Upload, caching them
+	// and returning them in the upload response
+	OnUpload bool
+}
+
+// withDefaults sets the default values for the placeholder parameters
+func (p *PlaceholderParams) withDefaults() {
+	if p.XComponents == 0 {
+		p.XComponents = 4
+	}
+
+	if p.YComponents == 0 {
+		p.YComponents = 3
+	}
+}
+
+// Placeholders holds the compact placeholder representations of an image
+// that clients can render before fetching the image itself
+type Placeholders struct {
+	// BlurHash is the BlurHash string of the image
+	BlurHash string `json:"blurhash"`
+
+	// ThumbHash is the base64 encoded ThumbHash of the image
+	ThumbHash string `json:"thumbhash"`
+
+	// Width and Height are the dimensions of the source image, BlurHash
+	// decoders need them to restore the aspect ratio
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// Placeholders returns the BlurHash and ThumbHash of a stored image. Zero
+// component counts fall back to the configured defaults. Results are cached
+// in the Cache store.
+func (i *Imagine) Placeholders(slug string, xComponents, yComponents int) (*Placeholders, error) {
+	if xComponents == 0 {
+		xComponents = i.params.Placeholders.XComponents
+	}
+	if yComponents == 0 {
+		yComponents = i.params.Placeholders.YComponents
+	}
+
+	cacheKey, err := i.placeholdersCacheKey(slug, xComponents, yComponents)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	cached, found, err := i.params.Cache.Get(cacheKey)
+	if err != nil && !errors.Is(err, ErrKeyNotFound) {
+		return nil, errors.Trace(err)
+	} else if err == nil && found {
+		var p Placeholders
+		if err := json.Unmarshal(cached, &p); err == nil {
+			return &p, nil
+		}
+	}
+
+	image, found, err := i.params.Storage.Get(slug)
+	if err != nil && !errors.Is(err, ErrKeyNotFound) {
+		return nil, errors.Trace(err)
+	} else if err != nil || !found {
+		return nil, errors.Annotatef(ErrImageNotFound, "slug %s", slug)
+	}
+
+	return i.computePlaceholders(slug, image, xComponents, yComponents)
+}
+
+// computePlaceholders computes the placeholders of the image data and stores
+// them in the cache under slug
+func (i *Imagine) computePlaceholders(slug string, image []byte, xComponents, yComponents int) (*Placeholders, error) {
+	// ThumbHash is limited to 100x100 images and BlurHash only needs a
+	// handful of pixels per component so a single small sample serves both
+	sample, err := sampleImage(image, 100)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	pixels, width, height := toNRGBA(sample)
+
+	blurHash, err := encodeBlurHash(pixels, width, height, xComponents, yComponents)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	thumbHash, err := encodeThumbHash(pixels, width, height)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	size, err := bimg.NewImage(image).Size()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	p := &Placeholders{
+		BlurHash:  blurHash,
+		ThumbHash: base64.StdEncoding.EncodeToString(thumbHash),
+		Width:     size.Width,
+		Height:    size.Height,
+	}
+
+	cacheKey, err := i.placeholdersCacheKey(slug, xComponents, yComponents)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if err := i.params.Cache.Set(cacheKey, data); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return p, nil
+}
+
+func (i *Imagine) placeholdersCacheKey(slug string, xComponents, yComponents int) (string, error) {
+	hash, err := i.params.Hasher.Hash([]byte(fmt.Sprintf("placeholders:%dx%d", xComponents, yComponents)))
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	return fmt.Sprintf("%s%s", slug, hash), nil
+}
+
+// PlaceholderHandlerFunc returns the BlurHash and ThumbHash of an image as JSON.
+// The BlurHash component counts can be set through the x and y query params.
+func (i *Imagine) PlaceholderHandlerFunc() http.HandlerFunc {
+	return http.HandlerFunc(i.placeholderHandler)
+}
+
+// placeholderHandler handles the placeholder requests
+func (i *Imagine) placeholderHandler(w http.ResponseWriter, r *http.Request) {
+	slug, err := parseSlugFromPath(r.URL.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	xComponents, yComponents, err := parseComponents(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	p, err := i.Placeholders(slug, xComponents, yComponents)
+	if err != nil && errors.Cause(err) == ErrImageNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+// parseComponents reads the BlurHash component counts from the x and y query params
+func parseComponents(values url.Values) (int, int, error) {
+	var components [2]int
+	for idx, key := range []string{"x", "y"} {
+		if !values.Has(key) {
+			continue
+		}
+
+		n, err := strconv.Atoi(values.Get(key))
+		if err != nil {
+			return 0, 0, errors.Trace(err)
+		}
+		if n < 1 || n > 9 {
+			return 0, 0, errors.New(key + " must be between 1 and 9")
+		}
+		components[idx] = n
+	}
+
+	return components[0], components[1], nil
+}
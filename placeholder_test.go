@@ -0,0 +1,112 @@
+package imagine_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/risico/imagine"
+)
+
+const testSlug = "0123456789abcdef0123456789abcdef"
+
+func TestPlaceholders(t *testing.T) {
+	storage := imagine.NewInMemoryStorage(imagine.MemoryStoreParams{})
+	i, err := imagine.New(imagine.Params{
+		Storage: storage,
+		Cache:   imagine.NewInMemoryStorage(imagine.MemoryStoreParams{}),
+	})
+	assert.NoError(t, err)
+
+	err = storage.Set(testSlug+".png", solidImage(t, 40, 30, color.RGBA{255, 0, 0, 255}))
+	assert.NoError(t, err)
+
+	p, err := i.Placeholders(testSlug+".png", 0, 0)
+	assert.NoError(t, err)
+	// 4x3 components encode the size flag "L" followed by the pure red DC value
+	assert.True(t, strings.HasPrefix(p.BlurHash, "L"))
+	assert.Equal(t, "TI:j", p.BlurHash[2:6])
+	assert.Len(t, p.BlurHash, 6+2*11)
+	assert.NotEmpty(t, p.ThumbHash)
+	assert.Equal(t, 40, p.Width)
+	assert.Equal(t, 30, p.Height)
+
+	t.Run("handler", func(t *testing.T) {
+		request := httptest.NewRequest("GET", "/placeholders/"+testSlug+".png?x=3&y=3", nil)
+		response := httptest.NewRecorder()
+		i.PlaceholderHandlerFunc().ServeHTTP(response, request)
+		assert.Equal(t, http.StatusOK, response.Code)
+
+		var body imagine.Placeholders
+		assert.NoError(t, json.NewDecoder(response.Body).Decode(&body))
+		assert.Len(t, body.BlurHash, 6+2*8)
+	})
+
+	t.Run("single component", func(t *testing.T) {
+		p, err := i.Placeholders(testSlug+".png", 1, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, "00TI:j", p.BlurHash)
+	})
+
+	t.Run("invalid components", func(t *testing.T) {
+		request := httptest.NewRequest("GET", "/placeholders/"+testSlug+".png?x=10", nil)
+		response := httptest.NewRecorder()
+		i.PlaceholderHandlerFunc().ServeHTTP(response, request)
+		assert.Equal(t, http.StatusBadRequest, response.Code)
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		request := httptest.NewRequest("GET", "/placeholders/ffffffffffffffffffffffffffffffff.png", nil)
+		response := httptest.NewRecorder()
+		i.PlaceholderHandlerFunc().ServeHTTP(response, request)
+		assert.Equal(t, http.StatusNotFound, response.Code)
+	})
+}
+
+func TestPlaceholdersOnUpload(t *testing.T) {
+	i, err := imagine.New(imagine.Params{
+		Storage: imagine.NewInMemoryStorage(imagine.MemoryStoreParams{}),
+		Cache:   imagine.NewInMemoryStorage(imagine.MemoryStoreParams{}),
+		Placeholders: imagine.PlaceholderParams{
+			OnUpload: true,
+		},
+	})
+	assert.NoError(t, err)
+
+	request := multipartRequest(t, "/", "file", solidImage(t, 40, 30, color.RGBA{0, 0, 255, 255}))
+	request.Header.Set("Accept", "application/json")
+	response := httptest.NewRecorder()
+	i.UploadHandlerFunc().ServeHTTP(response, request)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "application/json", response.Header().Get("Content-Type"))
+
+	var body struct {
+		Slug         string
+		Placeholders imagine.Placeholders
+	}
+	assert.NoError(t, json.NewDecoder(response.Body).Decode(&body))
+	assert.NotEmpty(t, body.Slug)
+	assert.NotEmpty(t, body.Placeholders.BlurHash)
+	assert.NotEmpty(t, body.Placeholders.ThumbHash)
+}
+
+func solidImage(t *testing.T, width, height int, c color.Color) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, c)
+		}
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, img))
+	return buf.Bytes()
+}
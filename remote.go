@@ -0,0 +1,292 @@
+package imagine
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+var (
+	// ErrForbiddenURL is returned for remote URLs which aren't HTTP(S) or
+	// resolve to an address not allowed, such as private networks
+	ErrForbiddenURL = errors.New("remote url not allowed")
+	// ErrRemoteFetch is returned when the remote image can't be fetched
+	ErrRemoteFetch = errors.New("could not fetch remote image")
+	// ErrRemoteContentType is returned when the remote server doesn't answer
+	// with an image
+	ErrRemoteContentType = errors.New("remote content is not an image")
+)
+
+// blockedNetworks are the special purpose networks remote images can't be
+// fetched from, on top of the loopback, private, link local, multicast and
+// unspecified addresses
+var blockedNetworks = parseNetworks(
+	"0.0.0.0/8",       // this network
+	"100.64.0.0/10",   // carrier grade NAT
+	"192.0.0.0/24",    // IETF protocol assignments
+	"192.0.2.0/24",    // documentation
+	"198.18.0.0/15",   // benchmarking
+	"198.51.100.0/24", // documentation
+	"203.0.113.0/24",  // documentation
+	"240.0.0.0/4",     // reserved, broadcast
+	"64:ff9b::/96",    // IPv4/IPv6 translation
+	"2001:db8::/32",   // documentation
+)
+
+// RemoteParams configures the upload of images by URL
+type RemoteParams struct {
+	// Timeout bounds the whole fetch, from connecting to reading the
+	// body. Defaults to 10 seconds.
+	Timeout time.Duration
+
+	// MaxRedirects is the maximum number of redirects followed. Defaults
+	// to 3, set it to -1 to follow none.
+	MaxRedirects int
+
+	// AllowedNetworks are the CIDR networks allowed even though they are
+	// private or special purpose, e.g. "10.1.0.0/16" for an internal CMS
+	AllowedNetworks []string
+
+	// ContentTypes are the accepted content types, a trailing slash accepts
+	// a whole type. Defaults to image/ and application/pdf.
+	ContentTypes []string
+}
+
+// withDefaults sets the default values for the remote upload parameters
+func (p *RemoteParams) withDefaults() {
+	if p.Timeout == 0 {
+		p.Timeout = 10 * time.Second
+	}
+	if p.MaxRedirects == 0 {
+		p.MaxRedirects = 3
+	}
+	if len(p.ContentTypes) == 0 {
+		p.ContentTypes = []string{"image/", "application/pdf"}
+	}
+}
+
+// parseNetworks parses CIDR networks, panicking on invalid ones
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for idx, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[idx] = network
+	}
+	return networks
+}
+
+// remoteFetcher fetches remote images, only connecting to allowed addresses
+type remoteFetcher struct {
+	client  *http.Client
+	params  RemoteParams
+	allowed []*net.IPNet
+}
+
+// newRemoteFetcher builds the HTTP client fetching remote images
+func newRemoteFetcher(params RemoteParams) (*remoteFetcher, error) {
+	f := &remoteFetcher{params: params}
+	for _, cidr := range params.AllowedNetworks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.Annotatef(err, "invalid allowed network %q", cidr)
+		}
+		f.allowed = append(f.allowed, network)
+	}
+
+	// the address is checked once resolved, right before connecting, so a
+	// host can't resolve to another address between a check and the dial
+	dialer := &net.Dialer{
+		Timeout: params.Timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if ip := net.ParseIP(host); ip == nil || !f.allowedIP(ip) {
+				return errors.Annotatef(ErrForbiddenURL, "address %s", host)
+			}
+			return nil
+		},
+	}
+
+	f.client = &http.Client{
+		Timeout: params.Timeout,
+		Transport: &http.Transport{
+			// a proxy would connect on our behalf, bypassing the checks
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   params.Timeout,
+			ResponseHeaderTimeout: params.Timeout,
+		},
+		CheckRedirect: func(r *http.Request, via []*http.Request) error {
+			if len(via) > params.MaxRedirects {
+				return errors.Annotatef(ErrRemoteFetch, "more than %d redirects", params.MaxRedirects)
+			}
+			return errors.Trace(checkRemoteURL(r.URL))
+		},
+	}
+
+	return f, nil
+}
+
+// allowedIP tells whether images can be fetched from ip
+func (f *remoteFetcher) allowedIP(ip net.IP) bool {
+	for _, network := range f.allowed {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	for _, network := range blockedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkRemoteURL only lets HTTP(S) URLs through
+func checkRemoteURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.Annotatef(ErrForbiddenURL, "scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return errors.Annotate(ErrForbiddenURL, "missing host")
+	}
+	if u.User != nil {
+		return errors.Annotate(ErrForbiddenURL, "credentials in url")
+	}
+	return nil
+}
+
+// fetch downloads a remote image of at most maxSize bytes
+func (f *remoteFetcher) fetch(ctx context.Context, rawURL string, maxSize int) ([]byte, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.Annotate(ErrForbiddenURL, err.Error())
+	}
+	if err := checkRemoteURL(u); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, errors.Annotate(ErrForbiddenURL, err.Error())
+	}
+	request.Header.Set("Accept", "image/*")
+
+	response, err := f.client.Do(request)
+	if err != nil {
+		// the errors of the dialer and the redirect checks are wrapped by
+		// the client
+		for _, cause := range []error{ErrForbiddenURL, ErrRemoteFetch} {
+			if errors.Is(err, cause) {
+				return nil, errors.Annotate(cause, err.Error())
+			}
+		}
+		return nil, errors.Annotate(ErrRemoteFetch, err.Error())
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.Annotatef(ErrRemoteFetch, "remote server answered %s", response.Status)
+	}
+
+	contentType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if !f.acceptedContentType(contentType) {
+		return nil, errors.Annotatef(ErrRemoteContentType, "content type %q", contentType)
+	}
+
+	if response.ContentLength > int64(maxSize) {
+		return nil, errors.Annotatef(ErrFileTooLarge, "%d bytes over a limit of %d", response.ContentLength, maxSize)
+	}
+
+	// read one byte more than allowed to tell full files from truncated ones
+	data, err := ioutil.ReadAll(io.LimitReader(response.Body, int64(maxSize)+1))
+	if err != nil {
+		return nil, errors.Annotate(ErrRemoteFetch, err.Error())
+	}
+	if len(data) > maxSize {
+		return nil, errors.Annotatef(ErrFileTooLarge, "over a limit of %d bytes", maxSize)
+	}
+
+	return data, nil
+}
+
+// acceptedContentType checks a content type against the accepted ones
+func (f *remoteFetcher) acceptedContentType(contentType string) bool {
+	for _, accepted := range f.params.ContentTypes {
+		if contentType == accepted || (strings.HasSuffix(accepted, "/") && strings.HasPrefix(contentType, accepted)) {
+			return true
+		}
+	}
+	return false
+}
+
+// UploadFromURL fetches a remote image and uploads it, returning its slug
+func (i *Imagine) UploadFromURL(ctx context.Context, rawURL string) (string, error) {
+	result, err := i.uploadFromURL(ctx, rawURL)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	return result.Slug, nil
+}
+
+func (i *Imagine) uploadFromURL(ctx context.Context, rawURL string) (*uploadResult, error) {
+	fmt.Printf("[Imagine] Fetching remote image %s\n", rawURL)
+	data, err := i.remote.fetch(ctx, rawURL, i.params.MaxImageSize)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	result, err := i.upload(data, i.params.UploadPolicy)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return result, nil
+}
+
+// UploadFromURLHandlerFunc handles the upload of remote images, the URL is
+// given by the url form value
+func (i *Imagine) UploadFromURLHandlerFunc() http.HandlerFunc {
+	return http.HandlerFunc(i.uploadFromURLHandler)
+}
+
+func (i *Imagine) uploadFromURLHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rawURL := r.FormValue("url")
+	if rawURL == "" {
+		http.Error(w, "missing url", http.StatusBadRequest)
+		return
+	}
+
+	result, err := i.uploadFromURL(r.Context(), rawURL)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	i.writeUploadResult(w, r, result)
+}
@@ -0,0 +1,112 @@
+package imagine_test
+
+import (
+	"context"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/risico/imagine"
+)
+
+func TestUploadFromURL(t *testing.T) {
+	image := solidImage(t, 20, 10, color.White)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/image.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(image)
+	})
+	mux.HandleFunc("/page.html", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html></html>"))
+	})
+	mux.HandleFunc("/large.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(make([]byte, 2048))
+	})
+	mux.HandleFunc("/slow.png", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, r.URL.Query().Get("to"), http.StatusFound)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	storage := imagine.NewInMemoryStorage(imagine.MemoryStoreParams{})
+	newImagine := func(allowed ...string) *imagine.Imagine {
+		i, err := imagine.New(imagine.Params{
+			Storage:      storage,
+			Cache:        imagine.NewInMemoryStorage(imagine.MemoryStoreParams{}),
+			MaxImageSize: 1024,
+			Remote: imagine.RemoteParams{
+				Timeout:         200 * time.Millisecond,
+				MaxRedirects:    1,
+				AllowedNetworks: allowed,
+			},
+		})
+		assert.NoError(t, err)
+		return i
+	}
+	i := newImagine("127.0.0.1/32")
+	ctx := context.Background()
+
+	t.Run("fetch", func(t *testing.T) {
+		slug, err := i.UploadFromURL(ctx, server.URL+"/image.png")
+		assert.NoError(t, err)
+		stored, _, err := storage.Get(slug)
+		assert.NoError(t, err)
+		assertSize(t, 20, 10, stored)
+	})
+
+	t.Run("loopback is blocked unless allowed", func(t *testing.T) {
+		_, err := newImagine().UploadFromURL(ctx, server.URL+"/image.png")
+		assert.Equal(t, imagine.ErrForbiddenURL, errors.Cause(err))
+	})
+
+	t.Run("redirects to blocked addresses", func(t *testing.T) {
+		_, err := i.UploadFromURL(ctx, server.URL+"/redirect?to=http://10.0.0.1/image.png")
+		assert.Equal(t, imagine.ErrForbiddenURL, errors.Cause(err))
+
+		_, err = i.UploadFromURL(ctx, server.URL+"/redirect?to=/redirect%3Fto%3D/image.png")
+		assert.Equal(t, imagine.ErrRemoteFetch, errors.Cause(err))
+	})
+
+	t.Run("checks", func(t *testing.T) {
+		for path, expected := range map[string]error{
+			"/page.html": imagine.ErrRemoteContentType,
+			"/large.png": imagine.ErrFileTooLarge,
+			"/slow.png":  imagine.ErrRemoteFetch,
+			"/missing":   imagine.ErrRemoteFetch,
+		} {
+			_, err := i.UploadFromURL(ctx, server.URL+path)
+			assert.Equal(t, expected, errors.Cause(err), path)
+		}
+
+		_, err := i.UploadFromURL(ctx, "file:///etc/passwd")
+		assert.Equal(t, imagine.ErrForbiddenURL, errors.Cause(err))
+	})
+
+	t.Run("handler", func(t *testing.T) {
+		for target, expected := range map[string]int{
+			server.URL + "/image.png":   http.StatusOK,
+			server.URL + "/page.html":   http.StatusUnsupportedMediaType,
+			"http://169.254.169.254/":   http.StatusBadRequest,
+			"gopher://example.com/data": http.StatusBadRequest,
+		} {
+			form := url.Values{"url": {target}}
+			request := httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			response := httptest.NewRecorder()
+			i.UploadFromURLHandlerFunc().ServeHTTP(response, request)
+			assert.Equal(t, expected, response.Code, target)
+		}
+	})
+}
@@ -0,0 +1,104 @@
+package imagine
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/h2non/bimg"
+	"github.com/juju/errors"
+)
+
+// detectContentType returns the MIME type of data, which can be only its
+// first bytes
+func detectContentType(head []byte) string {
+	switch t := detectImageType(head); t {
+	case bimg.UNKNOWN:
+		return http.DetectContentType(head)
+	case bimg.SVG:
+		return "image/svg+xml"
+	default:
+		return mimeType(bimg.ImageTypeName(t))
+	}
+}
+
+// statEntry describes an entry of store, reading it when the store doesn't
+// implement Stater
+func statEntry(store Store, key string) (*EntryInfo, bool, error) {
+	if stater, ok := store.(Stater); ok {
+		info, found, err := stater.Stat(key)
+		return info, found, errors.Trace(err)
+	}
+
+	data, found, err := store.Get(key)
+	if err != nil && errors.Cause(err) != ErrKeyNotFound {
+		return nil, false, errors.Trace(err)
+	} else if err != nil || !found {
+		return nil, false, nil
+	}
+	return &EntryInfo{Size: int64(len(data)), ContentType: detectContentType(data)}, true, nil
+}
+
+// serveWithoutData answers conditional and HEAD requests from the stats of
+// the image and of its cached variant, without reading or processing them.
+// It returns false when the image has to be served normally, the validators
+// are set on the response either way.
+func (i *Imagine) serveWithoutData(w http.ResponseWriter, r *http.Request, slug string, params *ImageParams) bool {
+	source, found, err := statEntry(i.params.Storage, slug)
+	if err != nil || !found {
+		return false
+	}
+	cacheKey, err := i.cacheKey(slug, params)
+	if err != nil {
+		return false
+	}
+
+	// slugs are content hashes, a variant only changes when its image is
+	// regenerated, which updates its modification time
+	etag := `"` + cacheKey + `"`
+	if !source.Modified.IsZero() {
+		etag = `"` + cacheKey + "-" + strconv.FormatInt(source.Modified.UnixNano(), 36) + `"`
+	}
+	w.Header().Set("ETag", etag)
+	if !source.Modified.IsZero() {
+		w.Header().Set("Last-Modified", source.Modified.UTC().Format(http.TimeFormat))
+	}
+
+	if notModified(r, etag, source.Modified) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	if r.Method != http.MethodHead {
+		return false
+	}
+
+	variant, found, err := statEntry(i.params.Cache, cacheKey)
+	if err != nil || !found {
+		return false
+	}
+	w.Header().Set("Content-Type", variant.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(variant.Size, 10))
+	w.WriteHeader(http.StatusOK)
+	return true
+}
+
+// notModified evaluates the conditional headers of a request, If-None-Match
+// taking precedence over If-Modified-Since
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		for _, candidate := range strings.Split(match, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == etag || candidate == "*" {
+				return true
+			}
+		}
+		return false
+	}
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || modified.IsZero() {
+		return false
+	}
+	return !modified.Truncate(time.Second).After(since)
+}
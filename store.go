@@ -3,6 +3,8 @@ package imagine
 import (
 	"errors"
 	"io"
+	"strings"
+	"time"
 )
 
 var ErrKeyNotFound = errors.New("key not found")
@@ -19,3 +21,82 @@ type Store interface {
 
 	io.Closer
 }
+
+// ListEntry describes an entry of a store
+type ListEntry struct {
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+
+	// ModTime is when the entry was last written, zero for stores which
+	// don't track it
+	ModTime time.Time `json:"mod_time"`
+}
+
+// ListOptions selects the entries of a store to list
+type ListOptions struct {
+	// Prefix only lists the keys starting with it
+	Prefix string
+
+	// Cursor lists the keys after it, it's the NextCursor of the previous
+	// page
+	Cursor string
+
+	// Limit is the maximum number of entries listed. Defaults to 100.
+	Limit int
+}
+
+// withDefaults sets the default values for the list options
+func (o *ListOptions) withDefaults() {
+	if o.Limit <= 0 {
+		o.Limit = 100
+	}
+}
+
+// ListPage is a page of entries of a store, sorted by key
+type ListPage struct {
+	Entries []ListEntry `json:"entries"`
+
+	// NextCursor is the cursor of the next page, empty on the last page
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// Lister is implemented by the stores which can enumerate their entries
+type Lister interface {
+	List(options ListOptions) (*ListPage, error)
+}
+
+// newListPage pages entries sorted by key which are after the cursor and
+// match the prefix, there can be one more than the limit to tell whether a
+// next page exists
+func newListPage(entries []ListEntry, limit int) *ListPage {
+	page := &ListPage{Entries: entries}
+	if len(entries) > limit {
+		page.Entries = entries[:limit]
+		page.NextCursor = entries[limit-1].Key
+	}
+	return page
+}
+
+// listedKey tells whether key belongs to the page selected by options
+func listedKey(key string, options ListOptions) bool {
+	return strings.HasPrefix(key, options.Prefix) && key > options.Cursor
+}
+
+// EntryInfo describes an entry of a store without its data
+type EntryInfo struct {
+	Size        int64
+	ContentType string
+
+	// Created and Modified are zero for stores which don't track them
+	Created  time.Time
+	Modified time.Time
+}
+
+// Stater is implemented by the stores which can describe an entry without
+// reading its data. Missing keys aren't an error, ok is false.
+type Stater interface {
+	Stat(key string) (info *EntryInfo, ok bool, err error)
+}
+
+// sniffLen is the number of bytes needed to detect a content type
+const sniffLen = 512
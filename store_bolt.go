@@ -1,6 +1,8 @@
 package imagine
 
 import (
+	"strings"
+
 	"github.com/juju/errors"
 	bolt "go.etcd.io/bbolt"
 )
@@ -16,8 +18,10 @@ type BoltStoreParams struct {
 	Path string
 }
 
-// ensure boltStore implements Store
+// ensure boltStore implements Store and Lister
 var _ Store = new(boltStore)
+var _ Lister = new(boltStore)
+var _ Stater = new(boltStore)
 
 // NewBoltStore creates a new BoltStore
 func NewBoltStore(params BoltStoreParams) (Store, error) {
@@ -82,6 +86,69 @@ func (b *boltStore) Delete(filename string) error {
 	return nil
 }
 
+// Stat describes an entry, BoltDB doesn't track creation and modification
+// times so they are left zero
+func (b *boltStore) Stat(filename string) (*EntryInfo, bool, error) {
+	var info *EntryInfo
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("images"))
+		if bucket == nil {
+			return nil
+		}
+
+		// the value is only valid during the transaction, and not copied
+		if v := bucket.Get([]byte(filename)); v != nil {
+			head := v
+			if len(head) > sniffLen {
+				head = head[:sniffLen]
+			}
+			info = &EntryInfo{Size: int64(len(v)), ContentType: detectContentType(head)}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, errors.Trace(err)
+	}
+
+	return info, info != nil, nil
+}
+
+// List lists the entries of the store, BoltDB doesn't track modification
+// times so they are left zero
+func (b *boltStore) List(options ListOptions) (*ListPage, error) {
+	options.withDefaults()
+
+	entries := []ListEntry{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("images"))
+		if bucket == nil {
+			return nil
+		}
+
+		start := options.Prefix
+		if options.Cursor > start {
+			start = options.Cursor
+		}
+
+		c := bucket.Cursor()
+		for k, v := c.Seek([]byte(start)); k != nil && len(entries) <= options.Limit; k, v = c.Next() {
+			key := string(k)
+			if !strings.HasPrefix(key, options.Prefix) {
+				break
+			}
+			if key > options.Cursor {
+				entries = append(entries, ListEntry{Key: key, Size: int64(len(v))})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return newListPage(entries, options.Limit), nil
+}
+
 func (b *boltStore) Close() error {
 	b.db.Close()
 	return nil
@@ -2,6 +2,7 @@ package imagine
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"time"
 
@@ -25,8 +26,10 @@ type localStore struct {
     closeCh chan struct{}
 }
 
-// ensure localStore implements Store
+// ensure localStore implements Store and Lister
 var _ Store = new(localStore)
+var _ Lister = new(localStore)
+var _ Stater = new(localStore)
 
 func (l *localStore) Set(filename string, data []byte) error {
 	path := fmt.Sprintf("%s/%s", l.params.Path, filename)
@@ -77,6 +80,72 @@ func (l *localStore) Delete(filename string) error {
 	return errors.Annotate(os.Remove(path), "storage.Delete: could not delete file")
 }
 
+// Stat describes a file from its metadata and first bytes, filesystems don't
+// portably expose creation times so Created is left zero
+func (l *localStore) Stat(filename string) (*EntryInfo, bool, error) {
+	path := fmt.Sprintf("%s/%s", l.params.Path, filename)
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, errors.Annotate(err, "storage.Stat: could not open file")
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, false, errors.Annotate(err, "storage.Stat: could not read file info")
+	}
+
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, false, errors.Annotate(err, "storage.Stat: could not read file")
+	}
+
+	return &EntryInfo{
+		Size:        info.Size(),
+		ContentType: detectContentType(head[:n]),
+		Modified:    info.ModTime(),
+	}, true, nil
+}
+
+// List reads the whole directory for every page, directory entries aren't
+// returned in name order so a page can't be read without the others. Listing
+// costs O(N) in the number of stored files.
+func (l *localStore) List(options ListOptions) (*ListPage, error) {
+	options.withDefaults()
+
+	// the files are sorted by name
+	files, err := os.ReadDir(l.params.Path)
+	if err != nil {
+		return nil, errors.Annotate(err, "storage.List: could not read directory")
+	}
+
+	entries := []ListEntry{}
+	for _, file := range files {
+		if file.IsDir() || !listedKey(file.Name(), options) {
+			continue
+		}
+
+		info, err := file.Info()
+		if os.IsNotExist(err) {
+			// deleted since the directory was read
+			continue
+		} else if err != nil {
+			return nil, errors.Annotate(err, "storage.List: could not read file info")
+		}
+
+		entries = append(entries, ListEntry{Key: file.Name(), Size: info.Size(), ModTime: info.ModTime()})
+		if len(entries) > options.Limit {
+			break
+		}
+	}
+
+	return newListPage(entries, options.Limit), nil
+}
+
 func (l *localStore) Close() error {
     close(l.closeCh)
 	return nil
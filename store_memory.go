@@ -1,61 +1,398 @@
 package imagine
 
 import (
+	"container/heap"
+	"container/list"
+	"sort"
 	"sync"
 	"time"
+
+	"github.com/juju/errors"
+)
+
+// EvictionReason tells why an entry left a memory store
+type EvictionReason string
+
+const (
+	// EvictedCapacity entries were the least recently used when the store
+	// went over MaxBytes
+	EvictedCapacity EvictionReason = "capacity"
+	// EvictedExpired entries outlived their TTL
+	EvictedExpired EvictionReason = "expired"
 )
 
 type MemoryStoreParams struct {
+	// TTL is the expiration of the entries set without one, they don't
+	// expire when zero
 	TTL time.Duration
+
+	// MaxBytes is the budget of the keys and data of the entries, the least
+	// recently used ones are evicted to stay under it. Unbounded when zero.
+	MaxBytes int64
+
+	// OnEvict is called after entries are evicted or expire, but not when
+	// they are deleted or overwritten
+	OnEvict func(key string, data []byte, reason EvictionReason)
+
+	// CleanupInterval is how often expired entries are reclaimed when they
+	// aren't read. Defaults to a minute.
+	CleanupInterval time.Duration
+}
+
+// withDefaults sets the default values for the memory store parameters
+func (p *MemoryStoreParams) withDefaults() {
+	if p.CleanupInterval == 0 {
+		p.CleanupInterval = time.Minute
+	}
+}
+
+// MemoryStoreStats are the counters of a memory store
+type MemoryStoreStats struct {
+	Hits        int64
+	Misses      int64
+	Evictions   int64
+	Expirations int64
+
+	Entries int
+	Bytes   int64
+}
+
+// memoryEntry is an entry of the memory store, in its LRU list
+type memoryEntry struct {
+	key  string
+	data []byte
+
+	// created and modified are when the key was first and last set
+	created  time.Time
+	modified time.Time
+
+	// expires is zero for entries which don't expire, the others are in
+	// the expiry heap at index
+	expires time.Time
+	index   int
+}
+
+func (e *memoryEntry) size() int64 {
+	return int64(len(e.key) + len(e.data))
+}
+
+func (e *memoryEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+// expiryHeap orders the entries which expire, the next to expire first
+type expiryHeap []*memoryEntry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(a, b int) bool { return h[a].expires.Before(h[b].expires) }
+
+func (h expiryHeap) Swap(a, b int) {
+	h[a], h[b] = h[b], h[a]
+	h[a].index = a
+	h[b].index = b
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	entry := x.(*memoryEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
 }
 
-// InMemoryStorage is a storage implementation that stores data in memory
-// This should only be used for testing
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	entry.index = -1
+	return entry
+}
+
+// evicted is an entry removed by the store, reported to OnEvict once the
+// lock is released
+type evicted struct {
+	entry  *memoryEntry
+	reason EvictionReason
+}
+
+// MemoryStore is a storage implementation that stores data in memory, as
+// an LRU cache when given a byte budget
 type MemoryStore struct {
 	params *MemoryStoreParams
 	mu     *sync.RWMutex
-	cache  map[string][]byte
+
+	// entries index the elements of lru, most recently used first
+	entries  map[string]*list.Element
+	lru      *list.List
+	expiries expiryHeap
+	stats    MemoryStoreStats
+
+	// cleaning is set while the janitor runs, it stops once closed
+	cleaning bool
+	closed   chan struct{}
 }
 
 var _ Store = new(MemoryStore)
+var _ Lister = new(MemoryStore)
+var _ Stater = new(MemoryStore)
 
 func NewInMemoryStorage(params MemoryStoreParams) Store {
+	params.withDefaults()
 	return &MemoryStore{
-		params: &params,
-		cache:  make(map[string][]byte),
-		mu:     new(sync.RWMutex),
+		params:  &params,
+		mu:      new(sync.RWMutex),
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		closed:  make(chan struct{}),
 	}
 }
 
 func (m *MemoryStore) Set(key string, data []byte) error {
+	return errors.Trace(m.SetWithTTL(key, data, m.params.TTL))
+}
+
+// SetWithTTL sets an entry expiring after ttl, or never when zero. Entries
+// larger than MaxBytes aren't stored.
+func (m *MemoryStore) SetWithTTL(key string, data []byte, ttl time.Duration) error {
+	if ttl < 0 {
+		return errors.Errorf("invalid ttl %s", ttl)
+	}
+
 	m.mu.Lock()
-	defer m.mu.Unlock()
+	now := time.Now()
+	entry := &memoryEntry{key: key, data: data, created: now, modified: now, index: -1}
+	if ttl > 0 {
+		entry.expires = now.Add(ttl)
+	}
+
+	if element, ok := m.entries[key]; ok {
+		previous := element.Value.(*memoryEntry)
+		if !previous.expired(now) {
+			entry.created = previous.created
+		}
+		m.remove(element)
+	}
+
+	if m.params.MaxBytes > 0 && entry.size() > m.params.MaxBytes {
+		m.mu.Unlock()
+		return nil
+	}
+	m.entries[key] = m.lru.PushFront(entry)
+	m.stats.Bytes += entry.size()
+	m.stats.Entries++
+	if !entry.expires.IsZero() {
+		heap.Push(&m.expiries, entry)
+		m.clean()
+	}
 
-	m.cache[key] = data
+	removed := m.evict(now)
+	m.mu.Unlock()
+
+	m.notify(removed)
 	return nil
 }
 
-
 func (m *MemoryStore) Get(key string) ([]byte, bool, error) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-
-	if data, ok := m.cache[key]; ok {
-		return data, true, nil
+	m.mu.Lock()
+	entry, removed := m.lookup(key, time.Now())
+	if entry != nil {
+		m.stats.Hits++
+		m.lru.MoveToFront(m.entries[key])
+	} else {
+		m.stats.Misses++
 	}
+	m.mu.Unlock()
 
-	return nil, false, nil
+	m.notify(removed)
+	if entry == nil {
+		return nil, false, nil
+	}
+	return entry.data, true, nil
 }
 
 func (m *MemoryStore) Delete(key string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	delete(m.cache, key)
+	if element, ok := m.entries[key]; ok {
+		m.remove(element)
+	}
 
 	return nil
 }
 
+// Stat describes an entry without counting as a use of it
+func (m *MemoryStore) Stat(key string) (*EntryInfo, bool, error) {
+	m.mu.Lock()
+	entry, removed := m.lookup(key, time.Now())
+	m.mu.Unlock()
+
+	m.notify(removed)
+	if entry == nil {
+		return nil, false, nil
+	}
+
+	return &EntryInfo{
+		Size:        int64(len(entry.data)),
+		ContentType: detectContentType(entry.data),
+		Created:     entry.created,
+		Modified:    entry.modified,
+	}, true, nil
+}
+
+func (m *MemoryStore) List(options ListOptions) (*ListPage, error) {
+	options.withDefaults()
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	now := time.Now()
+	entries := []ListEntry{}
+	for key, element := range m.entries {
+		entry := element.Value.(*memoryEntry)
+		if listedKey(key, options) && !entry.expired(now) {
+			entries = append(entries, ListEntry{Key: key, Size: int64(len(entry.data)), ModTime: entry.modified})
+		}
+	}
+	sort.Slice(entries, func(a, b int) bool { return entries[a].Key < entries[b].Key })
+	if len(entries) > options.Limit+1 {
+		entries = entries[:options.Limit+1]
+	}
+
+	return newListPage(entries, options.Limit), nil
+}
+
+// Stats returns the counters of the store
+func (m *MemoryStore) Stats() MemoryStoreStats {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.stats
+}
+
+// Close stops reclaiming the expired entries in the background, the store
+// can still be used
 func (m *MemoryStore) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	select {
+	case <-m.closed:
+	default:
+		close(m.closed)
+	}
 	return nil
 }
+
+// clean starts the janitor unless it runs already. The lock must be held.
+func (m *MemoryStore) clean() {
+	select {
+	case <-m.closed:
+		return
+	default:
+	}
+
+	if !m.cleaning {
+		m.cleaning = true
+		go m.janitor()
+	}
+}
+
+// janitor reclaims the expired entries every CleanupInterval, until no entry
+// expires anymore or the store is closed
+func (m *MemoryStore) janitor() {
+	ticker := time.NewTicker(m.params.CleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.closed:
+			m.mu.Lock()
+			m.cleaning = false
+			m.mu.Unlock()
+			return
+		case <-ticker.C:
+		}
+
+		m.mu.Lock()
+		removed := m.expire(time.Now())
+		done := len(m.expiries) == 0
+		if done {
+			m.cleaning = false
+		}
+		m.mu.Unlock()
+
+		m.notify(removed)
+		if done {
+			return
+		}
+	}
+}
+
+// lookup returns the entry of key, removing it when expired. The lock must
+// be held.
+func (m *MemoryStore) lookup(key string, now time.Time) (*memoryEntry, []evicted) {
+	element, ok := m.entries[key]
+	if !ok {
+		return nil, nil
+	}
+
+	entry := element.Value.(*memoryEntry)
+	if entry.expired(now) {
+		m.remove(element)
+		m.stats.Expirations++
+		return nil, []evicted{{entry, EvictedExpired}}
+	}
+	return entry, nil
+}
+
+// expire removes the expired entries, next to expire first. The lock must
+// be held.
+func (m *MemoryStore) expire(now time.Time) []evicted {
+	var removed []evicted
+	for len(m.expiries) > 0 && m.expiries[0].expired(now) {
+		entry := m.expiries[0]
+		m.remove(m.entries[entry.key])
+		m.stats.Expirations++
+		removed = append(removed, evicted{entry, EvictedExpired})
+	}
+	return removed
+}
+
+// evict removes the least recently used entries until the store is under
+// its budget, expired entries first. The lock must be held.
+func (m *MemoryStore) evict(now time.Time) []evicted {
+	if m.params.MaxBytes <= 0 || m.stats.Bytes <= m.params.MaxBytes {
+		return nil
+	}
+
+	removed := m.expire(now)
+	for m.stats.Bytes > m.params.MaxBytes {
+		element := m.lru.Back()
+		m.remove(element)
+		m.stats.Evictions++
+		removed = append(removed, evicted{element.Value.(*memoryEntry), EvictedCapacity})
+	}
+	return removed
+}
+
+// remove removes an element of the LRU list and of the expiry heap. The lock
+// must be held.
+func (m *MemoryStore) remove(element *list.Element) {
+	entry := m.lru.Remove(element).(*memoryEntry)
+	if entry.index >= 0 {
+		heap.Remove(&m.expiries, entry.index)
+	}
+	delete(m.entries, entry.key)
+	m.stats.Bytes -= entry.size()
+	m.stats.Entries--
+}
+
+// notify reports removed entries to OnEvict, without the lock held so the
+// callback can use the store
+func (m *MemoryStore) notify(removed []evicted) {
+	if m.params.OnEvict == nil {
+		return
+	}
+	for _, r := range removed {
+		m.params.OnEvict(r.entry.key, r.entry.data, r.reason)
+	}
+}
@@ -0,0 +1,129 @@
+package imagine_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/risico/imagine"
+)
+
+func TestMemoryStore(t *testing.T) {
+	type eviction struct {
+		key    string
+		reason imagine.EvictionReason
+	}
+
+	t.Run("lru", func(t *testing.T) {
+		var evictions []eviction
+		store := imagine.NewInMemoryStorage(imagine.MemoryStoreParams{
+			// keys and data count, this fits three entries
+			MaxBytes: 33,
+			OnEvict: func(key string, data []byte, reason imagine.EvictionReason) {
+				evictions = append(evictions, eviction{key, reason})
+			},
+		}).(*imagine.MemoryStore)
+
+		for _, key := range []string{"a", "b", "c"} {
+			assert.NoError(t, store.Set(key, make([]byte, 10)))
+		}
+		// a is used, b is now the least recently used
+		_, found, _ := store.Get("a")
+		assert.True(t, found)
+
+		assert.NoError(t, store.Set("d", make([]byte, 10)))
+		_, found, _ = store.Get("b")
+		assert.False(t, found)
+		assert.Equal(t, []eviction{{"b", imagine.EvictedCapacity}}, evictions)
+
+		// entries over the budget aren't stored
+		assert.NoError(t, store.Set("e", make([]byte, 40)))
+		_, found, _ = store.Get("e")
+		assert.False(t, found)
+
+		// deleting isn't evicting
+		assert.NoError(t, store.Delete("a"))
+		assert.Len(t, evictions, 1)
+
+		assert.Equal(t, imagine.MemoryStoreStats{
+			Hits:      1,
+			Misses:    2,
+			Evictions: 1,
+			Entries:   2,
+			Bytes:     22,
+		}, store.Stats())
+	})
+
+	t.Run("ttl", func(t *testing.T) {
+		var evictions []eviction
+		store := imagine.NewInMemoryStorage(imagine.MemoryStoreParams{
+			TTL: 50 * time.Millisecond,
+			OnEvict: func(key string, data []byte, reason imagine.EvictionReason) {
+				evictions = append(evictions, eviction{key, reason})
+			},
+		}).(*imagine.MemoryStore)
+
+		assert.NoError(t, store.Set("short", []byte("value")))
+		assert.NoError(t, store.SetWithTTL("long", []byte("value"), time.Hour))
+		assert.NoError(t, store.SetWithTTL("forever", []byte("value"), 0))
+		assert.Error(t, store.SetWithTTL("negative", []byte("value"), -time.Second))
+
+		time.Sleep(60 * time.Millisecond)
+		page, err := store.List(imagine.ListOptions{})
+		assert.NoError(t, err)
+		assert.Len(t, page.Entries, 2)
+
+		_, found, _ := store.Stat("short")
+		assert.False(t, found)
+		_, found, _ = store.Get("long")
+		assert.True(t, found)
+		_, found, _ = store.Get("forever")
+		assert.True(t, found)
+
+		assert.Equal(t, []eviction{{"short", imagine.EvictedExpired}}, evictions)
+		stats := store.Stats()
+		assert.Equal(t, int64(1), stats.Expirations)
+		assert.Equal(t, 2, stats.Entries)
+	})
+
+	t.Run("janitor", func(t *testing.T) {
+		var evictions []eviction
+		var mu sync.Mutex
+		store := imagine.NewInMemoryStorage(imagine.MemoryStoreParams{
+			TTL:             10 * time.Millisecond,
+			CleanupInterval: 5 * time.Millisecond,
+			OnEvict: func(key string, data []byte, reason imagine.EvictionReason) {
+				mu.Lock()
+				defer mu.Unlock()
+				evictions = append(evictions, eviction{key, reason})
+			},
+		}).(*imagine.MemoryStore)
+		defer store.Close()
+
+		assert.NoError(t, store.Set("short", []byte("value")))
+		assert.NoError(t, store.SetWithTTL("long", []byte("value"), time.Hour))
+
+		// expired entries are reclaimed without being read
+		assert.Eventually(t, func() bool { return store.Stats().Entries == 1 }, time.Second, 5*time.Millisecond)
+		mu.Lock()
+		assert.Equal(t, []eviction{{"short", imagine.EvictedExpired}}, evictions)
+		mu.Unlock()
+		assert.Equal(t, int64(1), store.Stats().Expirations)
+	})
+
+	t.Run("expired entries go first", func(t *testing.T) {
+		store := imagine.NewInMemoryStorage(imagine.MemoryStoreParams{MaxBytes: 22}).(*imagine.MemoryStore)
+
+		assert.NoError(t, store.Set("a", make([]byte, 10)))
+		assert.NoError(t, store.SetWithTTL("b", make([]byte, 10), time.Millisecond))
+		time.Sleep(5 * time.Millisecond)
+
+		assert.NoError(t, store.Set("c", make([]byte, 10)))
+		_, found, _ := store.Get("a")
+		assert.True(t, found)
+		assert.Equal(t, int64(0), store.Stats().Evictions)
+		assert.Equal(t, int64(1), store.Stats().Expirations)
+	})
+}
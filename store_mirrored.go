@@ -0,0 +1,479 @@
+package imagine
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// ErrNoQuorum is returned when a write doesn't reach the quorum of replicas
+var ErrNoQuorum = errors.New("write quorum not reached")
+
+// errQueueFull is the failure of a replica too slow to keep up with writes
+var errQueueFull = errors.New("replica writes queue is full")
+
+// MirroredStoreParams are the parameters for creating a new mirrored store
+type MirroredStoreParams struct {
+	// Replicas are the mirrored stores, read in this order
+	Replicas []Store
+
+	// WriteQuorum is the number of replicas a write waits for, the others
+	// are written in the background. Defaults to a majority.
+	WriteQuorum int
+
+	// FailureThreshold is the number of consecutive failures marking a
+	// replica unhealthy. Defaults to 3.
+	FailureThreshold int
+
+	// RetryInterval is how long an unhealthy replica is skipped before
+	// being tried again. Defaults to 30 seconds.
+	RetryInterval time.Duration
+
+	// QueueSize is the number of writes queued for each replica, a replica
+	// with a full queue is marked unhealthy. Defaults to 256.
+	QueueSize int
+}
+
+// withDefaults sets the default values for the mirrored store parameters
+func (p *MirroredStoreParams) withDefaults() {
+	if p.WriteQuorum == 0 {
+		p.WriteQuorum = len(p.Replicas)/2 + 1
+	}
+	if p.FailureThreshold == 0 {
+		p.FailureThreshold = 3
+	}
+	if p.RetryInterval == 0 {
+		p.RetryInterval = 30 * time.Second
+	}
+	if p.QueueSize == 0 {
+		p.QueueSize = 256
+	}
+}
+
+// ReplicaHealth describes the health of a replica
+type ReplicaHealth struct {
+	Healthy bool
+
+	// Failures is the number of consecutive failures
+	Failures int
+
+	LastError   error
+	LastFailure time.Time
+}
+
+// RepairResult sums up a repair of the replicas
+type RepairResult struct {
+	// Keys is the number of distinct keys found in the replicas
+	Keys int
+
+	// Copied is the number of entries copied to replicas missing them
+	Copied int
+
+	// Deleted is the number of deletes replayed on replicas which missed
+	// them
+	Deleted int
+}
+
+// mirrorWrite is a write queued for a replica
+type mirrorWrite struct {
+	key    string
+	data   []byte
+	delete bool
+	done   chan<- error
+}
+
+// replica is a mirrored store along with its health and its writes queue,
+// which keeps the writes to a replica in order
+type replica struct {
+	store  Store
+	writes chan mirrorWrite
+
+	mu     sync.Mutex
+	health ReplicaHealth
+
+	// tombstones are the keys deleted while the replica missed it, Repair
+	// replays them
+	tombstones map[string]bool
+}
+
+// MirroredStore is a Store writing to several replicas and reading from the
+// first healthy one holding a key
+type MirroredStore struct {
+	params   *MirroredStoreParams
+	replicas []*replica
+
+	// mu guards closed, the queues are only written to while it's held
+	mu      sync.RWMutex
+	closed  bool
+	writers sync.WaitGroup
+}
+
+// ensure MirroredStore implements Store, Lister and Stater
+var _ Store = new(MirroredStore)
+var _ Lister = new(MirroredStore)
+var _ Stater = new(MirroredStore)
+
+// NewMirroredStorage creates a store mirroring the entries to the given
+// replicas
+func NewMirroredStorage(params MirroredStoreParams) (*MirroredStore, error) {
+	params.withDefaults()
+	if len(params.Replicas) == 0 {
+		return nil, errors.New("mirrored store needs at least one replica")
+	}
+	if params.WriteQuorum < 1 || params.WriteQuorum > len(params.Replicas) {
+		return nil, errors.Errorf("write quorum must be between 1 and %d", len(params.Replicas))
+	}
+
+	m := &MirroredStore{params: &params}
+	for idx, store := range params.Replicas {
+		if store == nil {
+			return nil, errors.Errorf("replica %d is nil", idx)
+		}
+		r := &replica{
+			store:      store,
+			writes:     make(chan mirrorWrite, params.QueueSize),
+			health:     ReplicaHealth{Healthy: true},
+			tombstones: map[string]bool{},
+		}
+		m.replicas = append(m.replicas, r)
+
+		m.writers.Add(1)
+		go m.write(idx, r)
+	}
+
+	return m, nil
+}
+
+// write applies the writes queued for a replica
+func (m *MirroredStore) write(idx int, r *replica) {
+	defer m.writers.Done()
+
+	for write := range r.writes {
+		var err error
+		if write.delete {
+			err = deleteKey(r.store, write.key)
+		} else {
+			err = r.store.Set(write.key, write.data)
+		}
+		m.record(idx, err)
+		m.track(idx, write, err == nil)
+		write.done <- err
+	}
+}
+
+// track keeps the tombstones of a replica up to date after a write, applied
+// or missed
+func (m *MirroredStore) track(idx int, write mirrorWrite, applied bool) {
+	r := m.replicas[idx]
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch {
+	case write.delete && !applied:
+		r.tombstones[write.key] = true
+	case applied:
+		delete(r.tombstones, write.key)
+	}
+}
+
+// overflow marks a replica whose writes queue is full unhealthy, Repair
+// brings it back in sync
+func (m *MirroredStore) overflow(idx int, write mirrorWrite) {
+	r := m.replicas[idx]
+	r.mu.Lock()
+	if r.health.Healthy {
+		fmt.Printf("[MirroredStore] Replica %d is unhealthy: %v\n", idx, errQueueFull)
+	}
+	r.health.Healthy = false
+	r.health.Failures++
+	r.health.LastError = errQueueFull
+	r.health.LastFailure = time.Now()
+	r.mu.Unlock()
+
+	m.track(idx, write, false)
+}
+
+// record updates the health of a replica after an operation
+func (m *MirroredStore) record(idx int, err error) {
+	r := m.replicas[idx]
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err == nil {
+		if !r.health.Healthy {
+			fmt.Printf("[MirroredStore] Replica %d recovered\n", idx)
+		}
+		r.health.Healthy = true
+		r.health.Failures = 0
+		return
+	}
+
+	r.health.Failures++
+	r.health.LastError = err
+	r.health.LastFailure = time.Now()
+	if r.health.Healthy && r.health.Failures >= m.params.FailureThreshold {
+		fmt.Printf("[MirroredStore] Replica %d is unhealthy after %d failures: %v\n", idx, r.health.Failures, err)
+		r.health.Healthy = false
+	}
+}
+
+// available tells whether a replica is healthy or due for a retry
+func (m *MirroredStore) available(idx int) bool {
+	r := m.replicas[idx]
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.health.Healthy || time.Since(r.health.LastFailure) >= m.params.RetryInterval
+}
+
+// Health returns the health of the replicas, in their order
+func (m *MirroredStore) Health() []ReplicaHealth {
+	health := make([]ReplicaHealth, len(m.replicas))
+	for idx, r := range m.replicas {
+		r.mu.Lock()
+		health[idx] = r.health
+		r.mu.Unlock()
+	}
+	return health
+}
+
+// mirror queues a write to the available replicas and waits for the quorum
+// of them to succeed, the others complete in the background. Unavailable
+// replicas and those with a full queue are skipped, Repair brings them back
+// in sync.
+func (m *MirroredStore) mirror(write mirrorWrite) error {
+	done := make(chan error, len(m.replicas))
+	write.done = done
+
+	m.mu.RLock()
+	if m.closed {
+		m.mu.RUnlock()
+		return errors.Trace(ErrStoreClosed)
+	}
+	queued := 0
+	for idx, r := range m.replicas {
+		if !m.available(idx) {
+			m.track(idx, write, false)
+			continue
+		}
+
+		select {
+		case r.writes <- write:
+			queued++
+		default:
+			m.overflow(idx, write)
+		}
+	}
+	m.mu.RUnlock()
+
+	quorum := m.params.WriteQuorum
+	succeeded := 0
+	var failure error
+	for received := 0; succeeded < quorum && queued-received+succeeded >= quorum; received++ {
+		if err := <-done; err != nil {
+			failure = err
+		} else {
+			succeeded++
+		}
+	}
+
+	if succeeded < quorum {
+		return errors.Annotatef(ErrNoQuorum, "%s written to %d of %d replicas (last error: %v)", write.key, succeeded, quorum, failure)
+	}
+	return nil
+}
+
+func (m *MirroredStore) Set(key string, data []byte) error {
+	return errors.Trace(m.mirror(mirrorWrite{key: key, data: data}))
+}
+
+func (m *MirroredStore) Delete(key string) error {
+	return errors.Trace(m.mirror(mirrorWrite{key: key, delete: true}))
+}
+
+// Get reads key from the first available replica holding it, falling back
+// to the next ones on misses and failures. A failure is only returned when
+// no replica has the key.
+func (m *MirroredStore) Get(key string) ([]byte, bool, error) {
+	var failure error
+	for idx, r := range m.replicas {
+		if !m.available(idx) {
+			continue
+		}
+
+		data, found, err := r.store.Get(key)
+		if err != nil && errors.Cause(err) != ErrKeyNotFound {
+			m.record(idx, err)
+			if failure == nil {
+				failure = errors.Annotatef(err, "replica %d", idx)
+			}
+			continue
+		}
+		m.record(idx, nil)
+		if err == nil && found {
+			return data, true, nil
+		}
+	}
+	return nil, false, errors.Trace(failure)
+}
+
+// Stat describes key from the first available replica holding it
+func (m *MirroredStore) Stat(key string) (*EntryInfo, bool, error) {
+	var failure error
+	for idx, r := range m.replicas {
+		if !m.available(idx) {
+			continue
+		}
+
+		info, found, err := statEntry(r.store, key)
+		m.record(idx, err)
+		if err != nil {
+			if failure == nil {
+				failure = errors.Annotatef(err, "replica %d", idx)
+			}
+			continue
+		}
+		if found {
+			return info, true, nil
+		}
+	}
+	return nil, false, errors.Trace(failure)
+}
+
+// List lists the first available replica
+func (m *MirroredStore) List(options ListOptions) (*ListPage, error) {
+	for idx, r := range m.replicas {
+		if !m.available(idx) {
+			continue
+		}
+
+		lister, ok := r.store.(Lister)
+		if !ok {
+			return nil, errors.Trace(ErrListingUnsupported)
+		}
+		page, err := lister.List(options)
+		return page, errors.Trace(err)
+	}
+	return nil, errors.New("no replica available")
+}
+
+// Repair replays the deletes replicas missed, then copies the entries
+// missing from replicas, after they were down or skipped. The replicas must
+// implement Lister. The missed deletes are only known to the instance which
+// skipped them, until it restarts.
+func (m *MirroredStore) Repair() (*RepairResult, error) {
+	result := &RepairResult{}
+	for idx := range m.replicas {
+		deleted, err := m.replay(idx)
+		result.Deleted += deleted
+		if err != nil {
+			return result, errors.Trace(err)
+		}
+	}
+
+	keys := map[string]int{}
+	for idx, r := range m.replicas {
+		lister, ok := r.store.(Lister)
+		if !ok {
+			return nil, errors.Annotatef(ErrListingUnsupported, "replica %d", idx)
+		}
+
+		options := ListOptions{Limit: maxListLimit}
+		for {
+			page, err := lister.List(options)
+			if err != nil {
+				return nil, errors.Annotatef(err, "could not list replica %d", idx)
+			}
+			for _, entry := range page.Entries {
+				if _, ok := keys[entry.Key]; !ok {
+					keys[entry.Key] = idx
+				}
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			options.Cursor = page.NextCursor
+		}
+	}
+
+	result.Keys = len(keys)
+	for key, source := range keys {
+		var data []byte
+		for idx, r := range m.replicas {
+			_, found, err := statEntry(r.store, key)
+			if err != nil {
+				return result, errors.Annotatef(err, "could not check %s in replica %d", key, idx)
+			} else if found {
+				continue
+			}
+
+			if data == nil {
+				data, found, err = m.replicas[source].store.Get(key)
+				if err != nil && errors.Cause(err) != ErrKeyNotFound {
+					return result, errors.Annotatef(err, "could not read %s from replica %d", key, source)
+				} else if err != nil || !found {
+					// deleted since it was listed
+					break
+				}
+			}
+
+			if err := r.store.Set(key, data); err != nil {
+				m.record(idx, err)
+				return result, errors.Annotatef(err, "could not copy %s to replica %d", key, idx)
+			}
+			m.record(idx, nil)
+			result.Copied++
+		}
+	}
+
+	fmt.Printf("[MirroredStore] Repaired %d of %d keys, replayed %d deletes\n", result.Copied, result.Keys, result.Deleted)
+	return result, nil
+}
+
+// replay deletes the tombstones of a replica from it
+func (m *MirroredStore) replay(idx int) (int, error) {
+	r := m.replicas[idx]
+	r.mu.Lock()
+	keys := make([]string, 0, len(r.tombstones))
+	for key := range r.tombstones {
+		keys = append(keys, key)
+	}
+	r.mu.Unlock()
+
+	for deleted, key := range keys {
+		if err := deleteKey(r.store, key); err != nil {
+			m.record(idx, err)
+			return deleted, errors.Annotatef(err, "could not delete %s from replica %d", key, idx)
+		}
+		m.record(idx, nil)
+
+		r.mu.Lock()
+		delete(r.tombstones, key)
+		r.mu.Unlock()
+	}
+	return len(keys), nil
+}
+
+// Close waits for the queued writes and closes the replicas
+func (m *MirroredStore) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	for _, r := range m.replicas {
+		close(r.writes)
+	}
+	m.mu.Unlock()
+	m.writers.Wait()
+
+	var failure error
+	for idx, r := range m.replicas {
+		if err := r.store.Close(); err != nil && failure == nil {
+			failure = errors.Annotatef(err, "could not close replica %d", idx)
+		}
+	}
+	return failure
+}
@@ -0,0 +1,176 @@
+package imagine_test
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/risico/imagine"
+)
+
+// blockingStore wraps a store, its writes wait until released
+type blockingStore struct {
+	imagine.Store
+	release chan struct{}
+}
+
+func (b *blockingStore) Set(key string, data []byte) error {
+	<-b.release
+	return b.Store.Set(key, data)
+}
+
+func TestMirroredStore(t *testing.T) {
+	newReplicas := func() []*flakyStore {
+		var replicas []*flakyStore
+		for idx := 0; idx < 3; idx++ {
+			replicas = append(replicas, &flakyStore{Store: imagine.NewInMemoryStorage(imagine.MemoryStoreParams{})})
+		}
+		return replicas
+	}
+	newStore := func(t *testing.T, replicas []*flakyStore, params imagine.MirroredStoreParams) *imagine.MirroredStore {
+		for _, replica := range replicas {
+			params.Replicas = append(params.Replicas, replica)
+		}
+		store, err := imagine.NewMirroredStorage(params)
+		assert.NoError(t, err)
+		return store
+	}
+	has := func(replica *flakyStore, key string) bool {
+		_, found, _ := replica.Store.Get(key)
+		return found
+	}
+
+	t.Run("quorum", func(t *testing.T) {
+		replicas := newReplicas()
+		store := newStore(t, replicas, imagine.MirroredStoreParams{})
+
+		replicas[0].setDown(true)
+		assert.NoError(t, store.Set("key", []byte("value")))
+
+		replicas[1].setDown(true)
+		err := store.Set("other", []byte("value"))
+		assert.Equal(t, imagine.ErrNoQuorum, errors.Cause(err))
+
+		assert.NoError(t, store.Close())
+		assert.False(t, has(replicas[0], "key"))
+		assert.True(t, has(replicas[1], "key"))
+		assert.True(t, has(replicas[2], "key"))
+	})
+
+	t.Run("background writes", func(t *testing.T) {
+		replicas := newReplicas()
+		store := newStore(t, replicas, imagine.MirroredStoreParams{WriteQuorum: 1})
+
+		assert.NoError(t, store.Set("key", []byte("value")))
+		assert.NoError(t, store.Delete("deleted"))
+
+		// closing waits for the writes to the other replicas
+		assert.NoError(t, store.Close())
+		for _, replica := range replicas {
+			assert.True(t, has(replica, "key"))
+		}
+		assert.Equal(t, imagine.ErrStoreClosed, errors.Cause(store.Set("key", nil)))
+	})
+
+	t.Run("failover and health", func(t *testing.T) {
+		replicas := newReplicas()
+		store := newStore(t, replicas, imagine.MirroredStoreParams{WriteQuorum: 3, FailureThreshold: 2, RetryInterval: 50 * time.Millisecond})
+		defer store.Close()
+
+		assert.NoError(t, store.Set("key", []byte("value")))
+		replicas[0].setDown(true)
+		for attempt := 0; attempt < 2; attempt++ {
+			data, found, err := store.Get("key")
+			assert.NoError(t, err)
+			assert.True(t, found)
+			assert.Equal(t, []byte("value"), data)
+		}
+
+		health := store.Health()
+		assert.False(t, health[0].Healthy)
+		assert.Equal(t, 2, health[0].Failures)
+		assert.ErrorIs(t, health[0].LastError, errUnavailable)
+		assert.True(t, health[1].Healthy)
+
+		// the unhealthy replica is skipped, then retried
+		replicas[0].setDown(false)
+		_, _, err := store.Get("key")
+		assert.NoError(t, err)
+		assert.False(t, store.Health()[0].Healthy)
+
+		time.Sleep(60 * time.Millisecond)
+		_, _, err = store.Get("key")
+		assert.NoError(t, err)
+		assert.True(t, store.Health()[0].Healthy)
+	})
+
+	t.Run("repair", func(t *testing.T) {
+		replicas := newReplicas()
+		store := newStore(t, replicas, imagine.MirroredStoreParams{FailureThreshold: 1, RetryInterval: time.Hour})
+		defer store.Close()
+
+		// the replicas diverged during an outage of the last one
+		for idx, replica := range replicas {
+			assert.NoError(t, replica.Store.Set("a", []byte("a")))
+			if idx < 2 {
+				assert.NoError(t, replica.Store.Set("b", []byte("b")))
+			}
+		}
+		assert.NoError(t, replicas[0].Store.Set("c", []byte("c")))
+		replicas[2].setDown(true)
+		// a miss can't be told apart from the failure
+		_, _, err := store.Get("missing")
+		assert.ErrorIs(t, err, errUnavailable)
+		assert.False(t, store.Health()[2].Healthy)
+
+		// the delete missed by the last replica isn't undone
+		assert.NoError(t, store.Delete("a"))
+		replicas[2].setDown(false)
+
+		result, err := store.Repair()
+		assert.NoError(t, err)
+		assert.Equal(t, &imagine.RepairResult{Keys: 2, Copied: 3, Deleted: 1}, result)
+		for _, replica := range replicas {
+			assert.False(t, has(replica, "a"))
+			for _, key := range []string{"b", "c"} {
+				assert.True(t, has(replica, key), key)
+			}
+		}
+		assert.True(t, store.Health()[2].Healthy)
+	})
+
+	t.Run("slow replica", func(t *testing.T) {
+		replicas := newReplicas()
+		slow := &blockingStore{Store: replicas[0], release: make(chan struct{})}
+		store, err := imagine.NewMirroredStorage(imagine.MirroredStoreParams{
+			Replicas:      []imagine.Store{slow, replicas[1], replicas[2]},
+			QueueSize:     2,
+			RetryInterval: time.Hour,
+		})
+		assert.NoError(t, err)
+
+		// writes don't wait for the replica once its queue is full
+		for idx := 0; idx < 10; idx++ {
+			assert.NoError(t, store.Set(strconv.Itoa(idx), []byte("value")))
+		}
+		assert.NoError(t, store.Delete("0"))
+		health := store.Health()[0]
+		assert.False(t, health.Healthy)
+		assert.EqualError(t, health.LastError, "replica writes queue is full")
+
+		close(slow.release)
+		assert.NoError(t, store.Close())
+	})
+
+	t.Run("params", func(t *testing.T) {
+		_, err := imagine.NewMirroredStorage(imagine.MirroredStoreParams{})
+		assert.Error(t, err)
+
+		replica := imagine.NewInMemoryStorage(imagine.MemoryStoreParams{})
+		_, err = imagine.NewMirroredStorage(imagine.MirroredStoreParams{Replicas: []imagine.Store{replica}, WriteQuorum: 2})
+		assert.Error(t, err)
+	})
+}
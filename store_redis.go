@@ -1,23 +1,441 @@
 package imagine
 
-type redisStore struct {}
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// ErrStoreClosed is returned when using a store after closing it
+var ErrStoreClosed = errors.New("store closed")
+
+// RedisStoreParams are the parameters for creating a new RedisStore
+type RedisStoreParams struct {
+	// Addr is the host:port of the Redis server. Defaults to
+	// localhost:6379.
+	Addr string
+
+	// Password authenticates the connections when set
+	Password string
+
+	// DB is the database selected by the connections
+	DB int
+
+	// TTL is the expiration of the keys, they don't expire when zero
+	TTL time.Duration
+
+	// Prefix is prepended to the keys, to share a database
+	Prefix string
+
+	// PoolSize is the maximum number of idle connections kept open.
+	// Defaults to 10.
+	PoolSize int
+
+	// DialTimeout bounds the connection to the server, ReadTimeout and
+	// WriteTimeout each command. They default to 5, 3 and 3 seconds.
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+}
+
+// withDefaults sets the default values for the Redis parameters
+func (p *RedisStoreParams) withDefaults() {
+	if p.Addr == "" {
+		p.Addr = "localhost:6379"
+	}
+	if p.PoolSize == 0 {
+		p.PoolSize = 10
+	}
+	if p.DialTimeout == 0 {
+		p.DialTimeout = 5 * time.Second
+	}
+	if p.ReadTimeout == 0 {
+		p.ReadTimeout = 3 * time.Second
+	}
+	if p.WriteTimeout == 0 {
+		p.WriteTimeout = 3 * time.Second
+	}
+}
+
+// redisError is an error reply of the server
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redisConn is a connection to the server speaking RESP
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+// redisStore is a Store implementation that uses Redis
+type redisStore struct {
+	params *RedisStoreParams
+
+	mu     sync.Mutex
+	idle   []*redisConn
+	closed bool
+}
+
+// ensure redisStore implements Store, Lister and Stater
+var _ Store = new(redisStore)
+var _ Lister = new(redisStore)
+var _ Stater = new(redisStore)
+
+// redisGlob escapes the glob characters of SCAN MATCH patterns
+var redisGlob = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// NewRedisStorage creates a new Redis store, checking the server can be
+// reached
+func NewRedisStorage(params RedisStoreParams) (Store, error) {
+	params.withDefaults()
+	if params.DB < 0 {
+		return nil, errors.Errorf("invalid redis database %d", params.DB)
+	}
+
+	r := &redisStore{params: &params}
+	if _, err := r.do("PING"); err != nil {
+		return nil, errors.Annotatef(err, "could not reach redis at %s", params.Addr)
+	}
+
+	return r, nil
+}
+
+// NewRedisStore creates a Redis store for localhost:6379 with the default
+// parameters, connecting on first use.
+//
+// Deprecated: use NewRedisStorage, which takes parameters and reports
+// unreachable servers.
+func NewRedisStore() Store {
+	params := RedisStoreParams{}
+	params.withDefaults()
+	return &redisStore{params: &params}
+}
 
 func (r *redisStore) Set(key string, data []byte) error {
-    return nil
+	args := []interface{}{"SET", r.params.Prefix + key, data}
+	if r.params.TTL > 0 {
+		// sub-millisecond expirations would round to 0, which redis refuses
+		ttl := r.params.TTL.Milliseconds()
+		if ttl < 1 {
+			ttl = 1
+		}
+		args = append(args, "PX", ttl)
+	}
+
+	_, err := r.do(args...)
+	return errors.Trace(err)
 }
 
 func (r *redisStore) Get(key string) (data []byte, ok bool, err error) {
-    return nil, false, nil
+	reply, err := r.do("GET", r.params.Prefix+key)
+	if err != nil {
+		return nil, false, errors.Trace(err)
+	}
+	if reply == nil {
+		return nil, false, nil
+	}
+
+	data, ok = reply.([]byte)
+	if !ok {
+		return nil, false, errors.Errorf("unexpected redis reply %T to GET", reply)
+	}
+	return data, true, nil
 }
 
 func (r *redisStore) Delete(key string) error {
-    return nil
+	_, err := r.do("DEL", r.params.Prefix+key)
+	return errors.Trace(err)
+}
+
+// Stat describes an entry from its length and first bytes, Redis doesn't
+// track when keys were set
+func (r *redisStore) Stat(key string) (*EntryInfo, bool, error) {
+	size, err := r.do("STRLEN", r.params.Prefix+key)
+	if err != nil {
+		return nil, false, errors.Trace(err)
+	}
+	length, ok := size.(int64)
+	if !ok {
+		return nil, false, errors.Errorf("unexpected redis reply %T to STRLEN", size)
+	}
+
+	// missing keys have a zero length, like empty values
+	if length == 0 {
+		exists, err := r.do("EXISTS", r.params.Prefix+key)
+		if err != nil {
+			return nil, false, errors.Trace(err)
+		}
+		if exists != int64(1) {
+			return nil, false, nil
+		}
+	}
+
+	head, err := r.do("GETRANGE", r.params.Prefix+key, 0, sniffLen-1)
+	if err != nil {
+		return nil, false, errors.Trace(err)
+	}
+	data, _ := head.([]byte)
+	return &EntryInfo{Size: length, ContentType: detectContentType(data)}, true, nil
+}
+
+// List scans every key of the prefix for each page, SCAN doesn't return
+// keys in order. Listing costs O(N) in the number of keys matching the
+// prefix, and the modification times aren't known.
+func (r *redisStore) List(options ListOptions) (*ListPage, error) {
+	options.withDefaults()
+
+	pattern := redisGlob.Replace(r.params.Prefix+options.Prefix) + "*"
+	var keys []string
+	cursor := "0"
+	for {
+		reply, err := r.do("SCAN", cursor, "MATCH", pattern, "COUNT", 1000)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		values, ok := reply.([]interface{})
+		if !ok || len(values) != 2 {
+			return nil, errors.Errorf("unexpected redis reply %T to SCAN", reply)
+		}
+		next, _ := values[0].([]byte)
+		batch, _ := values[1].([]interface{})
+
+		for _, value := range batch {
+			raw, _ := value.([]byte)
+			key := strings.TrimPrefix(string(raw), r.params.Prefix)
+			if listedKey(key, options) {
+				keys = append(keys, key)
+			}
+		}
+
+		if cursor = string(next); cursor == "0" || cursor == "" {
+			break
+		}
+	}
+
+	// SCAN can return a key more than once
+	sort.Strings(keys)
+	entries := []ListEntry{}
+	for idx, key := range keys {
+		if idx > 0 && key == keys[idx-1] {
+			continue
+		}
+		size, err := r.do("STRLEN", r.params.Prefix+key)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		length, _ := size.(int64)
+
+		entries = append(entries, ListEntry{Key: key, Size: length})
+		if len(entries) > options.Limit {
+			break
+		}
+	}
+
+	return newListPage(entries, options.Limit), nil
 }
 
 func (r *redisStore) Close() error {
-    return nil
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.closed = true
+	for _, c := range r.idle {
+		c.conn.Close()
+	}
+	r.idle = nil
+	return nil
 }
 
-func NewRedisStore() Store {
-    return &redisStore{}
+// do runs a command, retrying once on a fresh connection when a pooled one
+// turns out to be broken, e.g. closed by the server while idle
+func (r *redisStore) do(args ...interface{}) (interface{}, error) {
+	for attempt := 0; ; attempt++ {
+		c, pooled, err := r.get()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		reply, err := c.do(r.params, args...)
+		if _, isReply := err.(redisError); err != nil && !isReply {
+			// the connection is in an unknown state after a network error
+			c.conn.Close()
+			if pooled && attempt == 0 {
+				continue
+			}
+			return nil, errors.Annotatef(err, "redis %v", args[0])
+		}
+
+		r.put(c)
+		return reply, errors.Trace(err)
+	}
+}
+
+// get returns an idle connection or dials a new one
+func (r *redisStore) get() (*redisConn, bool, error) {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil, false, errors.Trace(ErrStoreClosed)
+	}
+	if n := len(r.idle); n > 0 {
+		c := r.idle[n-1]
+		r.idle = r.idle[:n-1]
+		r.mu.Unlock()
+		return c, true, nil
+	}
+	r.mu.Unlock()
+
+	c, err := r.dial()
+	return c, false, errors.Trace(err)
+}
+
+// put returns a connection to the pool, closing it when the pool is full
+func (r *redisStore) put(c *redisConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed || len(r.idle) >= r.params.PoolSize {
+		c.conn.Close()
+		return
+	}
+	r.idle = append(r.idle, c)
+}
+
+// dial opens a connection, authenticated and on the right database
+func (r *redisStore) dial() (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", r.params.Addr, r.params.DialTimeout)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	c := &redisConn{conn: conn, reader: bufio.NewReader(conn), writer: bufio.NewWriter(conn)}
+
+	if r.params.Password != "" {
+		if _, err := c.do(r.params, "AUTH", r.params.Password); err != nil {
+			conn.Close()
+			return nil, errors.Annotate(err, "redis authentication failed")
+		}
+	}
+	if r.params.DB != 0 {
+		if _, err := c.do(r.params, "SELECT", r.params.DB); err != nil {
+			conn.Close()
+			return nil, errors.Annotatef(err, "could not select redis database %d", r.params.DB)
+		}
+	}
+
+	return c, nil
+}
+
+// do sends a command and reads its reply
+func (c *redisConn) do(params *RedisStoreParams, args ...interface{}) (interface{}, error) {
+	c.conn.SetWriteDeadline(time.Now().Add(params.WriteTimeout))
+	if err := c.writeCommand(args...); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	c.conn.SetReadDeadline(time.Now().Add(params.ReadTimeout))
+	return c.readReply()
+}
+
+// writeCommand writes a command as an array of bulk strings
+func (c *redisConn) writeCommand(args ...interface{}) error {
+	fmt.Fprintf(c.writer, "*%d\r\n", len(args))
+	for _, arg := range args {
+		var data []byte
+		switch v := arg.(type) {
+		case []byte:
+			data = v
+		case string:
+			data = []byte(v)
+		case int:
+			data = strconv.AppendInt(nil, int64(v), 10)
+		case int64:
+			data = strconv.AppendInt(nil, v, 10)
+		default:
+			return errors.Errorf("unsupported redis argument %T", arg)
+		}
+
+		fmt.Fprintf(c.writer, "$%d\r\n", len(data))
+		c.writer.Write(data)
+		c.writer.WriteString("\r\n")
+	}
+	return errors.Trace(c.writer.Flush())
+}
+
+// readReply reads a reply: simple strings, integers and bulk strings are
+// returned as string, int64 and []byte, nil bulk strings as nil and arrays
+// as []interface{}. Error replies are returned as redisError.
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(line) == 0 {
+		return nil, errors.New("empty redis reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		return n, errors.Trace(err)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return nil, errors.Trace(err)
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+
+		values := make([]interface{}, n)
+		for idx := range values {
+			values[idx], err = c.readReply()
+			if _, isReply := err.(redisError); err != nil && !isReply {
+				return nil, errors.Trace(err)
+			}
+		}
+		return values, nil
+	}
+	return nil, errors.Errorf("invalid redis reply %q", line)
+}
+
+// readLine reads a line without its CRLF
+func (c *redisConn) readLine() (string, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", errors.Errorf("invalid redis reply line %q", line)
+	}
+	return line[:len(line)-2], nil
 }
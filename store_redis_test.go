@@ -0,0 +1,358 @@
+package imagine_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/risico/imagine"
+)
+
+// fakeRedis is an in-process server speaking enough RESP for the store
+type fakeRedis struct {
+	listener net.Listener
+	password string
+
+	mu      sync.Mutex
+	data    map[string][]byte
+	expires map[string]time.Time
+	dials   int
+	conns   []net.Conn
+	// stall makes the server read commands without ever replying
+	stall bool
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	f := &fakeRedis{
+		listener: listener,
+		password: password,
+		data:     map[string][]byte{},
+		expires:  map[string]time.Time{},
+	}
+	go f.serve()
+	t.Cleanup(func() { listener.Close(); f.dropConnections() })
+	return f
+}
+
+func (f *fakeRedis) addr() string {
+	return f.listener.Addr().String()
+}
+
+func (f *fakeRedis) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.dials++
+		f.conns = append(f.conns, conn)
+		f.mu.Unlock()
+		go f.handle(conn)
+	}
+}
+
+// dropConnections closes every connection, like a server restart
+func (f *fakeRedis) dropConnections() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, conn := range f.conns {
+		conn.Close()
+	}
+	f.conns = nil
+}
+
+func (f *fakeRedis) keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := []string{}
+	for key := range f.data {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (f *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authenticated := f.password == ""
+
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+
+		f.mu.Lock()
+		if f.stall {
+			f.mu.Unlock()
+			continue
+		}
+
+		var reply string
+		switch command := strings.ToUpper(args[0]); {
+		case command == "AUTH":
+			if args[1] == f.password {
+				authenticated = true
+				reply = "+OK\r\n"
+			} else {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authenticated:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case command == "PING":
+			reply = "+PONG\r\n"
+		case command == "SELECT":
+			reply = "+OK\r\n"
+		case command == "SET":
+			f.data[args[1]] = []byte(args[2])
+			delete(f.expires, args[1])
+			if len(args) == 5 && strings.ToUpper(args[3]) == "PX" {
+				ms, _ := strconv.Atoi(args[4])
+				f.expires[args[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+			}
+			reply = "+OK\r\n"
+		case command == "GET":
+			if expiry, ok := f.expires[args[1]]; ok && time.Now().After(expiry) {
+				delete(f.data, args[1])
+				delete(f.expires, args[1])
+			}
+			if value, ok := f.data[args[1]]; ok {
+				reply = fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+			} else {
+				reply = "$-1\r\n"
+			}
+		case command == "STRLEN":
+			reply = fmt.Sprintf(":%d\r\n", len(f.data[args[1]]))
+		case command == "EXISTS":
+			if _, ok := f.data[args[1]]; ok {
+				reply = ":1\r\n"
+			} else {
+				reply = ":0\r\n"
+			}
+		case command == "GETRANGE":
+			value := f.data[args[1]]
+			end, _ := strconv.Atoi(args[3])
+			if end >= len(value) {
+				end = len(value) - 1
+			}
+			reply = fmt.Sprintf("$%d\r\n%s\r\n", end+1, value[:end+1])
+		case command == "SCAN":
+			// two keys per call, the cursor is the index of the next one
+			var keys []string
+			for key := range f.data {
+				if matched, _ := path.Match(args[3], key); matched {
+					keys = append(keys, key)
+				}
+			}
+			sort.Strings(keys)
+			start, _ := strconv.Atoi(args[1])
+			end, next := start+2, strconv.Itoa(start+2)
+			if end >= len(keys) {
+				end, next = len(keys), "0"
+			}
+			reply = fmt.Sprintf("*2\r\n$%d\r\n%s\r\n*%d\r\n", len(next), next, end-start)
+			for _, key := range keys[start:end] {
+				reply += fmt.Sprintf("$%d\r\n%s\r\n", len(key), key)
+			}
+		case command == "DEL":
+			_, ok := f.data[args[1]]
+			delete(f.data, args[1])
+			delete(f.expires, args[1])
+			if ok {
+				reply = ":1\r\n"
+			} else {
+				reply = ":0\r\n"
+			}
+		default:
+			reply = "-ERR unknown command\r\n"
+		}
+		f.mu.Unlock()
+
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// readCommand reads a command sent as an array of bulk strings
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, n)
+	for idx := range args {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		args[idx] = string(data[:size])
+	}
+	return args, nil
+}
+
+func TestRedisStore(t *testing.T) {
+	t.Run("set get delete", func(t *testing.T) {
+		server := newFakeRedis(t, "secret")
+		store, err := imagine.NewRedisStorage(imagine.RedisStoreParams{
+			Addr:     server.addr(),
+			Password: "secret",
+			DB:       2,
+			Prefix:   "imagine:",
+		})
+		assert.NoError(t, err)
+		defer store.Close()
+
+		// binary data survives the protocol
+		data := []byte("line\r\nbreak\x00")
+		assert.NoError(t, store.Set("key", data))
+		assert.Equal(t, []string{"imagine:key"}, server.keys())
+
+		got, found, err := store.Get("key")
+		assert.NoError(t, err)
+		assert.True(t, found)
+		assert.Equal(t, data, got)
+
+		assert.NoError(t, store.Delete("key"))
+		_, found, err = store.Get("key")
+		assert.NoError(t, err)
+		assert.False(t, found)
+		assert.NoError(t, store.Delete("key"))
+
+		// sequential commands share a single pooled connection
+		assert.Equal(t, 1, server.dials)
+	})
+
+	t.Run("stat and list", func(t *testing.T) {
+		server := newFakeRedis(t, "")
+		store, err := imagine.NewRedisStorage(imagine.RedisStoreParams{Addr: server.addr(), Prefix: "imagine:"})
+		assert.NoError(t, err)
+		defer store.Close()
+
+		for _, key := range []string{"a1", "a2", "a3", "b1"} {
+			assert.NoError(t, store.Set(key, []byte("value "+key)))
+		}
+		assert.NoError(t, store.Set("empty", []byte{}))
+		// keys outside the prefix belong to someone else
+		server.mu.Lock()
+		server.data["other:a4"] = []byte("value")
+		server.mu.Unlock()
+
+		info, found, err := store.(imagine.Stater).Stat("a1")
+		assert.NoError(t, err)
+		assert.True(t, found)
+		assert.Equal(t, int64(8), info.Size)
+		assert.Equal(t, "text/plain; charset=utf-8", info.ContentType)
+		info, found, err = store.(imagine.Stater).Stat("empty")
+		assert.NoError(t, err)
+		assert.True(t, found)
+		assert.Equal(t, int64(0), info.Size)
+		_, found, err = store.(imagine.Stater).Stat("missing")
+		assert.NoError(t, err)
+		assert.False(t, found)
+
+		lister := store.(imagine.Lister)
+		page, err := lister.List(imagine.ListOptions{Prefix: "a", Limit: 2})
+		assert.NoError(t, err)
+		assert.Equal(t, []imagine.ListEntry{{Key: "a1", Size: 8}, {Key: "a2", Size: 8}}, page.Entries)
+		assert.Equal(t, "a2", page.NextCursor)
+
+		page, err = lister.List(imagine.ListOptions{Prefix: "a", Limit: 2, Cursor: page.NextCursor})
+		assert.NoError(t, err)
+		assert.Equal(t, []imagine.ListEntry{{Key: "a3", Size: 8}}, page.Entries)
+		assert.Empty(t, page.NextCursor)
+	})
+
+	t.Run("ttl", func(t *testing.T) {
+		server := newFakeRedis(t, "")
+		store, err := imagine.NewRedisStorage(imagine.RedisStoreParams{Addr: server.addr(), TTL: 50 * time.Millisecond})
+		assert.NoError(t, err)
+		defer store.Close()
+
+		assert.NoError(t, store.Set("key", []byte("value")))
+		_, found, _ := store.Get("key")
+		assert.True(t, found)
+
+		time.Sleep(100 * time.Millisecond)
+		_, found, _ = store.Get("key")
+		assert.False(t, found)
+	})
+
+	t.Run("authentication", func(t *testing.T) {
+		server := newFakeRedis(t, "secret")
+		_, err := imagine.NewRedisStorage(imagine.RedisStoreParams{Addr: server.addr(), Password: "wrong"})
+		assert.Error(t, err)
+	})
+
+	t.Run("reconnects", func(t *testing.T) {
+		server := newFakeRedis(t, "")
+		store, err := imagine.NewRedisStorage(imagine.RedisStoreParams{Addr: server.addr()})
+		assert.NoError(t, err)
+		defer store.Close()
+
+		assert.NoError(t, store.Set("key", []byte("value")))
+		server.dropConnections()
+
+		_, found, err := store.Get("key")
+		assert.NoError(t, err)
+		assert.True(t, found)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		server := newFakeRedis(t, "")
+		store, err := imagine.NewRedisStorage(imagine.RedisStoreParams{Addr: server.addr(), ReadTimeout: 50 * time.Millisecond})
+		assert.NoError(t, err)
+		defer store.Close()
+
+		server.mu.Lock()
+		server.stall = true
+		server.mu.Unlock()
+
+		start := time.Now()
+		_, _, err = store.Get("key")
+		assert.Error(t, err)
+		assert.Less(t, time.Since(start), time.Second)
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		server := newFakeRedis(t, "")
+		store, err := imagine.NewRedisStorage(imagine.RedisStoreParams{Addr: server.addr()})
+		assert.NoError(t, err)
+		assert.NoError(t, store.Close())
+
+		_, _, err = store.Get("key")
+		assert.Error(t, err)
+	})
+
+	t.Run("unreachable", func(t *testing.T) {
+		_, err := imagine.NewRedisStorage(imagine.RedisStoreParams{Addr: "127.0.0.1:1", DialTimeout: 100 * time.Millisecond})
+		assert.Error(t, err)
+	})
+}
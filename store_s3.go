@@ -0,0 +1,471 @@
+package imagine
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// minS3PartSize is the smallest part S3 accepts in multipart uploads, but
+// for the last one
+const minS3PartSize = 5 << 20
+
+// S3StoreParams are the parameters for creating a new S3 store
+type S3StoreParams struct {
+	// Endpoint is the URL of the S3 compatible service. Defaults to the AWS
+	// endpoint of the region.
+	Endpoint string
+
+	// Region is the region the requests are signed for. Defaults to
+	// us-east-1.
+	Region string
+
+	// Bucket is the bucket holding the objects, it's required
+	Bucket string
+
+	// Prefix is prepended to the keys of the objects
+	Prefix string
+
+	// AccessKeyID and SecretAccessKey are the credentials signing the
+	// requests, SessionToken is set for temporary credentials
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+
+	// PathStyle addresses the bucket in the path of the URLs rather than in
+	// their host, which most S3 compatible services expect
+	PathStyle bool
+
+	// PartSize is the size of the parts of multipart uploads, used for
+	// objects larger than it. Defaults to 8MB, at least 5MB.
+	PartSize int
+
+	// Client sends the requests. Defaults to a client timing out after a
+	// minute.
+	Client *http.Client
+}
+
+// withDefaults sets the default values for the S3 parameters
+func (p *S3StoreParams) withDefaults() {
+	if p.Region == "" {
+		p.Region = "us-east-1"
+	}
+	if p.Endpoint == "" {
+		p.Endpoint = "https://s3." + p.Region + ".amazonaws.com"
+	}
+	if p.PartSize == 0 {
+		p.PartSize = 8 << 20
+	}
+	if p.Client == nil {
+		p.Client = &http.Client{Timeout: time.Minute}
+	}
+}
+
+// s3Store is a Store implementation that uses an S3 bucket
+type s3Store struct {
+	params   *S3StoreParams
+	endpoint *url.URL
+}
+
+// ensure s3Store implements Store, Lister and Stater
+var _ Store = new(s3Store)
+var _ Lister = new(s3Store)
+var _ Stater = new(s3Store)
+
+// NewS3Storage creates a new store keeping the entries as objects of an S3
+// bucket
+func NewS3Storage(params S3StoreParams) (Store, error) {
+	params.withDefaults()
+	if params.Bucket == "" {
+		return nil, errors.New("S3 bucket is required")
+	}
+	if params.PartSize < minS3PartSize {
+		return nil, errors.Errorf("S3 part size must be at least %d bytes", minS3PartSize)
+	}
+
+	endpoint, err := url.Parse(params.Endpoint)
+	if err != nil {
+		return nil, errors.Annotate(err, "invalid S3 endpoint")
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, errors.Errorf("invalid S3 endpoint %s", params.Endpoint)
+	}
+
+	fmt.Printf("[S3Store] Initialized with endpoint: %s, bucket: %s\n", params.Endpoint, params.Bucket)
+	return &s3Store{params: &params, endpoint: endpoint}, nil
+}
+
+// s3Error is the error document of S3
+type s3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+func (s *s3Store) Set(key string, data []byte) error {
+	contentType := detectContentType(data)
+	if len(data) > s.params.PartSize {
+		return errors.Trace(s.multipartUpload(key, data, contentType))
+	}
+
+	header := http.Header{"Content-Type": {contentType}}
+	response, err := s.do(http.MethodPut, key, nil, header, data)
+	if err != nil {
+		return errors.Annotatef(err, "could not put %s", key)
+	}
+	response.Body.Close()
+	return nil
+}
+
+func (s *s3Store) Get(key string) ([]byte, bool, error) {
+	response, err := s.do(http.MethodGet, key, nil, nil, nil)
+	if s.notFound(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, errors.Annotatef(err, "could not get %s", key)
+	}
+	defer response.Body.Close()
+
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, false, errors.Trace(err)
+	}
+	return data, true, nil
+}
+
+func (s *s3Store) Delete(key string) error {
+	response, err := s.do(http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return errors.Annotatef(err, "could not delete %s", key)
+	}
+	response.Body.Close()
+	return nil
+}
+
+func (s *s3Store) Stat(key string) (*EntryInfo, bool, error) {
+	response, err := s.do(http.MethodHead, key, nil, nil, nil)
+	if s.notFound(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, errors.Annotatef(err, "could not stat %s", key)
+	}
+	response.Body.Close()
+
+	info := &EntryInfo{
+		Size:        response.ContentLength,
+		ContentType: response.Header.Get("Content-Type"),
+	}
+	if modified, err := http.ParseTime(response.Header.Get("Last-Modified")); err == nil {
+		info.Modified = modified
+	}
+	return info, true, nil
+}
+
+func (s *s3Store) List(options ListOptions) (*ListPage, error) {
+	options.withDefaults()
+
+	query := url.Values{
+		"list-type": {"2"},
+		"prefix":    {s.params.Prefix + options.Prefix},
+		"max-keys":  {strconv.Itoa(options.Limit)},
+	}
+	if options.Cursor != "" {
+		query.Set("start-after", s.params.Prefix+options.Cursor)
+	}
+
+	response, err := s.do(http.MethodGet, "", query, nil, nil)
+	if err != nil {
+		return nil, errors.Annotate(err, "could not list objects")
+	}
+	defer response.Body.Close()
+
+	var result struct {
+		IsTruncated bool `xml:"IsTruncated"`
+		Contents    []struct {
+			Key          string    `xml:"Key"`
+			Size         int64     `xml:"Size"`
+			LastModified time.Time `xml:"LastModified"`
+		} `xml:"Contents"`
+	}
+	if err := xml.NewDecoder(response.Body).Decode(&result); err != nil {
+		return nil, errors.Annotate(err, "invalid object listing")
+	}
+
+	page := &ListPage{Entries: []ListEntry{}}
+	for _, object := range result.Contents {
+		page.Entries = append(page.Entries, ListEntry{
+			Key:     strings.TrimPrefix(object.Key, s.params.Prefix),
+			Size:    object.Size,
+			ModTime: object.LastModified,
+		})
+	}
+	if result.IsTruncated && len(page.Entries) > 0 {
+		page.NextCursor = page.Entries[len(page.Entries)-1].Key
+	}
+	return page, nil
+}
+
+func (s *s3Store) Close() error {
+	s.params.Client.CloseIdleConnections()
+	return nil
+}
+
+// multipartUpload uploads data in parts of PartSize, aborting the upload
+// when a part fails so S3 doesn't keep them
+func (s *s3Store) multipartUpload(key string, data []byte, contentType string) error {
+	header := http.Header{"Content-Type": {contentType}}
+	response, err := s.do(http.MethodPost, key, url.Values{"uploads": {""}}, header, nil)
+	if err != nil {
+		return errors.Annotatef(err, "could not start multipart upload of %s", key)
+	}
+
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(response.Body).Decode(&initiated)
+	response.Body.Close()
+	if err != nil {
+		return errors.Annotate(err, "invalid multipart upload")
+	}
+
+	err = s.uploadParts(key, initiated.UploadID, data)
+	if err != nil {
+		response, abortErr := s.do(http.MethodDelete, key, url.Values{"uploadId": {initiated.UploadID}}, nil, nil)
+		if abortErr == nil {
+			response.Body.Close()
+		}
+		return errors.Annotatef(err, "multipart upload of %s failed", key)
+	}
+	return nil
+}
+
+// uploadParts uploads the parts of data and completes the upload
+func (s *s3Store) uploadParts(key, uploadID string, data []byte) error {
+	type part struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	complete := struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}{}
+
+	for offset := 0; offset < len(data); offset += s.params.PartSize {
+		end := offset + s.params.PartSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		number := len(complete.Parts) + 1
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+		response, err := s.do(http.MethodPut, key, query, nil, data[offset:end])
+		if err != nil {
+			return errors.Annotatef(err, "could not upload part %d", number)
+		}
+		response.Body.Close()
+		complete.Parts = append(complete.Parts, part{PartNumber: number, ETag: response.Header.Get("ETag")})
+	}
+
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	response, err := s.do(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil, body)
+	if err != nil {
+		return errors.Annotate(err, "could not complete upload")
+	}
+	defer response.Body.Close()
+
+	// completing can fail after the 200 status was sent, the error is then
+	// in the body
+	result, err := io.ReadAll(response.Body)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	var failure s3Error
+	if xml.Unmarshal(result, &failure) == nil {
+		return errors.Errorf("%s: %s", failure.Code, failure.Message)
+	}
+	return nil
+}
+
+// notFound tells whether err is S3 reporting a missing object, rather than
+// e.g. a missing bucket
+func (s *s3Store) notFound(err error) bool {
+	var failure *s3ResponseError
+	return errors.As(err, &failure) && failure.status == http.StatusNotFound &&
+		(failure.code == "" || failure.code == "NoSuchKey")
+}
+
+// s3ResponseError is an unsuccessful response of S3
+type s3ResponseError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *s3ResponseError) Error() string {
+	if e.code == "" {
+		return fmt.Sprintf("s3: status %d", e.status)
+	}
+	return fmt.Sprintf("s3: %s: %s (status %d)", e.code, e.message, e.status)
+}
+
+// objectURL returns the URL of the object key, or of the bucket when key is
+// empty
+func (s *s3Store) objectURL(key string, query url.Values) (*url.URL, error) {
+	host := s.endpoint.Host
+	path := strings.TrimSuffix(s.endpoint.EscapedPath(), "/") + "/"
+	if s.params.PathStyle {
+		path += s3Escape(s.params.Bucket, false) + "/"
+	} else {
+		host = s.params.Bucket + "." + host
+	}
+	if key != "" {
+		path += s3Escape(s.params.Prefix+key, false)
+	}
+
+	if encoded := s3Query(query); encoded != "" {
+		path += "?" + encoded
+	}
+	return url.Parse(s.endpoint.Scheme + "://" + host + path)
+}
+
+// do sends a signed request, returning an error for unsuccessful responses
+func (s *s3Store) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u, err := s.objectURL(key, query)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	request, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	s.sign(request, body, time.Now().UTC())
+
+	response, err := s.params.Client.Do(request)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if response.StatusCode < 300 {
+		return response, nil
+	}
+	defer response.Body.Close()
+
+	failure := &s3ResponseError{status: response.StatusCode}
+	var document s3Error
+	if data, err := io.ReadAll(io.LimitReader(response.Body, 1<<16)); err == nil && xml.Unmarshal(data, &document) == nil {
+		failure.code, failure.message = document.Code, document.Message
+	}
+	return nil, errors.Trace(failure)
+}
+
+// sign signs the request with AWS Signature Version 4
+func (s *s3Store) sign(request *http.Request, body []byte, now time.Time) {
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	request.Header.Set("Host", request.URL.Host)
+	request.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.params.SessionToken != "" {
+		request.Header.Set("X-Amz-Security-Token", s.params.SessionToken)
+	}
+
+	var names []string
+	for name := range request.Header {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		value := strings.Join(request.Header.Values(name), ",")
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		s3Query(request.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.params.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+s.params.SecretAccessKey), date)
+	for _, part := range []string{s.params.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.params.AccessKeyID, scope, signedHeaders, signature))
+
+	// the Host header is signed but sent from the URL
+	request.Header.Del("Host")
+}
+
+// s3Query encodes a query string the way it's signed, sorted by key
+func s3Query(query url.Values) string {
+	var keys []string
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			pairs = append(pairs, s3Escape(key, true)+"="+s3Escape(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// s3Escape percent-encodes everything but the unreserved characters, and
+// slashes unless escapeSlash is set
+func s3Escape(s string, escapeSlash bool) string {
+	var escaped strings.Builder
+	for _, b := range []byte(s) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '_', b == '.', b == '~', b == '/' && !escapeSlash:
+			escaped.WriteByte(b)
+		default:
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+	return escaped.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
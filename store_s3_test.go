@@ -0,0 +1,296 @@
+package imagine_test
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/risico/imagine"
+)
+
+const (
+	testAccessKey = "AKIDEXAMPLE"
+	testSecretKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+)
+
+type fakeObject struct {
+	data        []byte
+	contentType string
+	modified    time.Time
+}
+
+// fakeS3 is an in-process S3 server holding a single bucket, which checks
+// the signatures of the requests
+type fakeS3 struct {
+	*httptest.Server
+	bucket string
+
+	mu      sync.Mutex
+	objects map[string]fakeObject
+	uploads map[string]*fakeUpload
+}
+
+type fakeUpload struct {
+	contentType string
+	parts       map[int][]byte
+}
+
+func newFakeS3(t *testing.T, bucket string) *fakeS3 {
+	f := &fakeS3{bucket: bucket, objects: map[string]fakeObject{}, uploads: map[string]*fakeUpload{}}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.handle))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func newS3Store(t *testing.T, server *fakeS3, params imagine.S3StoreParams) imagine.Store {
+	params.Endpoint = server.URL
+	params.PathStyle = true
+	params.AccessKeyID = testAccessKey
+	if params.SecretAccessKey == "" {
+		params.SecretAccessKey = testSecretKey
+	}
+	if params.Bucket == "" {
+		params.Bucket = server.bucket
+	}
+
+	store, err := imagine.NewS3Storage(params)
+	assert.NoError(t, err)
+	return store
+}
+
+func s3Fail(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (f *fakeS3) handle(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	if !validSignature(r, body) {
+		s3Fail(w, http.StatusForbidden, "SignatureDoesNotMatch")
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	bucket, key, _ := strings.Cut(path, "/")
+	if bucket != f.bucket {
+		s3Fail(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	query := r.URL.Query()
+
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		f.list(w, query)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		id := strconv.Itoa(len(f.uploads) + 1)
+		f.uploads[id] = &fakeUpload{contentType: r.Header.Get("Content-Type"), parts: map[int][]byte{}}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>", key, id)
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		f.uploads[query.Get("uploadId")].parts[number] = body
+		sum := sha256.Sum256(body)
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:8])+`"`)
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		var complete struct {
+			Parts []struct {
+				PartNumber int
+				ETag       string
+			} `xml:"Part"`
+		}
+		xml.Unmarshal(body, &complete)
+		upload := f.uploads[query.Get("uploadId")]
+
+		var data []byte
+		for idx, part := range complete.Parts {
+			sum := sha256.Sum256(upload.parts[part.PartNumber])
+			if part.PartNumber != idx+1 || part.ETag != `"`+hex.EncodeToString(sum[:8])+`"` {
+				s3Fail(w, http.StatusBadRequest, "InvalidPart")
+				return
+			}
+			if idx < len(complete.Parts)-1 && len(upload.parts[part.PartNumber]) < 5<<20 {
+				s3Fail(w, http.StatusBadRequest, "EntityTooSmall")
+				return
+			}
+			data = append(data, upload.parts[part.PartNumber]...)
+		}
+		f.objects[key] = fakeObject{data: data, contentType: upload.contentType, modified: time.Now()}
+		delete(f.uploads, query.Get("uploadId"))
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult><Key>%s</Key></CompleteMultipartUploadResult>", key)
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		f.objects[key] = fakeObject{data: body, contentType: r.Header.Get("Content-Type"), modified: time.Now()}
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		object, ok := f.objects[key]
+		if !ok {
+			s3Fail(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Content-Type", object.contentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(object.data)))
+		w.Header().Set("Last-Modified", object.modified.UTC().Format(http.TimeFormat))
+		w.Write(object.data)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s3Fail(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, query url.Values) {
+	limit, _ := strconv.Atoi(query.Get("max-keys"))
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, query.Get("prefix")) && key > query.Get("start-after") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	truncated := len(keys) > limit
+	if truncated {
+		keys = keys[:limit]
+	}
+	fmt.Fprintf(w, "<ListBucketResult><IsTruncated>%t</IsTruncated>", truncated)
+	for _, key := range keys {
+		object := f.objects[key]
+		fmt.Fprintf(w, "<Contents><Key>%s</Key><Size>%d</Size><LastModified>%s</LastModified></Contents>",
+			key, len(object.data), object.modified.UTC().Format("2006-01-02T15:04:05.000Z"))
+	}
+	fmt.Fprint(w, "</ListBucketResult>")
+}
+
+// validSignature recomputes the AWS Signature Version 4 of the request
+func validSignature(r *http.Request, body []byte) bool {
+	fields := map[string]string{}
+	for _, field := range strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 "), ", ") {
+		name, value, _ := strings.Cut(field, "=")
+		fields[name] = value
+	}
+	credential := strings.SplitN(fields["Credential"], "/", 2)
+	if len(credential) != 2 || credential[0] != testAccessKey {
+		return false
+	}
+
+	sum := sha256.Sum256(body)
+	if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+		return false
+	}
+
+	var headers []string
+	for _, name := range strings.Split(fields["SignedHeaders"], ";") {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		headers = append(headers, name+":"+value+"\n")
+	}
+
+	query := r.URL.Query()
+	var pairs []string
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, strings.ReplaceAll(url.QueryEscape(name), "+", "%20")+"="+strings.ReplaceAll(url.QueryEscape(value), "+", "%20"))
+		}
+	}
+	sort.Strings(pairs)
+
+	canonical := strings.Join([]string{
+		r.Method, r.URL.EscapedPath(), strings.Join(pairs, "&"),
+		strings.Join(headers, ""), fields["SignedHeaders"], r.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	canonicalSum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + r.Header.Get("X-Amz-Date") + "\n" + credential[1] + "\n" + hex.EncodeToString(canonicalSum[:])
+
+	key := []byte("AWS4" + testSecretKey)
+	for _, part := range strings.Split(credential[1], "/") {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(toSign))
+	return hex.EncodeToString(mac.Sum(nil)) == fields["Signature"]
+}
+
+func TestS3Store(t *testing.T) {
+	server := newFakeS3(t, "images")
+
+	t.Run("set get delete", func(t *testing.T) {
+		store := newS3Store(t, server, imagine.S3StoreParams{Prefix: "originals/"})
+		defer store.Close()
+
+		// keys are escaped the same way in the URL and the signature
+		key := "a b+c/d~e.png"
+		assert.NoError(t, store.Set(key, []byte("data")))
+		data, found, err := store.Get(key)
+		assert.NoError(t, err)
+		assert.True(t, found)
+		assert.Equal(t, []byte("data"), data)
+		_, found = server.objects["originals/"+key]
+		assert.True(t, found)
+
+		assert.NoError(t, store.Delete(key))
+		data, found, err = store.Get(key)
+		assert.NoError(t, err)
+		assert.False(t, found)
+		assert.Nil(t, data)
+	})
+
+	t.Run("multipart", func(t *testing.T) {
+		store := newS3Store(t, server, imagine.S3StoreParams{PartSize: 5 << 20})
+		defer store.Close()
+
+		data := append([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), make([]byte, 11<<20)...)
+		rand.Read(data[16:])
+		assert.NoError(t, store.Set("large", data))
+		assert.Equal(t, "image/png", server.objects["large"].contentType)
+		assert.Empty(t, server.uploads)
+
+		got, found, err := store.Get("large")
+		assert.NoError(t, err)
+		assert.True(t, found)
+		assert.True(t, bytes.Equal(data, got))
+	})
+
+	t.Run("signature", func(t *testing.T) {
+		store := newS3Store(t, server, imagine.S3StoreParams{SecretAccessKey: "wrong"})
+		_, _, err := store.Get("key")
+		assert.ErrorContains(t, err, "SignatureDoesNotMatch")
+	})
+
+	t.Run("missing bucket", func(t *testing.T) {
+		store := newS3Store(t, server, imagine.S3StoreParams{Bucket: "missing"})
+		_, found, err := store.Get("key")
+		assert.ErrorContains(t, err, "NoSuchBucket")
+		assert.False(t, found)
+	})
+
+	t.Run("params", func(t *testing.T) {
+		_, err := imagine.NewS3Storage(imagine.S3StoreParams{})
+		assert.Error(t, err)
+		_, err = imagine.NewS3Storage(imagine.S3StoreParams{Bucket: "images", PartSize: 1 << 20})
+		assert.Error(t, err)
+	})
+}
@@ -9,6 +9,11 @@ import (
 	"github.com/juju/errors"
 )
 
+// ensure sqliteStore implements Store and Lister
+var _ Store = new(sqliteStore)
+var _ Lister = new(sqliteStore)
+var _ Stater = new(sqliteStore)
+
 type sqliteStore struct {
 	db        *sql.DB
 	tableName string
@@ -142,6 +147,58 @@ func (s *sqliteStore) Delete(key string) error {
 	return nil
 }
 
+// Stat describes an entry without reading its data nor updating its access
+// time. Entries are rewritten on Set, so created_at is their modification
+// time and Created is left zero.
+func (s *sqliteStore) Stat(key string) (*EntryInfo, bool, error) {
+	query := fmt.Sprintf(`
+		SELECT length(data), substr(data, 1, ?), created_at FROM %s WHERE hash = ?
+	`, s.tableName)
+
+	var info EntryInfo
+	var head []byte
+	err := s.db.QueryRow(query, sniffLen, key).Scan(&info.Size, &head, &info.Modified)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, errors.Trace(err)
+	}
+
+	info.ContentType = detectContentType(head)
+	return &info, true, nil
+}
+
+func (s *sqliteStore) List(options ListOptions) (*ListPage, error) {
+	options.withDefaults()
+
+	// LIKE is case insensitive, prefixes are compared as they are
+	query := fmt.Sprintf(`
+		SELECT hash, length(data), created_at FROM %s
+		WHERE substr(hash, 1, ?) = ? AND hash > ?
+		ORDER BY hash LIMIT ?
+	`, s.tableName)
+
+	rows, err := s.db.Query(query, len(options.Prefix), options.Prefix, options.Cursor, options.Limit+1)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer rows.Close()
+
+	entries := []ListEntry{}
+	for rows.Next() {
+		var entry ListEntry
+		if err := rows.Scan(&entry.Key, &entry.Size, &entry.ModTime); err != nil {
+			return nil, errors.Trace(err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return newListPage(entries, options.Limit), nil
+}
+
 func (s *sqliteStore) Close() error {
 	fmt.Printf("[SQLiteStore] Closing database connection\n")
 	return s.db.Close()
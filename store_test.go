@@ -1,7 +1,10 @@
 package imagine_test
 
 import (
+	"fmt"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
@@ -13,6 +16,88 @@ func TestStores(t *testing.T) {
     t.Run("local", testLocalStore)
 }
 
+// testStores builds the stores implementing the optional extensions
+func testStores() map[string]func(t *testing.T) imagine.Store {
+	return map[string]func(t *testing.T) imagine.Store{
+		"memory": func(t *testing.T) imagine.Store {
+			return imagine.NewInMemoryStorage(imagine.MemoryStoreParams{})
+		},
+		"local": func(t *testing.T) imagine.Store {
+			store, err := imagine.NewLocalStorage(imagine.LocalStoreParams{Path: t.TempDir()})
+			assert.NoError(t, err)
+			return store
+		},
+		"bolt": func(t *testing.T) imagine.Store {
+			store, err := imagine.NewBoltStore(imagine.BoltStoreParams{Path: filepath.Join(t.TempDir(), "bolt.db")})
+			assert.NoError(t, err)
+			return store
+		},
+		"sqlite": func(t *testing.T) imagine.Store {
+			store, err := imagine.NewSQLiteStorage(imagine.SQLiteStoreParams{Path: filepath.Join(t.TempDir(), "sqlite.db")})
+			assert.NoError(t, err)
+			return store
+		},
+		"tiered": func(t *testing.T) imagine.Store {
+			local, err := imagine.NewLocalStorage(imagine.LocalStoreParams{Path: t.TempDir()})
+			assert.NoError(t, err)
+			store, err := imagine.NewTieredStorage(imagine.TieredStoreParams{
+				Tiers: []imagine.Store{imagine.NewInMemoryStorage(imagine.MemoryStoreParams{}), local},
+			})
+			assert.NoError(t, err)
+			return store
+		},
+		"s3": func(t *testing.T) imagine.Store {
+			return newS3Store(t, newFakeS3(t, "images"), imagine.S3StoreParams{Prefix: "images/"})
+		},
+	}
+}
+
+func TestListers(t *testing.T) {
+	for name, newStore := range testStores() {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+			defer store.Close()
+			lister := store.(imagine.Lister)
+
+			page, err := lister.List(imagine.ListOptions{})
+			assert.NoError(t, err)
+			assert.Empty(t, page.Entries)
+
+			for idx := 0; idx < 5; idx++ {
+				assert.NoError(t, store.Set(fmt.Sprintf("a%d", idx), make([]byte, idx)))
+			}
+			assert.NoError(t, store.Set("b0", []byte("b")))
+
+			var keys []string
+			options := imagine.ListOptions{Prefix: "a", Limit: 2}
+			for {
+				page, err := lister.List(options)
+				assert.NoError(t, err)
+				assert.LessOrEqual(t, len(page.Entries), 2)
+				for _, entry := range page.Entries {
+					keys = append(keys, entry.Key)
+					assert.Equal(t, int64(entry.Key[1]-'0'), entry.Size)
+					if name != "bolt" {
+						assert.WithinDuration(t, time.Now(), entry.ModTime, time.Minute)
+					}
+				}
+				if page.NextCursor == "" {
+					break
+				}
+				options.Cursor = page.NextCursor
+			}
+			assert.Equal(t, []string{"a0", "a1", "a2", "a3", "a4"}, keys)
+
+			page, err = lister.List(imagine.ListOptions{Cursor: "a4"})
+			assert.NoError(t, err)
+			if assert.Len(t, page.Entries, 1) {
+				assert.Equal(t, "b0", page.Entries[0].Key)
+			}
+			assert.Empty(t, page.NextCursor)
+		})
+	}
+}
+
 func testLocalStore(t *testing.T) {
     store, err := imagine.NewLocalStorage(imagine.LocalStoreParams{
         Path: "/tmp/imagine",
@@ -38,3 +123,35 @@ func testLocalStore(t *testing.T) {
     err = store.Close()
     assert.NoError(t, err)
 }
+
+func TestStaters(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+	for name, newStore := range testStores() {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+			defer store.Close()
+			stater := store.(imagine.Stater)
+
+			info, ok, err := stater.Stat("missing")
+			assert.NoError(t, err)
+			assert.False(t, ok)
+			assert.Nil(t, info)
+
+			assert.NoError(t, store.Set("image", append(png, make([]byte, 1000)...)))
+			info, ok, err = stater.Stat("image")
+			assert.NoError(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, int64(len(png)+1000), info.Size)
+			assert.Equal(t, "image/png", info.ContentType)
+			if name != "bolt" {
+				assert.WithinDuration(t, time.Now(), info.Modified, time.Minute)
+			}
+
+			assert.NoError(t, store.Set("text", []byte("hello")))
+			info, _, err = stater.Stat("text")
+			assert.NoError(t, err)
+			assert.Equal(t, "text/plain; charset=utf-8", info.ContentType)
+		})
+	}
+}
@@ -0,0 +1,204 @@
+package imagine
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/juju/errors"
+)
+
+// TierWritePolicy tells which tiers of a tiered store are written to
+type TierWritePolicy string
+
+const (
+	// TierWriteThrough writes to every tier, the slowest first
+	TierWriteThrough TierWritePolicy = "through"
+	// TierWriteAround only writes to the slowest tier and drops the key
+	// from the faster ones, which are filled by the reads
+	TierWriteAround TierWritePolicy = "around"
+)
+
+// TieredStoreParams are the parameters for creating a new tiered store
+type TieredStoreParams struct {
+	// Tiers are the stores, from the fastest to the slowest. The slowest
+	// one holds every entry.
+	Tiers []Store
+
+	// WritePolicy tells which tiers are written to. Defaults to
+	// TierWriteThrough.
+	WritePolicy TierWritePolicy
+}
+
+// withDefaults sets the default values for the tiered store parameters
+func (p *TieredStoreParams) withDefaults() {
+	if p.WritePolicy == "" {
+		p.WritePolicy = TierWriteThrough
+	}
+}
+
+// tieredStore layers stores, reading from the fastest tier holding a key
+// and promoting it into the faster ones
+type tieredStore struct {
+	params *TieredStoreParams
+
+	// mu is shared by the writes and held by the promotions, so an entry
+	// isn't promoted while being written
+	mu sync.RWMutex
+
+	// version changes after every write, an entry read before a write
+	// isn't promoted after it
+	version uint64
+}
+
+// ensure tieredStore implements Store, Lister and Stater
+var _ Store = new(tieredStore)
+var _ Lister = new(tieredStore)
+var _ Stater = new(tieredStore)
+
+// NewTieredStorage creates a store layering the given tiers, e.g. memory in
+// front of local files in front of SQLite
+func NewTieredStorage(params TieredStoreParams) (Store, error) {
+	params.withDefaults()
+	if len(params.Tiers) == 0 {
+		return nil, errors.New("tiered store needs at least one tier")
+	}
+	for idx, tier := range params.Tiers {
+		if tier == nil {
+			return nil, errors.Errorf("tier %d is nil", idx)
+		}
+	}
+	if params.WritePolicy != TierWriteThrough && params.WritePolicy != TierWriteAround {
+		return nil, errors.Errorf("unknown tier write policy %q", params.WritePolicy)
+	}
+
+	return &tieredStore{params: &params}, nil
+}
+
+// last returns the slowest tier, which holds every entry
+func (t *tieredStore) last() Store {
+	return t.params.Tiers[len(t.params.Tiers)-1]
+}
+
+func (t *tieredStore) Set(key string, data []byte) error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	defer atomic.AddUint64(&t.version, 1)
+
+	if err := t.last().Set(key, data); err != nil {
+		return errors.Trace(err)
+	}
+
+	faster := t.params.Tiers[:len(t.params.Tiers)-1]
+	for idx := len(faster) - 1; idx >= 0; idx-- {
+		var err error
+		if t.params.WritePolicy == TierWriteThrough {
+			err = faster[idx].Set(key, data)
+		} else {
+			err = deleteKey(faster[idx], key)
+		}
+		if err != nil {
+			return errors.Annotatef(err, "could not write %s to tier %d", key, idx)
+		}
+	}
+	return nil
+}
+
+// Get reads key from the fastest tier holding it, copying it into the
+// faster tiers. A failing tier is skipped, its error is only returned when
+// no other tier has the key.
+func (t *tieredStore) Get(key string) ([]byte, bool, error) {
+	version := atomic.LoadUint64(&t.version)
+
+	var failure error
+	for idx, tier := range t.params.Tiers {
+		data, found, err := tier.Get(key)
+		if err != nil && errors.Cause(err) != ErrKeyNotFound {
+			if failure == nil {
+				failure = errors.Annotatef(err, "tier %d", idx)
+			}
+			continue
+		} else if err != nil || !found {
+			continue
+		}
+
+		t.promote(key, data, idx, version)
+		return data, true, nil
+	}
+	return nil, false, errors.Trace(failure)
+}
+
+// promote copies an entry found in a tier into the faster ones, unless the
+// store was written since version, when it was read. Failing to do so
+// doesn't fail the read.
+func (t *tieredStore) promote(key string, data []byte, found int, version uint64) {
+	if found == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if atomic.LoadUint64(&t.version) != version {
+		return
+	}
+	for idx := found - 1; idx >= 0; idx-- {
+		if err := t.params.Tiers[idx].Set(key, data); err != nil {
+			fmt.Printf("[TieredStore] Could not promote %s to tier %d: %v\n", key, idx, err)
+		}
+	}
+}
+
+// Delete deletes key from every tier, the slowest last so a failed delete
+// can be retried
+func (t *tieredStore) Delete(key string) error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	defer atomic.AddUint64(&t.version, 1)
+
+	for idx, tier := range t.params.Tiers {
+		if err := deleteKey(tier, key); err != nil {
+			return errors.Annotatef(err, "could not delete %s from tier %d", key, idx)
+		}
+	}
+	return nil
+}
+
+// Stat describes key from the fastest tier holding it, without promoting
+// it
+func (t *tieredStore) Stat(key string) (*EntryInfo, bool, error) {
+	var failure error
+	for idx, tier := range t.params.Tiers {
+		info, found, err := statEntry(tier, key)
+		if err != nil {
+			if failure == nil {
+				failure = errors.Annotatef(err, "tier %d", idx)
+			}
+			continue
+		}
+		if found {
+			return info, true, nil
+		}
+	}
+	return nil, false, errors.Trace(failure)
+}
+
+// List lists the slowest tier, which holds every entry
+func (t *tieredStore) List(options ListOptions) (*ListPage, error) {
+	lister, ok := t.last().(Lister)
+	if !ok {
+		return nil, errors.Trace(ErrListingUnsupported)
+	}
+	page, err := lister.List(options)
+	return page, errors.Trace(err)
+}
+
+func (t *tieredStore) Close() error {
+	var failure error
+	for idx, tier := range t.params.Tiers {
+		if err := tier.Close(); err != nil && failure == nil {
+			failure = errors.Annotatef(err, "could not close tier %d", idx)
+		}
+	}
+	return failure
+}
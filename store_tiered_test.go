@@ -0,0 +1,213 @@
+package imagine_test
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/risico/imagine"
+)
+
+var errUnavailable = errors.New("store unavailable")
+
+// flakyStore wraps a store, failing every call while down
+type flakyStore struct {
+	imagine.Store
+
+	mu   sync.Mutex
+	down bool
+}
+
+func (f *flakyStore) setDown(down bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.down = down
+}
+
+func (f *flakyStore) isDown() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.down
+}
+
+func (f *flakyStore) Set(key string, data []byte) error {
+	if f.isDown() {
+		return errUnavailable
+	}
+	return f.Store.Set(key, data)
+}
+
+func (f *flakyStore) Get(key string) ([]byte, bool, error) {
+	if f.isDown() {
+		return nil, false, errUnavailable
+	}
+	return f.Store.Get(key)
+}
+
+func (f *flakyStore) Delete(key string) error {
+	if f.isDown() {
+		return errUnavailable
+	}
+	return f.Store.Delete(key)
+}
+
+func (f *flakyStore) List(options imagine.ListOptions) (*imagine.ListPage, error) {
+	if f.isDown() {
+		return nil, errUnavailable
+	}
+	return f.Store.(imagine.Lister).List(options)
+}
+
+// racingStore wraps a store, calling afterGet once after its first read
+type racingStore struct {
+	imagine.Store
+	afterGet func()
+	once     sync.Once
+}
+
+func (r *racingStore) Get(key string) ([]byte, bool, error) {
+	data, found, err := r.Store.Get(key)
+	r.once.Do(r.afterGet)
+	return data, found, err
+}
+
+func TestTieredStore(t *testing.T) {
+	newTiers := func(t *testing.T) (hot, warm imagine.Store, cold *flakyStore) {
+		hot = imagine.NewInMemoryStorage(imagine.MemoryStoreParams{})
+		warm, err := imagine.NewLocalStorage(imagine.LocalStoreParams{Path: t.TempDir()})
+		assert.NoError(t, err)
+		sqlite, err := imagine.NewSQLiteStorage(imagine.SQLiteStoreParams{Path: filepath.Join(t.TempDir(), "cold.db")})
+		assert.NoError(t, err)
+		return hot, warm, &flakyStore{Store: sqlite}
+	}
+	has := func(store imagine.Store, key string) bool {
+		_, found, _ := store.Get(key)
+		return found
+	}
+
+	t.Run("write through", func(t *testing.T) {
+		hot, warm, cold := newTiers(t)
+		store, err := imagine.NewTieredStorage(imagine.TieredStoreParams{Tiers: []imagine.Store{hot, warm, cold}})
+		assert.NoError(t, err)
+		defer store.Close()
+
+		assert.NoError(t, store.Set("key", []byte("value")))
+		assert.True(t, has(hot, "key"))
+		assert.True(t, has(warm, "key"))
+		assert.True(t, has(cold, "key"))
+
+		assert.NoError(t, store.Delete("key"))
+		assert.False(t, has(hot, "key"))
+		assert.False(t, has(warm, "key"))
+		assert.False(t, has(cold, "key"))
+		_, found, err := store.Get("key")
+		assert.NoError(t, err)
+		assert.False(t, found)
+	})
+
+	t.Run("write around and promotion", func(t *testing.T) {
+		hot, warm, cold := newTiers(t)
+		store, err := imagine.NewTieredStorage(imagine.TieredStoreParams{
+			Tiers:       []imagine.Store{hot, warm, cold},
+			WritePolicy: imagine.TierWriteAround,
+		})
+		assert.NoError(t, err)
+		defer store.Close()
+
+		assert.NoError(t, hot.Set("key", []byte("stale")))
+		assert.NoError(t, store.Set("key", []byte("value")))
+		assert.False(t, has(hot, "key"))
+		assert.False(t, has(warm, "key"))
+
+		data, found, err := store.Get("key")
+		assert.NoError(t, err)
+		assert.True(t, found)
+		assert.Equal(t, []byte("value"), data)
+		assert.True(t, has(hot, "key"))
+		assert.True(t, has(warm, "key"))
+
+		// promoted entries are then served without the slower tiers
+		cold.setDown(true)
+		data, found, err = store.Get("key")
+		assert.NoError(t, err)
+		assert.True(t, found)
+		assert.Equal(t, []byte("value"), data)
+	})
+
+	t.Run("delete during a read", func(t *testing.T) {
+		hot, warm, cold := newTiers(t)
+		racing := &racingStore{Store: cold}
+		store, err := imagine.NewTieredStorage(imagine.TieredStoreParams{
+			Tiers:       []imagine.Store{hot, warm, racing},
+			WritePolicy: imagine.TierWriteAround,
+		})
+		assert.NoError(t, err)
+		defer store.Close()
+
+		// the key is deleted once read from the slowest tier, it isn't
+		// promoted back
+		assert.NoError(t, store.Set("key", []byte("value")))
+		racing.afterGet = func() { assert.NoError(t, store.Delete("key")) }
+		_, found, err := store.Get("key")
+		assert.NoError(t, err)
+		assert.True(t, found)
+		assert.False(t, has(hot, "key"))
+		assert.False(t, has(warm, "key"))
+		assert.False(t, has(cold, "key"))
+	})
+
+	t.Run("set during a read", func(t *testing.T) {
+		hot, warm, cold := newTiers(t)
+		racing := &racingStore{Store: cold}
+		store, err := imagine.NewTieredStorage(imagine.TieredStoreParams{
+			Tiers:       []imagine.Store{hot, warm, racing},
+			WritePolicy: imagine.TierWriteAround,
+		})
+		assert.NoError(t, err)
+		defer store.Close()
+
+		// the key is overwritten once read from the slowest tier, the
+		// previous value isn't promoted over the new one
+		assert.NoError(t, store.Set("key", []byte("old")))
+		racing.afterGet = func() { assert.NoError(t, store.Set("key", []byte("new"))) }
+		data, _, err := store.Get("key")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("old"), data)
+		assert.False(t, has(hot, "key"))
+
+		data, _, err = store.Get("key")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("new"), data)
+		data, _, _ = hot.Get("key")
+		assert.Equal(t, []byte("new"), data)
+	})
+
+	t.Run("failing tier", func(t *testing.T) {
+		hot, warm, cold := newTiers(t)
+		store, err := imagine.NewTieredStorage(imagine.TieredStoreParams{Tiers: []imagine.Store{hot, warm, cold}})
+		assert.NoError(t, err)
+		defer store.Close()
+
+		cold.setDown(true)
+		assert.ErrorIs(t, store.Set("key", []byte("value")), errUnavailable)
+		assert.False(t, has(hot, "key"))
+
+		// a miss can't be told apart from the failure
+		_, found, err := store.Get("key")
+		assert.ErrorIs(t, err, errUnavailable)
+		assert.False(t, found)
+	})
+
+	t.Run("params", func(t *testing.T) {
+		_, err := imagine.NewTieredStorage(imagine.TieredStoreParams{})
+		assert.Error(t, err)
+		_, err = imagine.NewTieredStorage(imagine.TieredStoreParams{
+			Tiers:       []imagine.Store{imagine.NewInMemoryStorage(imagine.MemoryStoreParams{})},
+			WritePolicy: "back",
+		})
+		assert.Error(t, err)
+	})
+}
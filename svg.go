@@ -0,0 +1,258 @@
+package imagine
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// ErrInvalidSVG is returned for SVG documents which can't be parsed
+var ErrInvalidSVG = errors.New("invalid svg document")
+
+// blockedSVGElements are removed along with their content
+var blockedSVGElements = map[string]bool{
+	"script":        true,
+	"foreignobject": true,
+	"iframe":        true,
+	"embed":         true,
+	"object":        true,
+	"handler":       true,
+	"listener":      true,
+}
+
+var (
+	// svgLengthMatcher splits a length into its value and unit
+	svgLengthMatcher = regexp.MustCompile(`^\s*([0-9]*\.?[0-9]+(?:[eE][-+]?[0-9]+)?)\s*(px|pt|pc|mm|cm|in)?\s*$`)
+
+	// cssURLMatcher matches the url() references of CSS
+	cssURLMatcher = regexp.MustCompile(`(?i)url\(\s*['"]?\s*([^'")\s]*)`)
+
+	// svgEscaper escapes text and attribute values. White space is kept as
+	// is and asterisks are escaped, bimg doesn't detect SVG documents with
+	// escaped white space in their prolog or containing asterisks.
+	svgEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;", "*", "&#42;")
+)
+
+// sanitizeSVG removes the scripts, event handlers and external references
+// of an SVG document, which are run or fetched by the rasterizer and browsers
+// displaying the original. The document size is multiplied by scale so it
+// is rasterized at a higher density.
+func sanitizeSVG(data []byte, scale float64) ([]byte, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	var out bytes.Buffer
+
+	root := true
+	skipping := 0
+	inStyle := false
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.Annotate(ErrInvalidSVG, err.Error())
+		}
+
+		if skipping > 0 {
+			switch token.(type) {
+			case xml.StartElement:
+				skipping++
+			case xml.EndElement:
+				skipping--
+			}
+			continue
+		}
+
+		switch t := token.(type) {
+		case xml.ProcInst:
+			// stylesheets processing instructions reference external files
+			if t.Target == "xml" {
+				out.WriteString("<?xml " + string(t.Inst) + "?>")
+			}
+
+		case xml.StartElement:
+			name := strings.ToLower(t.Name.Local)
+			if root && name != "svg" {
+				return nil, errors.Annotatef(ErrInvalidSVG, "unexpected root element %s", t.Name.Local)
+			}
+			if blockedSVGElements[name] || animatesUnsafeAttribute(t) {
+				skipping = 1
+				continue
+			}
+
+			attrs := sanitizeSVGAttrs(t.Attr)
+			if root && scale != 1 {
+				attrs = scaleSVG(attrs, scale)
+			}
+			root = false
+			inStyle = name == "style"
+
+			out.WriteString("<" + xmlName(t.Name))
+			for _, attr := range attrs {
+				out.WriteString(" " + xmlName(attr.Name) + `="` + svgEscaper.Replace(attr.Value) + `"`)
+			}
+			out.WriteString(">")
+
+		case xml.EndElement:
+			inStyle = false
+			out.WriteString("</" + xmlName(t.Name) + ">")
+
+		case xml.CharData:
+			if inStyle && externalCSS(string(t)) {
+				continue
+			}
+			out.WriteString(svgEscaper.Replace(string(t)))
+		}
+
+		// comments are dropped, directives too as they define entities
+	}
+
+	if root {
+		return nil, errors.Annotate(ErrInvalidSVG, "no svg element")
+	}
+
+	return out.Bytes(), nil
+}
+
+// xmlName writes a name along with its namespace prefix
+func xmlName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
+
+// sanitizeSVGAttrs drops event handlers and external references
+func sanitizeSVGAttrs(attrs []xml.Attr) []xml.Attr {
+	sanitized := make([]xml.Attr, 0, len(attrs))
+	for _, attr := range attrs {
+		name := strings.ToLower(attr.Name.Local)
+		value := strings.ToLower(strings.Join(strings.Fields(attr.Value), ""))
+
+		switch {
+		case strings.HasPrefix(name, "on"):
+			continue
+		case strings.Contains(value, "javascript:"):
+			continue
+		case name == "href" || name == "src":
+			if !internalReference(value) {
+				continue
+			}
+		case (name == "style" || strings.Contains(value, "url(")) && externalCSS(attr.Value):
+			// presentation attributes like fill or filter take url() too
+			continue
+		}
+
+		sanitized = append(sanitized, attr)
+	}
+
+	return sanitized
+}
+
+// animatesUnsafeAttribute tells whether an animation element targets a
+// reference or an event handler, which could sneak a script in
+func animatesUnsafeAttribute(element xml.StartElement) bool {
+	switch strings.ToLower(element.Name.Local) {
+	case "set", "animate", "animatemotion", "animatetransform":
+	default:
+		return false
+	}
+
+	for _, attr := range element.Attr {
+		if attr.Name.Local != "attributeName" {
+			continue
+		}
+		target := strings.ToLower(attr.Value)
+		if idx := strings.Index(target, ":"); idx >= 0 {
+			target = target[idx+1:]
+		}
+		if target == "href" || target == "src" || strings.HasPrefix(target, "on") {
+			return true
+		}
+	}
+	return false
+}
+
+// rasterDataURIs are the embedded images allowed, nested SVG documents
+// would escape the sanitization
+var rasterDataURIs = []string{"data:image/png", "data:image/jpeg", "data:image/jpg", "data:image/gif", "data:image/webp"}
+
+// internalReference tells whether a reference points inside the document
+func internalReference(value string) bool {
+	if value == "" || strings.HasPrefix(value, "#") {
+		return true
+	}
+	for _, prefix := range rasterDataURIs {
+		if rest := strings.TrimPrefix(value, prefix); rest != value && (strings.HasPrefix(rest, ";") || strings.HasPrefix(rest, ",")) {
+			return true
+		}
+	}
+	return false
+}
+
+// externalCSS tells whether a stylesheet imports or references external
+// resources
+func externalCSS(css string) bool {
+	if strings.Contains(strings.ToLower(css), "@import") {
+		return true
+	}
+	for _, match := range cssURLMatcher.FindAllStringSubmatch(css, -1) {
+		if !internalReference(strings.ToLower(match[1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// scaleSVG multiplies the width and height of the root element by scale.
+// Missing or relative sizes are taken from the view box.
+func scaleSVG(attrs []xml.Attr, scale float64) []xml.Attr {
+	var viewBox []string
+	width, height := -1, -1
+	for idx, attr := range attrs {
+		switch attr.Name.Local {
+		case "viewBox":
+			viewBox = strings.Fields(strings.ReplaceAll(attr.Value, ",", " "))
+		case "width":
+			width = idx
+		case "height":
+			height = idx
+		}
+	}
+
+	scaled := func(idx int, viewBoxSize int) (string, bool) {
+		if idx >= 0 {
+			if m := svgLengthMatcher.FindStringSubmatch(attrs[idx].Value); m != nil {
+				v, _ := strconv.ParseFloat(m[1], 64)
+				return strconv.FormatFloat(v*scale, 'f', -1, 64) + m[2], true
+			}
+		}
+		if len(viewBox) == 4 {
+			if v, err := strconv.ParseFloat(viewBox[viewBoxSize], 64); err == nil {
+				return strconv.FormatFloat(v*scale, 'f', -1, 64), true
+			}
+		}
+		return "", false
+	}
+
+	for _, size := range []struct {
+		name        string
+		idx         int
+		viewBoxSize int
+	}{{"width", width, 2}, {"height", height, 3}} {
+		value, ok := scaled(size.idx, size.viewBoxSize)
+		switch {
+		case !ok:
+		case size.idx >= 0:
+			attrs[size.idx].Value = value
+		default:
+			attrs = append(attrs, xml.Attr{Name: xml.Name{Local: size.name}, Value: value})
+		}
+	}
+
+	return attrs
+}
@@ -0,0 +1,150 @@
+package imagine
+
+import (
+	"math"
+
+	"github.com/juju/errors"
+)
+
+// encodeThumbHash computes the ThumbHash (https://evanw.github.io/thumbhash/)
+// of an RGBA pixel buffer. The image must be at most 100x100 pixels.
+func encodeThumbHash(pixels []uint8, width, height int) ([]byte, error) {
+	if width > 100 || height > 100 {
+		return nil, errors.Errorf("thumbhash: image must be at most 100x100, got %dx%d", width, height)
+	}
+	if width == 0 || height == 0 || len(pixels) < width*height*4 {
+		return nil, errors.New("thumbhash: empty image")
+	}
+
+	// JavaScript's Math.round, which the reference implementation relies on
+	round := func(v float64) int { return int(math.Floor(v + 0.5)) }
+
+	// determine the average color
+	var avgR, avgG, avgB, avgA float64
+	for i := 0; i < width*height; i++ {
+		alpha := float64(pixels[i*4+3]) / 255
+		avgR += alpha / 255 * float64(pixels[i*4])
+		avgG += alpha / 255 * float64(pixels[i*4+1])
+		avgB += alpha / 255 * float64(pixels[i*4+2])
+		avgA += alpha
+	}
+	if avgA > 0 {
+		avgR /= avgA
+		avgG /= avgA
+		avgB /= avgA
+	}
+
+	hasAlpha := avgA < float64(width*height)
+	lLimit := 7.0
+	if hasAlpha {
+		lLimit = 5
+	}
+	longest := math.Max(float64(width), float64(height))
+	lx := int(math.Max(1, float64(round(lLimit*float64(width)/longest))))
+	ly := int(math.Max(1, float64(round(lLimit*float64(height)/longest))))
+
+	// convert the image from RGBA to LPQA, composited on top of the average color
+	l := make([]float64, width*height)
+	p := make([]float64, width*height)
+	q := make([]float64, width*height)
+	a := make([]float64, width*height)
+	for i := 0; i < width*height; i++ {
+		alpha := float64(pixels[i*4+3]) / 255
+		r := avgR*(1-alpha) + alpha/255*float64(pixels[i*4])
+		g := avgG*(1-alpha) + alpha/255*float64(pixels[i*4+1])
+		b := avgB*(1-alpha) + alpha/255*float64(pixels[i*4+2])
+		l[i] = (r + g + b) / 3
+		p[i] = (r+g)/2 - b
+		q[i] = r - g
+		a[i] = alpha
+	}
+
+	encodeChannel := func(channel []float64, nx, ny int) (dc float64, ac []float64, scale float64) {
+		fx := make([]float64, width)
+		for cy := 0; cy < ny; cy++ {
+			for cx := 0; cx*ny < nx*(ny-cy); cx++ {
+				for x := 0; x < width; x++ {
+					fx[x] = math.Cos(math.Pi / float64(width) * float64(cx) * (float64(x) + 0.5))
+				}
+
+				f := 0.0
+				for y := 0; y < height; y++ {
+					fy := math.Cos(math.Pi / float64(height) * float64(cy) * (float64(y) + 0.5))
+					for x := 0; x < width; x++ {
+						f += channel[x+y*width] * fx[x] * fy
+					}
+				}
+				f /= float64(width * height)
+
+				if cx > 0 || cy > 0 {
+					ac = append(ac, f)
+					scale = math.Max(scale, math.Abs(f))
+				} else {
+					dc = f
+				}
+			}
+		}
+
+		if scale > 0 {
+			for i := range ac {
+				ac[i] = 0.5 + 0.5/scale*ac[i]
+			}
+		}
+
+		return dc, ac, scale
+	}
+
+	lDC, lAC, lScale := encodeChannel(l, maxInt(3, lx), maxInt(3, ly))
+	pDC, pAC, pScale := encodeChannel(p, 3, 3)
+	qDC, qAC, qScale := encodeChannel(q, 3, 3)
+	var aDC, aScale float64
+	var aAC []float64
+	if hasAlpha {
+		aDC, aAC, aScale = encodeChannel(a, 5, 5)
+	}
+
+	// write the constants
+	isLandscape := width > height
+	header24 := round(63*lDC) | round(31.5+31.5*pDC)<<6 | round(31.5+31.5*qDC)<<12 | round(31*lScale)<<18
+	if hasAlpha {
+		header24 |= 1 << 23
+	}
+	header16 := round(63*pScale)<<3 | round(63*qScale)<<9
+	if isLandscape {
+		header16 |= ly | 1<<15
+	} else {
+		header16 |= lx
+	}
+
+	hash := []byte{
+		byte(header24 & 255), byte((header24 >> 8) & 255), byte(header24 >> 16),
+		byte(header16 & 255), byte(header16 >> 8),
+	}
+	channels := [][]float64{lAC, pAC, qAC}
+	if hasAlpha {
+		hash = append(hash, byte(round(15*aDC)|round(15*aScale)<<4))
+		channels = append(channels, aAC)
+	}
+
+	// write the varying factors, two per byte
+	acStart, acIndex := len(hash), 0
+	for _, ac := range channels {
+		for _, f := range ac {
+			pos := acStart + acIndex>>1
+			for len(hash) <= pos {
+				hash = append(hash, 0)
+			}
+			hash[pos] |= byte(round(15*f) << ((acIndex & 1) << 2))
+			acIndex++
+		}
+	}
+
+	return hash, nil
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,534 @@
+package imagine
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,creation-with-upload,termination,expiration"
+	tusChunkType  = "application/offset+octet-stream"
+)
+
+// TusParams configures the resumable uploads endpoint, implementing the tus
+// 1.0 protocol (https://tus.io/protocols/resumable-upload)
+type TusParams struct {
+	// Store stages the chunks of uploads in progress. Defaults to an in
+	// memory store, use a shared store when running several instances.
+	Store Store
+
+	// BasePath is the path the handler is mounted on, the upload URLs are
+	// built from it. Defaults to /uploads/.
+	BasePath string
+
+	// Expiration is how long an upload can be resumed after its creation.
+	// Defaults to 24 hours.
+	Expiration time.Duration
+
+	// SweepInterval is how often the expired uploads are removed, while an
+	// instance has uploads in progress. Defaults to 10 minutes.
+	SweepInterval time.Duration
+
+	// MaxUploads is the number of uploads in progress an instance accepts.
+	// Defaults to 100.
+	MaxUploads int
+
+	// MaxBytes is the total length of the uploads in progress an instance
+	// accepts. Defaults to 256MB.
+	MaxBytes int64
+}
+
+// withDefaults sets the default values for the resumable uploads
+func (p *TusParams) withDefaults() {
+	if p.Store == nil {
+		p.Store = NewInMemoryStorage(MemoryStoreParams{})
+	}
+	if p.BasePath == "" {
+		p.BasePath = "/uploads/"
+	}
+	if !strings.HasSuffix(p.BasePath, "/") {
+		p.BasePath += "/"
+	}
+	if p.Expiration == 0 {
+		p.Expiration = 24 * time.Hour
+	}
+	if p.SweepInterval == 0 {
+		p.SweepInterval = 10 * time.Minute
+	}
+	if p.MaxUploads == 0 {
+		p.MaxUploads = 100
+	}
+	if p.MaxBytes == 0 {
+		p.MaxBytes = 256 << 20
+	}
+}
+
+// tusUpload is the state of a resumable upload, the data is staged in one
+// chunk per PATCH request
+type tusUpload struct {
+	Length    int64     `json:"length"`
+	Offset    int64     `json:"offset"`
+	Chunks    []int64   `json:"chunks"`
+	Metadata  string    `json:"metadata,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+
+	// Slug is the slug of the completed upload, which isn't saved
+	Slug string `json:"-"`
+}
+
+// tusPending is an upload in progress created by this instance
+type tusPending struct {
+	length  int64
+	expires time.Time
+}
+
+// tusServer serves the resumable uploads
+type tusServer struct {
+	imagine *Imagine
+	params  TusParams
+
+	// locks prevents concurrent requests on the same upload
+	mu    sync.Mutex
+	locks map[string]bool
+
+	// pending are the uploads in progress, swept once expired while
+	// sweeping is set
+	pending      map[string]tusPending
+	pendingBytes int64
+	sweeping     bool
+}
+
+func newTusServer(imagine *Imagine, params TusParams) *tusServer {
+	return &tusServer{
+		imagine: imagine,
+		params:  params,
+		locks:   map[string]bool{},
+		pending: map[string]tusPending{},
+	}
+}
+
+// the keys are flat, stores such as the local one don't create directories
+func tusInfoKey(id string) string {
+	return "tus-" + id + "-info"
+}
+
+func tusChunkKey(id string, offset int64) string {
+	return fmt.Sprintf("tus-%s-%d", id, offset)
+}
+
+// TusHandlerFunc handles resumable uploads, completed uploads are uploaded
+// like any other and their slug returned in the Imagine-Slug header
+func (i *Imagine) TusHandlerFunc() http.HandlerFunc {
+	return http.HandlerFunc(i.tus.handle)
+}
+
+func (t *tusServer) handle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		w.Header().Set("Tus-Max-Size", strconv.Itoa(t.imagine.params.MaxImageSize))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, t.params.BasePath)
+	if r.Method == http.MethodPost && id == "" {
+		t.create(w, r)
+		return
+	}
+	if id == "" || strings.Contains(id, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !t.lock(id) {
+		http.Error(w, "upload in use by another request", http.StatusLocked)
+		return
+	}
+	defer t.unlock(id)
+
+	upload, err := t.load(id)
+	if err != nil && errors.Cause(err) == ErrKeyNotFound {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if time.Now().After(upload.ExpiresAt) {
+		if err := t.terminate(id, upload); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, "upload expired", http.StatusGone)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		t.writeState(w, upload)
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPatch:
+		t.patch(w, r, id, upload)
+	case http.MethodDelete:
+		if err := t.terminate(id, upload); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// create starts an upload, with its first chunk when the request has a body
+func (t *tusServer) create(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "invalid or missing Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if length == 0 {
+		http.Error(w, "empty uploads can't be images", http.StatusBadRequest)
+		return
+	}
+	if length > int64(t.imagine.params.MaxImageSize) {
+		http.Error(w, fmt.Sprintf("upload exceeds the maximum image size of %d bytes", t.imagine.params.MaxImageSize),
+			http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	id := hex.EncodeToString(random)
+
+	upload := &tusUpload{
+		Length:    length,
+		Metadata:  r.Header.Get("Upload-Metadata"),
+		ExpiresAt: time.Now().Add(t.params.Expiration).UTC(),
+	}
+	if err := t.track(id, upload); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err := t.save(id, upload); err != nil {
+		t.forget(id)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Printf("[Imagine] Created resumable upload %s of %d bytes\n", id, length)
+
+	w.Header().Set("Location", t.params.BasePath+id)
+	if r.Header.Get("Content-Type") == tusChunkType {
+		t.lock(id)
+		defer t.unlock(id)
+		if err := t.write(id, upload, r.Body); err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+	}
+
+	t.writeState(w, upload)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// patch appends a chunk to an upload
+func (t *tusServer) patch(w http.ResponseWriter, r *http.Request, id string, upload *tusUpload) {
+	if r.Header.Get("Content-Type") != tusChunkType {
+		http.Error(w, "chunks must be sent as "+tusChunkType, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid or missing Upload-Offset", http.StatusBadRequest)
+		return
+	}
+	if offset != upload.Offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		http.Error(w, "offset doesn't match the upload", http.StatusConflict)
+		return
+	}
+
+	if err := t.write(id, upload, r.Body); err != nil {
+		t.writeState(w, upload)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	t.writeState(w, upload)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// write stages a chunk and completes the upload once all the data is there.
+// What was received of an interrupted chunk is kept so it can be resumed.
+func (t *tusServer) write(id string, upload *tusUpload, body io.Reader) error {
+	// read one byte more than expected to catch overflowing chunks
+	remaining := upload.Length - upload.Offset
+	chunk, readErr := ioutil.ReadAll(io.LimitReader(body, remaining+1))
+	if int64(len(chunk)) > remaining {
+		return errors.Annotatef(ErrFileTooLarge, "chunk goes past the upload length of %d bytes", upload.Length)
+	}
+
+	if len(chunk) > 0 {
+		if err := t.params.Store.Set(tusChunkKey(id, upload.Offset), chunk); err != nil {
+			return errors.Trace(err)
+		}
+		upload.Chunks = append(upload.Chunks, upload.Offset)
+		upload.Offset += int64(len(chunk))
+		if err := t.save(id, upload); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if readErr != nil {
+		return errors.Annotate(readErr, "chunk interrupted")
+	}
+
+	if upload.Offset < upload.Length {
+		return nil
+	}
+	return errors.Trace(t.complete(id, upload))
+}
+
+// complete uploads the assembled data and drops the upload
+func (t *tusServer) complete(id string, upload *tusUpload) error {
+	data := make([]byte, 0, upload.Length)
+	for _, offset := range upload.Chunks {
+		chunk, found, err := t.params.Store.Get(tusChunkKey(id, offset))
+		if err != nil && errors.Cause(err) != ErrKeyNotFound {
+			return errors.Trace(err)
+		} else if err != nil || !found {
+			return errors.Errorf("chunk at offset %d of upload %s is missing", offset, id)
+		}
+		data = append(data, chunk...)
+	}
+
+	result, err := t.imagine.upload(data, t.imagine.params.UploadPolicy)
+	if err != nil {
+		// the upload is rejected as a whole, there's nothing to resume
+		if err := t.terminate(id, upload); err != nil {
+			fmt.Printf("[Imagine] Could not remove rejected upload %s: %v\n", id, err)
+		}
+		return errors.Trace(err)
+	}
+	fmt.Printf("[Imagine] Completed resumable upload %s as %s\n", id, result.Slug)
+
+	upload.Slug = result.Slug
+	return errors.Trace(t.terminate(id, upload))
+}
+
+// terminate removes an upload and its chunks
+func (t *tusServer) terminate(id string, upload *tusUpload) error {
+	t.forget(id)
+	for _, offset := range upload.Chunks {
+		if err := t.params.Store.Delete(tusChunkKey(id, offset)); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return errors.Trace(t.params.Store.Delete(tusInfoKey(id)))
+}
+
+// track records an upload in progress, unless the instance has too many of
+// them, and sweeps them while there are some
+func (t *tusServer) track(id string, upload *tusUpload) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.pending) >= t.params.MaxUploads {
+		return errors.Errorf("too many uploads in progress, try again later")
+	}
+	if t.pendingBytes+upload.Length > t.params.MaxBytes {
+		return errors.Errorf("too many bytes being uploaded, try again later")
+	}
+	t.pending[id] = tusPending{length: upload.Length, expires: upload.ExpiresAt}
+	t.pendingBytes += upload.Length
+
+	if !t.sweeping {
+		t.sweeping = true
+		go t.sweep()
+	}
+	return nil
+}
+
+// forget stops tracking a completed or removed upload
+func (t *tusServer) forget(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if pending, ok := t.pending[id]; ok {
+		delete(t.pending, id)
+		t.pendingBytes -= pending.length
+	}
+}
+
+// sweep periodically removes the expired uploads, until none of this
+// instance is left. Stores implementing Lister are listed for the uploads
+// abandoned by other instances too.
+func (t *tusServer) sweep() {
+	ticker := time.NewTicker(t.params.SweepInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+		var expired []string
+
+		t.mu.Lock()
+		if len(t.pending) == 0 {
+			t.sweeping = false
+			t.mu.Unlock()
+			return
+		}
+		for id, pending := range t.pending {
+			if now.After(pending.expires) {
+				expired = append(expired, id)
+			}
+		}
+		t.mu.Unlock()
+
+		abandoned, err := t.abandoned(now)
+		if err != nil {
+			fmt.Printf("[Imagine] Could not list abandoned uploads: %v\n", err)
+		}
+		expired = append(expired, abandoned...)
+
+		for _, id := range expired {
+			// uploads in use are swept next time
+			if !t.lock(id) {
+				continue
+			}
+
+			upload, err := t.load(id)
+			if err != nil && errors.Cause(err) == ErrKeyNotFound {
+				// removed by another instance
+				t.forget(id)
+			} else if err != nil {
+				fmt.Printf("[Imagine] Could not load expired upload %s: %v\n", id, err)
+			} else if err := t.terminate(id, upload); err != nil {
+				fmt.Printf("[Imagine] Could not remove expired upload %s: %v\n", id, err)
+			}
+			t.unlock(id)
+		}
+	}
+}
+
+// abandoned lists the expired uploads of the store which this instance
+// doesn't track, left by other instances, e.g. stopped ones
+func (t *tusServer) abandoned(now time.Time) ([]string, error) {
+	lister, ok := t.params.Store.(Lister)
+	if !ok {
+		return nil, nil
+	}
+
+	var ids []string
+	options := ListOptions{Prefix: "tus-", Limit: 1000}
+	for {
+		page, err := lister.List(options)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		for _, entry := range page.Entries {
+			if !strings.HasSuffix(entry.Key, "-info") {
+				continue
+			}
+			id := strings.TrimSuffix(strings.TrimPrefix(entry.Key, "tus-"), "-info")
+
+			t.mu.Lock()
+			_, tracked := t.pending[id]
+			t.mu.Unlock()
+			if tracked {
+				continue
+			}
+
+			// uploads removed meanwhile are skipped
+			upload, err := t.load(id)
+			if err == nil && now.After(upload.ExpiresAt) {
+				ids = append(ids, id)
+			}
+		}
+
+		if page.NextCursor == "" {
+			return ids, nil
+		}
+		options.Cursor = page.NextCursor
+	}
+}
+
+// writeState sets the headers describing an upload
+func (t *tusServer) writeState(w http.ResponseWriter, upload *tusUpload) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	if upload.Metadata != "" {
+		w.Header().Set("Upload-Metadata", upload.Metadata)
+	}
+	if upload.Slug != "" {
+		w.Header().Set("Imagine-Slug", upload.Slug)
+	} else {
+		w.Header().Set("Upload-Expires", upload.ExpiresAt.Format(http.TimeFormat))
+	}
+}
+
+func (t *tusServer) load(id string) (*tusUpload, error) {
+	data, found, err := t.params.Store.Get(tusInfoKey(id))
+	if err != nil {
+		return nil, errors.Trace(err)
+	} else if !found {
+		return nil, errors.Trace(ErrKeyNotFound)
+	}
+
+	var upload tusUpload
+	if err := json.Unmarshal(data, &upload); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &upload, nil
+}
+
+func (t *tusServer) save(id string, upload *tusUpload) error {
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(t.params.Store.Set(tusInfoKey(id), data))
+}
+
+func (t *tusServer) lock(id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.locks[id] {
+		return false
+	}
+	t.locks[id] = true
+	return true
+}
+
+func (t *tusServer) unlock(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.locks, id)
+}
@@ -0,0 +1,271 @@
+package imagine_test
+
+import (
+	"bytes"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/risico/imagine"
+)
+
+func TestTusUpload(t *testing.T) {
+	storage := imagine.NewInMemoryStorage(imagine.MemoryStoreParams{})
+	staging := imagine.NewInMemoryStorage(imagine.MemoryStoreParams{})
+	i, err := imagine.New(imagine.Params{
+		Storage: storage,
+		Cache:   imagine.NewInMemoryStorage(imagine.MemoryStoreParams{}),
+		Tus:     imagine.TusParams{Store: staging, Expiration: time.Hour},
+	})
+	assert.NoError(t, err)
+	handler := i.TusHandlerFunc()
+
+	request := func(method, target string, headers map[string]string, body []byte) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, bytes.NewReader(body))
+		r.Header.Set("Tus-Resumable", "1.0.0")
+		for name, value := range headers {
+			r.Header.Set(name, value)
+		}
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, r)
+		return response
+	}
+	create := func(length int) string {
+		response := request(http.MethodPost, "/uploads/", map[string]string{"Upload-Length": strconv.Itoa(length)}, nil)
+		assert.Equal(t, http.StatusCreated, response.Code)
+		assert.NotEmpty(t, response.Header().Get("Upload-Expires"))
+		return response.Header().Get("Location")
+	}
+	patch := func(location string, offset int, chunk []byte) *httptest.ResponseRecorder {
+		return request(http.MethodPatch, location, map[string]string{
+			"Content-Type":  "application/offset+octet-stream",
+			"Upload-Offset": strconv.Itoa(offset),
+		}, chunk)
+	}
+
+	t.Run("discovery", func(t *testing.T) {
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, httptest.NewRequest(http.MethodOptions, "/uploads/", nil))
+		assert.Equal(t, http.StatusNoContent, response.Code)
+		assert.Contains(t, response.Header().Get("Tus-Extension"), "termination")
+
+		response = httptest.NewRecorder()
+		handler.ServeHTTP(response, httptest.NewRequest(http.MethodPost, "/uploads/", nil))
+		assert.Equal(t, http.StatusPreconditionFailed, response.Code)
+	})
+
+	t.Run("resumed upload", func(t *testing.T) {
+		image := solidImage(t, 30, 20, color.White)
+		location := create(len(image))
+
+		response := patch(location, 0, image[:10])
+		assert.Equal(t, http.StatusNoContent, response.Code)
+		assert.Equal(t, "10", response.Header().Get("Upload-Offset"))
+
+		// a chunk sent at the wrong offset is refused
+		response = patch(location, 5, image[5:])
+		assert.Equal(t, http.StatusConflict, response.Code)
+
+		response = request(http.MethodHead, location, nil, nil)
+		assert.Equal(t, http.StatusOK, response.Code)
+		assert.Equal(t, "10", response.Header().Get("Upload-Offset"))
+		assert.Equal(t, strconv.Itoa(len(image)), response.Header().Get("Upload-Length"))
+		assert.Equal(t, "no-store", response.Header().Get("Cache-Control"))
+
+		response = patch(location, 10, image[10:])
+		assert.Equal(t, http.StatusNoContent, response.Code)
+		slug := response.Header().Get("Imagine-Slug")
+		assert.NotEmpty(t, slug)
+
+		stored, found, err := storage.Get(slug)
+		assert.NoError(t, err)
+		assert.True(t, found)
+		assert.Equal(t, image, stored)
+
+		// the completed upload is dropped
+		assert.Equal(t, http.StatusNotFound, request(http.MethodHead, location, nil, nil).Code)
+		page, err := staging.(imagine.Lister).List(imagine.ListOptions{})
+		assert.NoError(t, err)
+		assert.Empty(t, page.Entries)
+	})
+
+	t.Run("creation with upload", func(t *testing.T) {
+		image := solidImage(t, 10, 10, color.Black)
+		response := request(http.MethodPost, "/uploads/", map[string]string{
+			"Upload-Length": strconv.Itoa(len(image)),
+			"Content-Type":  "application/offset+octet-stream",
+		}, image)
+		assert.Equal(t, http.StatusCreated, response.Code)
+		assert.NotEmpty(t, response.Header().Get("Imagine-Slug"))
+	})
+
+	t.Run("termination", func(t *testing.T) {
+		location := create(100)
+		assert.Equal(t, http.StatusNoContent, patch(location, 0, make([]byte, 50)).Code)
+
+		response := request(http.MethodDelete, location, nil, nil)
+		assert.Equal(t, http.StatusNoContent, response.Code)
+		assert.Equal(t, http.StatusNotFound, request(http.MethodHead, location, nil, nil).Code)
+	})
+
+	t.Run("limits", func(t *testing.T) {
+		response := request(http.MethodPost, "/uploads/", map[string]string{"Upload-Length": "2000000"}, nil)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, response.Code)
+		response = request(http.MethodPost, "/uploads/", map[string]string{"Upload-Length": "0"}, nil)
+		assert.Equal(t, http.StatusBadRequest, response.Code)
+
+		location := create(10)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, patch(location, 0, make([]byte, 11)).Code)
+
+		// an invalid image is dropped once complete
+		assert.Equal(t, http.StatusInternalServerError, patch(location, 0, make([]byte, 10)).Code)
+		assert.Equal(t, http.StatusNotFound, request(http.MethodHead, location, nil, nil).Code)
+	})
+
+	t.Run("local staging store", func(t *testing.T) {
+		local, err := imagine.NewLocalStorage(imagine.LocalStoreParams{Path: t.TempDir()})
+		assert.NoError(t, err)
+		i, err := imagine.New(imagine.Params{
+			Storage: storage,
+			Cache:   imagine.NewInMemoryStorage(imagine.MemoryStoreParams{}),
+			Tus:     imagine.TusParams{Store: local},
+		})
+		assert.NoError(t, err)
+
+		image := solidImage(t, 10, 10, color.Black)
+		r := httptest.NewRequest(http.MethodPost, "/uploads/", bytes.NewReader(image))
+		r.Header.Set("Tus-Resumable", "1.0.0")
+		r.Header.Set("Upload-Length", strconv.Itoa(len(image)))
+		r.Header.Set("Content-Type", "application/offset+octet-stream")
+		response := httptest.NewRecorder()
+		i.TusHandlerFunc().ServeHTTP(response, r)
+		assert.Equal(t, http.StatusCreated, response.Code)
+		assert.NotEmpty(t, response.Header().Get("Imagine-Slug"))
+	})
+
+	t.Run("uploads in progress", func(t *testing.T) {
+		staging := imagine.NewInMemoryStorage(imagine.MemoryStoreParams{})
+		limited, err := imagine.New(imagine.Params{
+			Storage: storage,
+			Tus: imagine.TusParams{
+				Store:         staging,
+				Expiration:    20 * time.Millisecond,
+				SweepInterval: 10 * time.Millisecond,
+				MaxUploads:    2,
+				MaxBytes:      100,
+			},
+		})
+		assert.NoError(t, err)
+		create := func(length int) *httptest.ResponseRecorder {
+			r := httptest.NewRequest(http.MethodPost, "/uploads/", nil)
+			r.Header.Set("Tus-Resumable", "1.0.0")
+			r.Header.Set("Upload-Length", strconv.Itoa(length))
+			response := httptest.NewRecorder()
+			limited.TusHandlerFunc().ServeHTTP(response, r)
+			return response
+		}
+
+		assert.Equal(t, http.StatusServiceUnavailable, create(101).Code)
+		assert.Equal(t, http.StatusCreated, create(60).Code)
+		assert.Equal(t, http.StatusServiceUnavailable, create(60).Code)
+		assert.Equal(t, http.StatusCreated, create(40).Code)
+		assert.Equal(t, http.StatusServiceUnavailable, create(1).Code)
+
+		// abandoned uploads are swept once expired
+		time.Sleep(50 * time.Millisecond)
+		page, err := staging.(imagine.Lister).List(imagine.ListOptions{})
+		assert.NoError(t, err)
+		assert.Empty(t, page.Entries)
+		assert.Equal(t, http.StatusCreated, create(100).Code)
+	})
+
+	t.Run("uploads of other instances", func(t *testing.T) {
+		staging := imagine.NewInMemoryStorage(imagine.MemoryStoreParams{})
+		instance := func(sweepInterval time.Duration) http.HandlerFunc {
+			i, err := imagine.New(imagine.Params{
+				Storage: storage,
+				Tus: imagine.TusParams{
+					Store:         staging,
+					Expiration:    20 * time.Millisecond,
+					SweepInterval: sweepInterval,
+				},
+			})
+			assert.NoError(t, err)
+			return i.TusHandlerFunc()
+		}
+		stopped, sweeping := instance(time.Hour), instance(10*time.Millisecond)
+
+		for _, handler := range []http.HandlerFunc{stopped, sweeping} {
+			r := httptest.NewRequest(http.MethodPost, "/uploads/", nil)
+			r.Header.Set("Tus-Resumable", "1.0.0")
+			r.Header.Set("Upload-Length", "10")
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, r)
+			assert.Equal(t, http.StatusCreated, response.Code)
+		}
+
+		// the upload of the stopped instance is swept by the other one
+		time.Sleep(50 * time.Millisecond)
+		page, err := staging.(imagine.Lister).List(imagine.ListOptions{})
+		assert.NoError(t, err)
+		assert.Empty(t, page.Entries)
+	})
+
+	t.Run("expiration", func(t *testing.T) {
+		expiring, err := imagine.New(imagine.Params{
+			Storage: storage,
+			Tus:     imagine.TusParams{Store: staging, Expiration: time.Nanosecond},
+		})
+		assert.NoError(t, err)
+
+		r := httptest.NewRequest(http.MethodPost, "/uploads/", nil)
+		r.Header.Set("Tus-Resumable", "1.0.0")
+		r.Header.Set("Upload-Length", "10")
+		response := httptest.NewRecorder()
+		expiring.TusHandlerFunc().ServeHTTP(response, r)
+		assert.Equal(t, http.StatusCreated, response.Code)
+
+		time.Sleep(time.Millisecond)
+		r = httptest.NewRequest(http.MethodHead, response.Header().Get("Location"), nil)
+		r.Header.Set("Tus-Resumable", "1.0.0")
+		response = httptest.NewRecorder()
+		expiring.TusHandlerFunc().ServeHTTP(response, r)
+		assert.Equal(t, http.StatusGone, response.Code)
+
+		// an expired upload which can't be removed is an error
+		undeletable, err := imagine.New(imagine.Params{
+			Storage: storage,
+			Tus:     imagine.TusParams{Store: undeletableStore{staging}, Expiration: time.Nanosecond},
+		})
+		assert.NoError(t, err)
+
+		r = httptest.NewRequest(http.MethodPost, "/uploads/", nil)
+		r.Header.Set("Tus-Resumable", "1.0.0")
+		r.Header.Set("Upload-Length", "10")
+		response = httptest.NewRecorder()
+		undeletable.TusHandlerFunc().ServeHTTP(response, r)
+		assert.Equal(t, http.StatusCreated, response.Code)
+
+		time.Sleep(time.Millisecond)
+		r = httptest.NewRequest(http.MethodHead, response.Header().Get("Location"), nil)
+		r.Header.Set("Tus-Resumable", "1.0.0")
+		response = httptest.NewRecorder()
+		undeletable.TusHandlerFunc().ServeHTTP(response, r)
+		assert.Equal(t, http.StatusInternalServerError, response.Code)
+	})
+}
+
+// undeletableStore wraps a store, failing every delete
+type undeletableStore struct {
+	imagine.Store
+}
+
+func (u undeletableStore) Delete(key string) error {
+	return errors.New("delete failed")
+}
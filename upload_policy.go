@@ -0,0 +1,210 @@
+package imagine
+
+import (
+	"net/http"
+
+	"github.com/h2non/bimg"
+	"github.com/juju/errors"
+)
+
+var (
+	// ErrFormatNotAllowed is returned for uploads in a format the upload
+	// policy doesn't allow
+	ErrFormatNotAllowed = errors.New("image format not allowed")
+	// ErrUploadRejected is returned for uploads whose dimensions or aspect
+	// ratio don't meet the upload policy
+	ErrUploadRejected = errors.New("image rejected by the upload policy")
+)
+
+// UploadPolicy configures how uploaded images are checked and optimized
+// before being stored
+type UploadPolicy struct {
+	// Formats are the allowed input formats: jpeg, png, gif, webp, avif,
+	// heif, tiff, svg or pdf. Defaults to all the formats libvips supports.
+	Formats []string
+
+	// MinWidth and MinHeight reject smaller images
+	MinWidth, MinHeight int
+
+	// MinAspectRatio and MaxAspectRatio reject images whose width divided
+	// by their height is out of range
+	MinAspectRatio, MaxAspectRatio float64
+
+	// MaxWidth and MaxHeight downscale larger images. Default to 4096.
+	MaxWidth, MaxHeight int
+
+	// TargetSize downscales and re-encodes larger files at Quality. Defaults
+	// to 10MB and 92.
+	TargetSize int
+	Quality    int
+
+	// CompressAbove re-encodes larger files at CompressQuality without
+	// downscaling them. Defaults to 5MB and 95.
+	CompressAbove   int
+	CompressQuality int
+
+	// Format is the format large files are re-encoded in: jpeg, webp, avif
+	// or png. Defaults to jpeg, which leaves PNG files untouched as they may
+	// be transparent.
+	Format string
+
+	// SkipOriginal doesn't keep the untouched uploads in Params.Originals
+	SkipOriginal bool
+}
+
+// withDefaults sets the default values for the upload policy
+func (p *UploadPolicy) withDefaults() {
+	if p.MaxWidth == 0 {
+		p.MaxWidth = 4096
+	}
+	if p.MaxHeight == 0 {
+		p.MaxHeight = 4096
+	}
+	if p.TargetSize == 0 {
+		p.TargetSize = 10 * 1024 * 1024
+	}
+	if p.Quality == 0 {
+		p.Quality = 92
+	}
+	if p.CompressAbove == 0 {
+		p.CompressAbove = 5 * 1024 * 1024
+	}
+	if p.CompressQuality == 0 {
+		p.CompressQuality = 95
+	}
+	if p.Format == "" {
+		p.Format = "jpeg"
+	}
+}
+
+// validate checks the formats named by the policy
+func (p *UploadPolicy) validate() error {
+	for _, format := range p.Formats {
+		if formatType(format) == bimg.UNKNOWN {
+			return errors.Errorf("invalid upload format %q", format)
+		}
+	}
+
+	switch formatType(p.Format) {
+	case bimg.JPEG, bimg.WEBP, bimg.AVIF, bimg.PNG:
+	default:
+		return errors.Errorf("invalid upload re-encoding format %q", p.Format)
+	}
+
+	if p.MaxAspectRatio > 0 && p.MinAspectRatio > p.MaxAspectRatio {
+		return errors.New("the minimum aspect ratio is over the maximum")
+	}
+	return nil
+}
+
+// formatType returns the image type named by format
+func formatType(format string) bimg.ImageType {
+	switch format {
+	case "jpeg", "jpg":
+		return bimg.JPEG
+	case "png":
+		return bimg.PNG
+	case "gif":
+		return bimg.GIF
+	case "webp":
+		return bimg.WEBP
+	case "avif":
+		return bimg.AVIF
+	case "heif", "heic":
+		return bimg.HEIF
+	case "tiff":
+		return bimg.TIFF
+	case "svg":
+		return bimg.SVG
+	case "pdf":
+		return bimg.PDF
+	}
+	return bimg.UNKNOWN
+}
+
+// fitWithin returns the width or the height to resize an image to so it fits
+// in the maximum dimensions, the other one is left to zero to keep the
+// aspect ratio
+func fitWithin(width, height, maxWidth, maxHeight int) (int, int) {
+	if width > maxWidth || height > maxHeight {
+		if float64(width)/float64(maxWidth) > float64(height)/float64(maxHeight) {
+			return maxWidth, 0
+		}
+		return 0, maxHeight
+	}
+
+	// keep the largest dimension, as when no maximum applies
+	if width > height {
+		return width, 0
+	}
+	return 0, height
+}
+
+// checkFormat checks the upload format is allowed by the policy
+func (p *UploadPolicy) checkFormat(data []byte) error {
+	if len(p.Formats) == 0 {
+		return nil
+	}
+
+	t := detectImageType(data)
+	for _, format := range p.Formats {
+		if formatType(format) == t {
+			return nil
+		}
+	}
+	return errors.Annotatef(ErrFormatNotAllowed, "%s uploads are not allowed", bimg.ImageTypeName(t))
+}
+
+// checkDimensions checks the upload dimensions, as displayed, against the
+// policy
+func (p *UploadPolicy) checkDimensions(data []byte) error {
+	width, height, err := imageDimensions(data)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// rotated orientations swap the dimensions
+	if metadata, err := bimg.Metadata(data); err == nil && metadata.Orientation >= 5 {
+		width, height = height, width
+	}
+
+	if width < p.MinWidth || height < p.MinHeight {
+		return errors.Annotatef(ErrUploadRejected, "%dx%d under the minimum of %dx%d",
+			width, height, p.MinWidth, p.MinHeight)
+	}
+
+	ratio := float64(width) / float64(height)
+	if (p.MinAspectRatio > 0 && ratio < p.MinAspectRatio) || (p.MaxAspectRatio > 0 && ratio > p.MaxAspectRatio) {
+		return errors.Annotatef(ErrUploadRejected, "aspect ratio %.2f out of range", ratio)
+	}
+	return nil
+}
+
+// UploadWithPolicy validates, optimizes and stores an image following the
+// given policy instead of the default one, returning its slug
+func (i *Imagine) UploadWithPolicy(data []byte, policy UploadPolicy) (string, error) {
+	policy.withDefaults()
+	if err := policy.validate(); err != nil {
+		return "", errors.Trace(err)
+	}
+
+	result, err := i.upload(data, policy)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	return result.Slug, nil
+}
+
+// UploadPolicyHandlerFunc handles the upload of images following the given
+// policy, so different endpoints can have different rules
+func (i *Imagine) UploadPolicyHandlerFunc(policy UploadPolicy) (http.HandlerFunc, error) {
+	policy.withDefaults()
+	if err := policy.validate(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		i.uploadHandler(w, r, policy)
+	}, nil
+}
@@ -0,0 +1,108 @@
+package imagine_test
+
+import (
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/h2non/bimg"
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/risico/imagine"
+)
+
+func TestUploadPolicy(t *testing.T) {
+	storage := imagine.NewInMemoryStorage(imagine.MemoryStoreParams{})
+	originals := imagine.NewInMemoryStorage(imagine.MemoryStoreParams{})
+	i, err := imagine.New(imagine.Params{
+		Storage:   storage,
+		Cache:     imagine.NewInMemoryStorage(imagine.MemoryStoreParams{}),
+		Originals: originals,
+		UploadPolicy: imagine.UploadPolicy{
+			MaxWidth:  64,
+			MaxHeight: 64,
+		},
+	})
+	assert.NoError(t, err)
+
+	t.Run("downscale and keep the original", func(t *testing.T) {
+		original := solidImage(t, 200, 100, color.White)
+		slug, err := i.Upload(original)
+		assert.NoError(t, err)
+
+		stored, _, err := storage.Get(slug)
+		assert.NoError(t, err)
+		assertSize(t, 64, 32, stored)
+
+		kept, found, err := originals.Get(slug)
+		assert.NoError(t, err)
+		assert.True(t, found)
+		assert.Equal(t, original, kept)
+
+		// documents are only kept sanitized
+		slug, err = i.Upload([]byte(testSVG))
+		assert.NoError(t, err)
+		kept, err = i.Original(slug)
+		assert.NoError(t, err)
+		assert.Contains(t, string(kept), "<svg")
+		assert.NotContains(t, string(kept), "<script")
+		assert.NotContains(t, string(kept), "onload")
+
+		slug, err = i.UploadWithPolicy(solidImage(t, 100, 200, color.White), imagine.UploadPolicy{SkipOriginal: true})
+		assert.NoError(t, err)
+		_, found, err = originals.Get(slug)
+		assert.NoError(t, err)
+		assert.False(t, found)
+	})
+
+	t.Run("avatars", func(t *testing.T) {
+		avatars := imagine.UploadPolicy{
+			Formats:        []string{"jpeg", "png"},
+			MinWidth:       50,
+			MinHeight:      50,
+			MinAspectRatio: 1,
+			MaxAspectRatio: 1,
+			CompressAbove:  1,
+			Format:         "webp",
+		}
+
+		_, err := i.UploadWithPolicy(solidImage(t, 40, 40, color.White), avatars)
+		assert.Equal(t, imagine.ErrUploadRejected, errors.Cause(err))
+
+		_, err = i.UploadWithPolicy(solidImage(t, 100, 50, color.White), avatars)
+		assert.Equal(t, imagine.ErrUploadRejected, errors.Cause(err))
+
+		_, err = i.UploadWithPolicy(animatedGIF(t, 50, 50), avatars)
+		assert.Equal(t, imagine.ErrFormatNotAllowed, errors.Cause(err))
+
+		slug, err := i.UploadWithPolicy(solidImage(t, 80, 80, color.White), avatars)
+		assert.NoError(t, err)
+		stored, _, err := storage.Get(slug)
+		assert.NoError(t, err)
+		assert.Equal(t, bimg.WEBP, bimg.DetermineImageType(stored))
+
+		handler, err := i.UploadPolicyHandlerFunc(avatars)
+		assert.NoError(t, err)
+
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, multipartRequest(t, "/", "file", animatedGIF(t, 50, 50)))
+		assert.Equal(t, http.StatusUnsupportedMediaType, response.Code)
+
+		response = httptest.NewRecorder()
+		handler.ServeHTTP(response, multipartRequest(t, "/", "file", solidImage(t, 40, 40, color.White)))
+		assert.Equal(t, http.StatusUnprocessableEntity, response.Code)
+	})
+
+	t.Run("invalid policies", func(t *testing.T) {
+		_, err := i.UploadPolicyHandlerFunc(imagine.UploadPolicy{Formats: []string{"bmp"}})
+		assert.Error(t, err)
+
+		_, err = imagine.New(imagine.Params{
+			Storage:      storage,
+			UploadPolicy: imagine.UploadPolicy{Format: "gif"},
+		})
+		assert.Error(t, err)
+	})
+}